@@ -0,0 +1,311 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Scopes that can be granted to an API key
+const (
+	scopeLinksRead  = "links:read"
+	scopeLinksWrite = "links:write"
+	scopeKeysAdmin  = "keys:admin"
+)
+
+var apiKeyScopes = []string{scopeLinksRead, scopeLinksWrite, scopeKeysAdmin}
+
+// apiKeyPrefix starts every generated key so that leaked keys are easy to recognize
+const apiKeyPrefix = "usk_"
+
+// APIKey grants programmatic access. Only a SHA-256 hash of the key is
+// stored; the key itself is shown once when it is created.
+type APIKey struct {
+	ID         int64     `json:"id"`
+	Name       string    `json:"name"`
+	UserID     int64     `json:"user_id"`
+	Owner      string    `json:"owner"`
+	OwnerRole  string    `json:"-"`
+	Prefix     string    `json:"prefix"`
+	Scopes     []string  `json:"scopes"`
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+}
+
+var (
+	errInvalidAPIKey = errors.New("invalid API key")
+	errExpiredAPIKey = errors.New("API key has expired")
+)
+
+// HasScope reports whether the key was granted a scope
+func (k APIKey) HasScope(scope string) bool {
+	return slices.Contains(k.Scopes, scope)
+}
+
+// Expired reports whether the key can no longer be used at the given time
+func (k APIKey) Expired(now time.Time) bool {
+	return !k.ExpiresAt.IsZero() && !now.Before(k.ExpiresAt)
+}
+
+// ScopeList returns the scopes of a key as a comma separated string
+func (k APIKey) ScopeList() string {
+	return strings.Join(k.Scopes, ", ")
+}
+
+// generateAPIKey returns a new random key. Keys carry 256 bits of entropy, so
+// a fast hash is enough to protect them at rest and still allows lookups.
+func generateAPIKey() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// hashToken hashes API keys and session tokens for storage
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// parseScopes reads a comma or space separated list of scopes
+func parseScopes(value string) ([]string, error) {
+	var scopes []string
+	for _, scope := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' }) {
+		if !slices.Contains(apiKeyScopes, scope) {
+			return nil, fmt.Errorf("unknown scope %q", scope)
+		}
+		if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	if len(scopes) == 0 {
+		return nil, errors.New("at least one scope is required")
+	}
+	return scopes, nil
+}
+
+// parseExpiry reads an expiry date (YYYY-MM-DD, the key expires at the start
+// of that day in server local time) or an RFC 3339 time. An empty value means
+// the key never expires.
+func parseExpiry(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid expiry %q", value)
+	}
+	return t, nil
+}
+
+// bearerToken returns the API key sent in the Authorization header of a request
+func bearerToken(r *http.Request) string {
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// authenticateAPIKey looks up a key, checks its expiry and records its use
+func authenticateAPIKey(db *sql.DB, token string, now time.Time) (APIKey, error) {
+	if !strings.HasPrefix(token, apiKeyPrefix) {
+		return APIKey{}, errInvalidAPIKey
+	}
+	key, err := queryAPIKeyByHash(db, hashToken(token))
+	if err == sql.ErrNoRows {
+		return APIKey{}, errInvalidAPIKey
+	}
+	if err != nil {
+		return APIKey{}, err
+	}
+	if key.Expired(now) {
+		return APIKey{}, errExpiredAPIKey
+	}
+	if err := updateAPIKeyLastUsed(db, key.ID, now); err != nil {
+		return APIKey{}, err
+	}
+	key.LastUsedAt = now
+	return key, nil
+}
+
+// APIKeyHandler is the admin page listing, creating and revoking API keys
+type APIKeyHandler struct {
+	db *sql.DB
+}
+
+// ServeHTTP implements the http.Handler interface
+func (h APIKeyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var created string
+	switch r.Method {
+	case "GET":
+	case "POST":
+		if r.FormValue("action") == "revoke" {
+			id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+			if err != nil {
+				http.Error(w, "Invalid key", http.StatusBadRequest)
+				return
+			}
+			if err := deleteAPIKey(h.db, id); err != nil {
+				http.Error(w, "Failed to revoke API key", http.StatusInternalServerError)
+				return
+			}
+			http.Redirect(w, r, "/keys", http.StatusSeeOther)
+			return
+		}
+
+		name := strings.TrimSpace(r.FormValue("name"))
+		if name == "" {
+			http.Error(w, "Key name is required", http.StatusBadRequest)
+			return
+		}
+		scopes, err := parseScopes(strings.Join(r.Form["scopes"], ","))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		expiresAt, err := parseExpiry(r.FormValue("expires"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		_, created, err = createAPIKey(h.db, name, requestAuth(r).ownerID(), scopes, expiresAt)
+		if err != nil {
+			http.Error(w, "Failed to create API key", http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	keys, err := queryAPIKeys(h.db)
+	if err != nil {
+		http.Error(w, "Failed to fetch API keys", http.StatusInternalServerError)
+		return
+	}
+
+	page := struct {
+		Title     string
+		Keys      []APIKey
+		Scopes    []string
+		Created   string
+		CSRFToken string
+	}{
+		Title:     "API Keys",
+		Keys:      keys,
+		Scopes:    apiKeyScopes,
+		Created:   created,
+		CSRFToken: csrfToken(w, r),
+	}
+
+	tmpl, err := template.ParseFiles("templates/api_keys.html")
+	if err != nil {
+		http.Error(w, "Failed to load template: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The page may contain a new key, which must not end up in any cache
+	w.Header().Set("Cache-Control", "no-store")
+	err = tmpl.Execute(w, page)
+	if err != nil {
+		http.Error(w, "Failed to execute template: "+err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// runAPIKeyCommand implements the apikey subcommand:
+//
+//	url_shortener apikey create -name deploy -scopes links:read,links:write [-expires 2026-12-31] [-user alice]
+//	url_shortener apikey list
+//	url_shortener apikey revoke <id>
+func runAPIKeyCommand(db *sql.DB, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("usage: apikey create|list|revoke")
+	}
+
+	switch args[0] {
+	case "create":
+		flags := flag.NewFlagSet("apikey create", flag.ContinueOnError)
+		flags.SetOutput(out)
+		name := flags.String("name", "", "name of the key")
+		scopeList := flags.String("scopes", scopeLinksRead+","+scopeLinksWrite, "comma separated scopes")
+		expires := flags.String("expires", "", "expiry date (YYYY-MM-DD) or RFC 3339 time")
+		username := flags.String("user", "", "user that links created with the key belong to")
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		if *name == "" {
+			return errors.New("-name is required")
+		}
+		scopes, err := parseScopes(*scopeList)
+		if err != nil {
+			return err
+		}
+		expiresAt, err := parseExpiry(*expires)
+		if err != nil {
+			return err
+		}
+		var userID int64
+		if *username != "" {
+			user, _, err := queryUserByName(db, *username)
+			if err != nil {
+				return fmt.Errorf("unknown user %q", *username)
+			}
+			userID = user.ID
+		}
+		key, token, err := createAPIKey(db, *name, userID, scopes, expiresAt)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Created API key %d (%s). Store it now, it is not shown again:\n%s\n", key.ID, key.Name, token)
+	case "list":
+		keys, err := queryAPIKeys(db)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			expires, lastUsed := "never", "never"
+			if !key.ExpiresAt.IsZero() {
+				expires = key.ExpiresAt.Format(time.RFC3339)
+			}
+			if !key.LastUsedAt.IsZero() {
+				lastUsed = key.LastUsedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(out, "%d\t%s\t%s...\t%s\tuser %s\texpires %s\tlast used %s\n", key.ID, key.Name, key.Prefix,
+				key.ScopeList(), key.Owner, expires, lastUsed)
+		}
+	case "revoke":
+		if len(args) != 2 {
+			return errors.New("usage: apikey revoke <id>")
+		}
+		id, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid key id %q", args[1])
+		}
+		if err := deleteAPIKey(db, id); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Revoked API key %d\n", id)
+	default:
+		return fmt.Errorf("unknown apikey command %q", args[0])
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseScopes(t *testing.T) {
+	scopes, err := parseScopes("links:read, links:write,links:read")
+	if err != nil || len(scopes) != 2 {
+		t.Errorf("Expected two scopes, got %v, %v", scopes, err)
+	}
+	if _, err := parseScopes("links:delete"); err == nil {
+		t.Error("Expected unknown scope to be rejected")
+	}
+	if _, err := parseScopes(""); err == nil {
+		t.Error("Expected empty scope list to be rejected")
+	}
+}
+
+func TestAuthenticateAPIKey(t *testing.T) {
+	db := setupTestDB(t)
+	db.Exec("DELETE FROM api_keys")
+
+	key, token, err := createAPIKey(db, "test", 0, []string{scopeLinksRead}, time.Time{})
+	if err != nil {
+		t.Fatalf("createAPIKey failed: %v", err)
+	}
+	if !strings.HasPrefix(token, apiKeyPrefix) || !strings.HasPrefix(token, key.Prefix) {
+		t.Errorf("Unexpected key %s with prefix %s", token, key.Prefix)
+	}
+
+	var stored string
+	db.QueryRow("SELECT key_hash FROM api_keys WHERE id = ?", key.ID).Scan(&stored)
+	if stored == token || stored != hashToken(token) {
+		t.Error("Expected only the hash of the key to be stored")
+	}
+
+	now := time.Now()
+	authenticated, err := authenticateAPIKey(db, token, now)
+	if err != nil || !authenticated.HasScope(scopeLinksRead) || authenticated.HasScope(scopeLinksWrite) {
+		t.Errorf("Expected key with links:read, got %+v, %v", authenticated, err)
+	}
+	keys, _ := queryAPIKeys(db)
+	if len(keys) != 1 || keys[0].LastUsedAt.IsZero() {
+		t.Errorf("Expected last used time to be recorded, got %+v", keys)
+	}
+
+	if _, err := authenticateAPIKey(db, token+"x", now); err != errInvalidAPIKey {
+		t.Errorf("Expected errInvalidAPIKey, got %v", err)
+	}
+
+	_, expired, _ := createAPIKey(db, "expired", 0, []string{scopeLinksRead}, now.Add(-time.Hour))
+	if _, err := authenticateAPIKey(db, expired, now); err != errExpiredAPIKey {
+		t.Errorf("Expected errExpiredAPIKey, got %v", err)
+	}
+
+	deleteAPIKey(db, key.ID)
+	if _, err := authenticateAPIKey(db, token, now); err != errInvalidAPIKey {
+		t.Errorf("Expected revoked key to be rejected, got %v", err)
+	}
+}
+
+func TestAPIKeyHandler(t *testing.T) {
+	db := setupTestDB(t)
+	db.Exec("DELETE FROM api_keys")
+	handler := APIKeyHandler{db: db}
+
+	form := url.Values{"name": {"deploy"}, "scopes": {scopeLinksRead, scopeLinksWrite}, "expires": {"2099-01-01"}}
+	req := httptest.NewRequest("POST", "/keys", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), apiKeyPrefix) {
+		t.Fatalf("Expected the new key to be shown, got %d", w.Code)
+	}
+	keys, _ := queryAPIKeys(db)
+	if len(keys) != 1 || keys[0].Name != "deploy" || len(keys[0].Scopes) != 2 || keys[0].ExpiresAt.Year() != 2099 {
+		t.Fatalf("Unexpected keys %+v", keys)
+	}
+
+	form = url.Values{"action": {"revoke"}, "id": {strconv.FormatInt(keys[0].ID, 10)}}
+	req = httptest.NewRequest("POST", "/keys", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if keys, _ := queryAPIKeys(db); len(keys) != 0 {
+		t.Errorf("Expected key to be revoked, got %+v", keys)
+	}
+}
+
+func TestRunAPIKeyCommand(t *testing.T) {
+	db := setupTestDB(t)
+	db.Exec("DELETE FROM api_keys")
+
+	var out bytes.Buffer
+	if err := runAPIKeyCommand(db, []string{"create", "-name", "cli", "-scopes", "links:write"}, &out); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	token := lines[len(lines)-1]
+	key, err := authenticateAPIKey(db, token, time.Now())
+	if err != nil || key.Name != "cli" || !key.HasScope(scopeLinksWrite) {
+		t.Fatalf("Expected printed key to authenticate, got %+v, %v", key, err)
+	}
+
+	out.Reset()
+	runAPIKeyCommand(db, []string{"list"}, &out)
+	if !strings.Contains(out.String(), "cli") || strings.Contains(out.String(), token) {
+		t.Errorf("Expected list to show the key name but not the key, got %s", out.String())
+	}
+
+	if err := runAPIKeyCommand(db, []string{"create"}, &out); err == nil {
+		t.Error("Expected create without a name to fail")
+	}
+	if err := runAPIKeyCommand(db, []string{"revoke", "999999"}, &out); err == nil {
+		t.Error("Expected revoking an unknown key to fail")
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sessionCookie holds the session token of a signed in user
+const sessionCookie = "session"
+
+// sessionLifetime is how long a user stays signed in
+const sessionLifetime = 7 * 24 * time.Hour
+
+// authInfo describes who made a request: a signed in user, an API key, or
+// nobody, and the workspace they work in. The zero value of each field means
+// it is absent.
+type authInfo struct {
+	user      User
+	key       APIKey
+	workspace Workspace
+}
+
+type authContextKey struct{}
+
+// requestAuth returns the identity that Auth attached to a request
+func requestAuth(r *http.Request) authInfo {
+	info, _ := r.Context().Value(authContextKey{}).(authInfo)
+	return info
+}
+
+// ownerID returns the user that links created by this request belong to. Links
+// created with an API key belong to the user the key was issued to.
+func (a authInfo) ownerID() int64 {
+	if a.user.ID != 0 {
+		return a.user.ID
+	}
+	return a.key.UserID
+}
+
+// ownerName returns the username of the user returned by ownerID
+func (a authInfo) ownerName() string {
+	if a.user.ID != 0 {
+		return a.user.Username
+	}
+	return a.key.Owner
+}
+
+// Auth identifies the user or API key behind a request and checks that it may
+// use the route. Safe requests need the read scope and all other requests the
+// write scope. API keys must have been given the scope, and users and the
+// users of API keys need the role the scope requires. Anonymous requests are
+// rejected when Settings.RequireAuth is enabled.
+type Auth struct {
+	db    *sql.DB
+	read  string
+	write string
+	next  http.Handler
+}
+
+// ServeHTTP implements the http.Handler interface
+func (a Auth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var info authInfo
+	if token := bearerToken(r); token != "" {
+		key, err := authenticateAPIKey(a.db, token, time.Now())
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="url_shortener", error="invalid_token"`)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		info.key = key
+	} else if user, err := sessionUser(a.db, r, time.Now()); err == nil {
+		info.user = user
+	}
+
+	scope := a.write
+	if r.Method == "GET" || r.Method == "HEAD" {
+		scope = a.read
+	}
+
+	switch {
+	case info.key.ID != 0:
+		if !info.key.HasScope(scope) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="url_shortener", error="insufficient_scope", scope="`+scope+`"`)
+			http.Error(w, "API key lacks the "+scope+" scope", http.StatusForbidden)
+			return
+		}
+	case info.user.ID == 0 && config.RequireAuth:
+		// Send people using the web interface to the login page
+		if r.Method == "GET" && r.Header.Get("HX-Request") == "" && strings.Contains(r.Header.Get("Accept"), "text/html") {
+			http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Bearer realm="url_shortener"`)
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return
+	}
+	if !info.atLeast(scopeRole(scope)) {
+		http.Error(w, "Your role does not allow this", http.StatusForbidden)
+		return
+	}
+
+	// A workspace the user was removed from is simply left, but API clients
+	// asking for one they cannot enter get an error
+	workspace, explicit, err := requestWorkspace(a.db, r, info)
+	if err != nil && explicit {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	info.workspace = workspace
+
+	a.next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authContextKey{}, info)))
+}
+
+// generateSessionToken returns a random session token, which is stored hashed
+// like API keys
+func generateSessionToken() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// sessionUser returns the user signed in with the session cookie of a request
+func sessionUser(db *sql.DB, r *http.Request, now time.Time) (User, error) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return User{}, err
+	}
+	return querySessionUser(db, hashToken(cookie.Value), now)
+}
+
+// setSessionCookie sends the session cookie, or clears it for an empty token
+func setSessionCookie(w http.ResponseWriter, token string, expires time.Time) {
+	cookie := &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(config.BaseURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	}
+	if token == "" {
+		cookie.MaxAge = -1
+	} else {
+		cookie.Expires = expires
+	}
+	http.SetCookie(w, cookie)
+}
+
+// safeRedirectTarget only allows local paths as the page to return to after login
+func safeRedirectTarget(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+// LoginHandler signs users in with their username and password
+type LoginHandler struct {
+	db *sql.DB
+}
+
+// loginAttempts limits guessing of account passwords to 5 failures per 15
+// minutes per client and username. It is separate from the link password
+// limiter, so failures on one never lock users out of the other.
+var loginAttempts = newAttemptLimiter(5, 15*time.Minute)
+
+// loginAttemptKey identifies the failed logins of a client as a user
+func loginAttemptKey(client string, username string) string {
+	return client + " " + strings.ToLower(username)
+}
+
+// ServeHTTP implements the http.Handler interface
+func (h LoginHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	next := safeRedirectTarget(r.FormValue("next"))
+	switch r.Method {
+	case "GET":
+		renderLogin(w, r, next, "", http.StatusOK)
+	case "POST":
+		if config.DisablePasswordLogin {
+			renderLogin(w, r, next, "Password login is disabled, please use single sign-on", http.StatusForbidden)
+			return
+		}
+
+		username := strings.TrimSpace(r.FormValue("username"))
+		attempt := loginAttemptKey(clientIP(r), username)
+		if ok, wait := loginAttempts.allow(attempt); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			renderLogin(w, r, next, "Too many attempts, please try again later", http.StatusTooManyRequests)
+			return
+		}
+
+		user, err := authenticateUser(h.db, username, r.FormValue("password"))
+		if err != nil {
+			loginAttempts.fail(attempt)
+			renderLogin(w, r, next, "Invalid username or password", http.StatusUnauthorized)
+			return
+		}
+		loginAttempts.reset(attempt)
+
+		token, err := generateSessionToken()
+		if err != nil {
+			http.Error(w, "Failed to create session", http.StatusInternalServerError)
+			return
+		}
+		expires := time.Now().Add(sessionLifetime)
+		if err := createSession(h.db, hashToken(token), user.ID, expires); err != nil {
+			http.Error(w, "Failed to create session", http.StatusInternalServerError)
+			return
+		}
+		setSessionCookie(w, token, expires)
+		http.Redirect(w, r, next, http.StatusSeeOther)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// LogoutHandler ends the session of the signed in user
+type LogoutHandler struct {
+	db *sql.DB
+}
+
+// ServeHTTP implements the http.Handler interface
+func (h LogoutHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		if err := deleteSession(h.db, hashToken(cookie.Value)); err != nil {
+			http.Error(w, "Failed to end session", http.StatusInternalServerError)
+			return
+		}
+	}
+	setSessionCookie(w, "", time.Time{})
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+func renderLogin(w http.ResponseWriter, r *http.Request, next string, message string, status int) {
+	tmpl, err := template.ParseFiles("templates/login.html")
+	if err != nil {
+		http.Error(w, "Failed to load template: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	page := struct {
+		Title         string
+		Next          string
+		Error         string
+		SSO           bool
+		PasswordLogin bool
+		CSRFToken     string
+	}{
+		Title:         "Log In",
+		Next:          next,
+		Error:         message,
+		SSO:           config.OIDCIssuer != "",
+		PasswordLogin: !config.DisablePasswordLogin,
+		CSRFToken:     csrfToken(w, r),
+	}
+
+	w.WriteHeader(status)
+	err = tmpl.Execute(w, page)
+	if err != nil {
+		http.Error(w, "Failed to execute template: "+err.Error(), http.StatusInternalServerError)
+	}
+}
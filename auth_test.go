@@ -0,0 +1,221 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// createTestUser creates a user with a fresh password and returns it
+func createTestUser(t *testing.T, username string, password string) User {
+	db := setupTestDB(t)
+	if user, _, err := queryUserByName(db, username); err == nil {
+		deleteUser(db, user.Username)
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		t.Fatalf("hashPassword failed: %v", err)
+	}
+	user, err := createUser(db, username, hash)
+	if err != nil {
+		t.Fatalf("createUser failed: %v", err)
+	}
+	return user
+}
+
+// login signs a user in and returns their session cookie
+func login(t *testing.T, username string, password string) *http.Cookie {
+	handler := LoginHandler{db: setupTestDB(t)}
+	form := url.Values{"username": {username}, "password": {password}}
+	req := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == sessionCookie && cookie.Value != "" {
+			return cookie
+		}
+	}
+	t.Fatalf("Expected a session cookie, got status %d", w.Code)
+	return nil
+}
+
+func TestAuth(t *testing.T) {
+	db := setupTestDB(t)
+	db.Exec("DELETE FROM api_keys")
+	_, reader, _ := createAPIKey(db, "reader", 0, []string{scopeLinksRead}, time.Time{})
+	_, writer, _ := createAPIKey(db, "writer", 0, []string{scopeLinksRead, scopeLinksWrite}, time.Time{})
+	createTestUser(t, "authtest", "correct horse")
+	session := login(t, "authtest", "correct horse")
+
+	config.RequireAuth = true
+	defer func() { config.RequireAuth = false }()
+
+	var seen authInfo
+	handler := Auth{db: db, read: scopeLinksRead, write: scopeLinksWrite, next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = requestAuth(r)
+		w.WriteHeader(http.StatusNoContent)
+	})}
+
+	tests := []struct {
+		name       string
+		method     string
+		header     string
+		session    string
+		accept     string
+		wantStatus int
+	}{
+		{"Anonymous", "POST", "", "", "", http.StatusUnauthorized},
+		{"Browser without login", "GET", "", "", "text/html", http.StatusSeeOther},
+		{"Invalid key", "GET", "Bearer usk_nope", "", "", http.StatusUnauthorized},
+		{"Wrong scheme", "GET", "Basic " + reader, "", "", http.StatusUnauthorized},
+		{"Read", "GET", "Bearer " + reader, "", "", http.StatusNoContent},
+		{"Write without scope", "POST", "Bearer " + reader, "", "", http.StatusForbidden},
+		{"Write", "POST", "Bearer " + writer, "", "", http.StatusNoContent},
+		{"Session", "POST", "", session.Value, "", http.StatusNoContent},
+		{"Unknown session", "POST", "", "forged", "", http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/create", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			if tt.session != "" {
+				req.AddCookie(&http.Cookie{Name: sessionCookie, Value: tt.session})
+			}
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("Expected status code %d, got %d", tt.wantStatus, w.Code)
+			}
+		})
+	}
+
+	config.RequireAuth = false
+	req := httptest.NewRequest("POST", "/create", nil)
+	req.AddCookie(session)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent || seen.user.Username != "authtest" {
+		t.Errorf("Expected open access that still knows the user, got %d %+v", w.Code, seen)
+	}
+}
+
+func TestLoginHandler(t *testing.T) {
+	db := setupTestDB(t)
+	handler := LoginHandler{db: db}
+	createTestUser(t, "logintest", "open sesame")
+
+	post := func(username string, password string, next string) *httptest.ResponseRecorder {
+		form := url.Values{"username": {username}, "password": {password}, "next": {next}}
+		req := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.RemoteAddr = "198.51.100.20:1234"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := post("logintest", "wrong password", "/"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status code %d for a wrong password, got %d", http.StatusUnauthorized, w.Code)
+	}
+	if w := post("nobody", "open sesame", "/"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status code %d for an unknown user, got %d", http.StatusUnauthorized, w.Code)
+	}
+
+	w := post("logintest", "open sesame", "/stats/abc")
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/stats/abc" {
+		t.Errorf("Expected redirect to /stats/abc, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || !cookies[0].HttpOnly || cookies[0].SameSite != http.SameSiteLaxMode {
+		t.Fatalf("Expected an HttpOnly session cookie, got %+v", cookies)
+	}
+	if user, err := querySessionUser(db, hashToken(cookies[0].Value), time.Now()); err != nil || user.Username != "logintest" {
+		t.Errorf("Expected session for logintest, got %+v, %v", user, err)
+	}
+	if _, err := querySessionUser(db, hashToken(cookies[0].Value), time.Now().Add(sessionLifetime)); err == nil {
+		t.Error("Expected session to expire")
+	}
+
+	if w := post("logintest", "open sesame", "//evil.example.com"); w.Header().Get("Location") != "/" {
+		t.Errorf("Expected redirect to another site to be refused, got %s", w.Header().Get("Location"))
+	}
+
+	// Failures lock out the username from the client, not other users or
+	// link passwords
+	for i := 0; i < 5; i++ {
+		post("logintest", "guess", "/")
+	}
+	if w := post("logintest", "open sesame", "/"); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected status code %d with Retry-After, got %d", http.StatusTooManyRequests, w.Code)
+	}
+	if w := post("nobody", "open sesame", "/"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected other usernames to stay allowed, got %d", w.Code)
+	}
+	if ok, _ := passwordAttempts.allow(linkAttemptKey(0, "abc", "198.51.100.20")); !ok {
+		t.Error("Expected failed logins not to block link passwords")
+	}
+
+	req := httptest.NewRequest("POST", "/logout", nil)
+	req.AddCookie(cookies[0])
+	LogoutHandler{db: db}.ServeHTTP(httptest.NewRecorder(), req)
+	if _, err := querySessionUser(db, hashToken(cookies[0].Value), time.Now()); err == nil {
+		t.Error("Expected session to end on logout")
+	}
+}
+
+func TestURLOwners(t *testing.T) {
+	db := setupTestDB(t)
+	cache, _ := createCache(10)
+	createTestUser(t, "ownertest", "hunter2hunter2")
+	session := login(t, "ownertest", "hunter2hunter2")
+
+	create := Auth{db: db, read: scopeLinksRead, write: scopeLinksWrite, next: URLFormHandler{db: db, cache: cache}}
+	form := url.Values{"url": {"https://owned.example.com/"}}
+	req := httptest.NewRequest("POST", "/create", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(session)
+	w := httptest.NewRecorder()
+	create.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "by ownertest") {
+		t.Fatalf("Expected row owned by ownertest, got %d", w.Code)
+	}
+	createURL(db, "https://unowned.example.com/", "unowned1", "127.0.0.1")
+
+	home := Auth{db: db, read: scopeLinksRead, write: scopeLinksWrite, next: HomeHandler{db: db, cache: cache}}
+	list := func(query string, cookie *http.Cookie) string {
+		req := httptest.NewRequest("GET", "/"+query, nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		home.ServeHTTP(w, req)
+		return w.Body.String()
+	}
+
+	if body := list("", session); !strings.Contains(body, "//owned.example.com") || strings.Contains(body, "unowned1") {
+		t.Error("Expected only the user's own links by default")
+	}
+	if body := list("?owner=all", session); strings.Contains(body, "unowned1") {
+		t.Error("Expected editors to only see their own links with owner=all")
+	}
+	if body := list("", nil); strings.Contains(body, "//owned.example.com") || !strings.Contains(body, "unowned1") {
+		t.Error("Expected anonymous visitors to only see links nobody owns")
+	}
+
+	user, _, _ := queryUserByName(db, "ownertest")
+	updateUserRole(db, user.ID, roleAdmin)
+	if body := list("?owner=all", session); !strings.Contains(body, "unowned1") || !strings.Contains(body, "/users") {
+		t.Error("Expected admins to see all links with owner=all")
+	}
+}
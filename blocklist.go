@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"html/template"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Blocklist holds the phishing and malware domains and URLs listed in local
+// threat feeds. Each entry remembers the file it came from.
+type Blocklist struct {
+	mu      sync.RWMutex
+	domains map[string]string
+	urls    map[string]string
+}
+
+// threatBlocklist is the blocklist destinations are checked against. It is
+// empty until the server loads Settings.BlocklistFiles.
+var threatBlocklist = &Blocklist{}
+
+// parseBlocklist reads domains and URLs from a feed in any of the common
+// formats, which may be mixed line by line: hosts files ("0.0.0.0 evil.example"),
+// plain lists of domains or URLs, and CSV exports such as URLhaus, where the
+// first http or https field of each record is taken.
+func parseBlocklist(r io.Reader) (domains []string, urls []string, err error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "!") {
+			continue
+		}
+
+		if strings.HasPrefix(line, `"`) || strings.Contains(line, `","`) {
+			reader := csv.NewReader(strings.NewReader(line))
+			reader.LazyQuotes = true
+			record, err := reader.Read()
+			if err != nil {
+				continue
+			}
+			for _, field := range record {
+				if entry, ok := blocklistURL(field); ok {
+					urls = append(urls, entry)
+					break
+				}
+			}
+			continue
+		}
+
+		if i := strings.Index(line, " #"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) > 1 && net.ParseIP(fields[0]) != nil {
+			for _, name := range fields[1:] {
+				if domain, ok := blocklistDomain(name); ok {
+					domains = append(domains, domain)
+				}
+			}
+			continue
+		}
+		if len(fields) != 1 {
+			continue
+		}
+		if entry, ok := blocklistURL(fields[0]); ok {
+			urls = append(urls, entry)
+		} else if domain, ok := blocklistDomain(fields[0]); ok {
+			domains = append(domains, domain)
+		}
+	}
+	return domains, urls, scanner.Err()
+}
+
+// blocklistDomain normalizes a listed domain or IP address. Names without a
+// dot, such as the localhost entries of hosts files, are skipped.
+func blocklistDomain(name string) (string, bool) {
+	name = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+	name = strings.TrimPrefix(strings.TrimPrefix(name, "*"), ".")
+	if !strings.Contains(name, ".") || strings.ContainsAny(name, "/:") {
+		return "", false
+	}
+	return name, true
+}
+
+// blocklistURL normalizes a URL so that listed URLs and destinations compare
+// equal regardless of the case of the scheme and host, or a fragment
+func blocklistURL(raw string) (string, bool) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", false
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	u.Fragment = ""
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	return u.String(), true
+}
+
+// load replaces the entries with those in the given files. The old entries
+// stay in place if a file cannot be read.
+func (b *Blocklist) load(files []string) error {
+	domains := make(map[string]string)
+	urls := make(map[string]string)
+	for _, filename := range files {
+		f, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		listedDomains, listedURLs, err := parseBlocklist(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", filename, err)
+		}
+		source := filepath.Base(filename)
+		for _, domain := range listedDomains {
+			domains[domain] = source
+		}
+		for _, u := range listedURLs {
+			urls[u] = source
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.domains = domains
+	b.urls = urls
+	return nil
+}
+
+// lookup returns the feed listing a destination, or "" if none does. A
+// listed domain also covers all of its subdomains.
+func (b *Blocklist) lookup(destination string) string {
+	normalized, ok := blocklistURL(destination)
+	if !ok {
+		return ""
+	}
+	u, _ := url.Parse(normalized)
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if source, ok := b.urls[normalized]; ok {
+		return source
+	}
+	host := strings.TrimSuffix(u.Hostname(), ".")
+	for host != "" {
+		if source, ok := b.domains[host]; ok {
+			return source
+		}
+		_, parent, found := strings.Cut(host, ".")
+		if !found {
+			break
+		}
+		host = parent
+	}
+	return ""
+}
+
+// check returns an error if a destination is listed in a threat feed
+func (b *Blocklist) check(destination string) error {
+	if source := b.lookup(destination); source != "" {
+		return fmt.Errorf("Destination is listed as phishing or malware in %s", source)
+	}
+	return nil
+}
+
+// destinations returns every destination a link can redirect to
+func (u URL) destinations() []string {
+	destinations := []string{u.Name, u.IOSURL, u.AndroidURL, u.DesktopURL}
+	for _, target := range u.CountryTargets {
+		destinations = append(destinations, target)
+	}
+	for _, variant := range u.Variants {
+		destinations = append(destinations, variant.Target)
+	}
+	return destinations
+}
+
+// listedReason returns why a link has to be disabled, or "" if none of its
+// destinations is listed
+func (b *Blocklist) listedReason(link URL) string {
+	for _, destination := range link.destinations() {
+		if destination == "" {
+			continue
+		}
+		if source := b.lookup(destination); source != "" {
+			return destination + " is listed in " + source
+		}
+	}
+	return ""
+}
+
+// Blocked reports whether a link was disabled because a destination is listed
+// in a threat feed
+func (u URL) Blocked() bool {
+	return u.BlockedReason != ""
+}
+
+// BlocklistRefresher reloads the blocklist files on an interval and disables
+// links whose destinations have been listed since they were created
+type BlocklistRefresher struct {
+	db       *sql.DB
+	cache    *Cache
+	files    []string
+	interval time.Duration
+}
+
+// Start loads the blocklist and refreshes it once per interval in the
+// background, or never again for an interval of 0
+func (r *BlocklistRefresher) Start() {
+	if err := r.refresh(); err != nil {
+		fmt.Println("Error loading blocklists:", err)
+	}
+	if r.interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := r.refresh(); err != nil && config.EnableLogging {
+				fmt.Println("Blocklist refresh failed:", err)
+			}
+		}
+	}()
+}
+
+// refresh reloads the files and updates which links are disabled. Links are
+// enabled again once none of their destinations is listed any more.
+func (r *BlocklistRefresher) refresh() error {
+	if err := threatBlocklist.load(r.files); err != nil {
+		return err
+	}
+	links, err := queryURLs(r.db)
+	if err != nil {
+		return err
+	}
+	for _, link := range links {
+		reason := threatBlocklist.listedReason(link)
+		if reason == link.BlockedReason {
+			continue
+		}
+		if err := updateURLBlocked(r.db, link.DomainID, link.Short, reason); err != nil {
+			return err
+		}
+		r.cache.forgetLink(link.DomainID, link.Short)
+		if reason != "" && config.EnableLogging {
+			fmt.Println("Disabled link", link.Short+":", reason)
+		}
+	}
+	return nil
+}
+
+// renderBlocked tells visitors that a link was disabled, without revealing
+// its destination
+func renderBlocked(w http.ResponseWriter) {
+	tmpl, err := template.ParseFiles("templates/blocked.html")
+	if err != nil {
+		http.Error(w, "Failed to load template: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusGone)
+	err = tmpl.Execute(w, nil)
+	if err != nil {
+		http.Error(w, "Failed to execute template: "+err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseBlocklist(t *testing.T) {
+	feed := `# hosts file
+127.0.0.1 localhost
+0.0.0.0 phish.example login.phish.example # comment
+! adblock style comment
+malware.example.
+*.wildcard.example
+https://Files.Example.com/payload.bin#x
+################################################################
+# id,dateadded,url,url_status,last_online,threat,tags,urlhaus_link,reporter
+"123","2024-01-01 00:00:00","http://203.0.113.7/bins/mirai","online","","malware_download","elf","https://urlhaus.abuse.ch/url/123/","someone"
+`
+	domains, urls, err := parseBlocklist(strings.NewReader(feed))
+	if err != nil {
+		t.Fatalf("parseBlocklist failed: %v", err)
+	}
+	wantDomains := []string{"phish.example", "login.phish.example", "malware.example", "wildcard.example"}
+	if strings.Join(domains, " ") != strings.Join(wantDomains, " ") {
+		t.Errorf("Expected domains %v, got %v", wantDomains, domains)
+	}
+	wantURLs := []string{"https://files.example.com/payload.bin", "http://203.0.113.7/bins/mirai"}
+	if strings.Join(urls, " ") != strings.Join(wantURLs, " ") {
+		t.Errorf("Expected URLs %v, got %v", wantURLs, urls)
+	}
+}
+
+func TestBlocklistLookup(t *testing.T) {
+	dir := t.TempDir()
+	hosts := filepath.Join(dir, "hosts.txt")
+	csv := filepath.Join(dir, "urlhaus.csv")
+	os.WriteFile(hosts, []byte("0.0.0.0 phish.example\n"), 0o644)
+	os.WriteFile(csv, []byte(`"1","2024-01-01","https://files.example.com/payload.bin","online"`+"\n"), 0o644)
+
+	blocklist := &Blocklist{}
+	if err := blocklist.load([]string{hosts, csv}); err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+
+	tests := []struct {
+		destination string
+		source      string
+	}{
+		{"https://phish.example/login", "hosts.txt"},
+		{"https://secure.PHISH.example/", "hosts.txt"},
+		{"https://notphish.example/", ""},
+		{"https://files.example.com/payload.bin", "urlhaus.csv"},
+		{"HTTPS://FILES.EXAMPLE.COM/payload.bin#top", "urlhaus.csv"},
+		{"https://files.example.com/other.bin", ""},
+	}
+	for _, tt := range tests {
+		if got := blocklist.lookup(tt.destination); got != tt.source {
+			t.Errorf("lookup(%q) = %q, want %q", tt.destination, got, tt.source)
+		}
+	}
+
+	// A missing file keeps the entries that were loaded
+	if err := blocklist.load([]string{filepath.Join(dir, "missing.txt")}); err == nil {
+		t.Error("Expected loading a missing file to fail")
+	}
+	if blocklist.lookup("https://phish.example/") == "" {
+		t.Error("Expected old entries to be kept after a failed load")
+	}
+}
+
+func TestBlocklistDisablesLinks(t *testing.T) {
+	db := setupTestDB(t)
+	cache, _ := createCache(10)
+	defer threatBlocklist.load(nil)
+
+	feed := filepath.Join(t.TempDir(), "domains.txt")
+	os.WriteFile(feed, []byte("evil.example\n"), 0o644)
+	if err := threatBlocklist.load([]string{feed}); err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	if _, err := normalizeDestination("https://www.evil.example/"); err == nil || !strings.Contains(err.Error(), "domains.txt") {
+		t.Errorf("Expected listed destination to be rejected, got %v", err)
+	}
+
+	short := "blocked01"
+	deleteURL(db, 0, short)
+	defer deleteURL(db, 0, short)
+	createURL(db, "https://later.example/login", short, "127.0.0.1")
+
+	var header http.Header
+	redirect := func() int {
+		req := httptest.NewRequest("GET", "/q/"+short, nil)
+		w := httptest.NewRecorder()
+		QueryHandler{db: db, cache: cache}.ServeHTTP(w, req)
+		header = w.Header()
+		return w.Code
+	}
+	if code := redirect(); code != http.StatusMovedPermanently {
+		t.Fatalf("Expected redirect before the destination is listed, got %d", code)
+	}
+	// Browsers must ask again, or they would never see the link disabled
+	if header.Get("Cache-Control") != "no-store" {
+		t.Errorf("Expected redirects not to be cached, got %q", header.Get("Cache-Control"))
+	}
+
+	// The destination is listed after the link was created
+	os.WriteFile(feed, []byte("evil.example\nlater.example\n"), 0o644)
+	refresher := &BlocklistRefresher{db: db, cache: cache, files: []string{feed}}
+	if err := refresher.refresh(); err != nil {
+		t.Fatalf("refresh failed: %v", err)
+	}
+	link, _ := queryShortURL(db, 0, short)
+	if !link.Blocked() || !strings.Contains(link.BlockedReason, "domains.txt") {
+		t.Errorf("Expected link to be disabled, got reason %q", link.BlockedReason)
+	}
+	if code := redirect(); code != http.StatusGone {
+		t.Errorf("Expected 410 for a disabled link, got %d", code)
+	}
+
+	// Removing the entry enables the link again
+	os.WriteFile(feed, []byte("evil.example\n"), 0o644)
+	refresher.refresh()
+	if code := redirect(); code != http.StatusMovedPermanently {
+		t.Errorf("Expected redirect after the destination was delisted, got %d", code)
+	}
+}
+
+func TestBlocklistCheckedOnRedirect(t *testing.T) {
+	db := setupTestDB(t)
+	cache, _ := createCache(10)
+	defer threatBlocklist.load(nil)
+
+	short := "blocked02"
+	deleteURL(db, 0, short)
+	defer deleteURL(db, 0, short)
+	createURL(db, "https://fine.example/", short, "127.0.0.1")
+	updateURLDetails(db, URL{Short: short, IOSURL: "https://app.listed.example/"})
+
+	feed := filepath.Join(t.TempDir(), "hosts")
+	os.WriteFile(feed, []byte("0.0.0.0 listed.example\n"), 0o644)
+	threatBlocklist.load([]string{feed})
+
+	req := httptest.NewRequest("GET", "/q/"+short, nil)
+	w := httptest.NewRecorder()
+	QueryHandler{db: db, cache: cache}.ServeHTTP(w, req)
+	if w.Code != http.StatusGone {
+		t.Errorf("Expected 410 when any destination is listed, got %d", w.Code)
+	}
+	if link, _ := queryShortURL(db, 0, short); !link.Blocked() {
+		t.Error("Expected link to be disabled on redirect")
+	}
+}
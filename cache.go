@@ -2,8 +2,11 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/redis/go-redis/v9"
 )
@@ -37,3 +40,39 @@ func (c *Cache) getURL(shortURL string) (string, error) {
 	}
 	return url, nil
 }
+
+// linkTTL bounds how long a cached link record can be stale on other replicas
+const linkTTL = 10 * time.Minute
+
+// linkKey names the cached record of a link, which is only unique together
+// with the domain of the link
+func linkKey(domainID int64, shortURL string) string {
+	return "link:" + strconv.FormatInt(domainID, 10) + ":" + shortURL
+}
+
+// cacheLink stores the full link record used by QueryHandler
+func (c *Cache) cacheLink(url URL) {
+	data, err := json.Marshal(url)
+	if err != nil {
+		return
+	}
+	(*c.rdb).Set(ctx, linkKey(url.DomainID, url.Short), data, linkTTL)
+}
+
+// getLink returns a cached link record, or an error if it is missing or the cache is unavailable
+func (c *Cache) getLink(domainID int64, shortURL string) (URL, error) {
+	data, err := (*c.rdb).Get(ctx, linkKey(domainID, shortURL)).Bytes()
+	if err != nil {
+		return URL{}, err
+	}
+	var url URL
+	if err := json.Unmarshal(data, &url); err != nil {
+		return URL{}, err
+	}
+	return url, nil
+}
+
+// forgetLink drops a cached link record after the link has been changed
+func (c *Cache) forgetLink(domainID int64, shortURL string) {
+	(*c.rdb).Del(ctx, linkKey(domainID, shortURL))
+}
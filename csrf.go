@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// csrfCookie holds the token that forms and HTMX requests of the web
+// interface have to send back
+const csrfCookie = "csrf"
+
+// csrfHeader carries the token in HTMX requests, which index.html adds to
+// every request with hx-headers
+const csrfHeader = "X-CSRF-Token"
+
+// csrfField carries the token in plain HTML forms
+const csrfField = "csrf_token"
+
+// csrfToken returns the CSRF token of the browser that sent a request, and
+// issues one if it has none yet. Pages with forms render it into the page.
+func csrfToken(w http.ResponseWriter, r *http.Request) string {
+	if cookie, err := r.Cookie(csrfCookie); err == nil && cookie.Value != "" {
+		return cookie.Value
+	}
+	token, err := generateSessionToken()
+	if err != nil {
+		return ""
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(config.BaseURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+	// Later calls for the same request see the new token
+	r.AddCookie(&http.Cookie{Name: csrfCookie, Value: token})
+	return token
+}
+
+// CSRF rejects requests that change something unless they carry the token
+// from the csrf cookie in the X-CSRF-Token header or the csrf_token form
+// field. Other sites can make browsers send the cookie, but cannot read it
+// to send it back. Requests with an API key are exempt, since browsers never
+// add Authorization headers by themselves.
+type CSRF struct {
+	next http.Handler
+}
+
+// ServeHTTP implements the http.Handler interface
+func (c CSRF) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS":
+		c.next.ServeHTTP(w, r)
+		return
+	}
+	if bearerToken(r) != "" {
+		c.next.ServeHTTP(w, r)
+		return
+	}
+
+	cookie, err := r.Cookie(csrfCookie)
+	token := r.Header.Get(csrfHeader)
+	if token == "" {
+		token = r.PostFormValue(csrfField)
+	}
+	if err != nil || cookie.Value == "" || subtle.ConstantTimeCompare([]byte(token), []byte(cookie.Value)) != 1 {
+		http.Error(w, "Missing or invalid CSRF token, please reload the page and try again", http.StatusForbidden)
+		return
+	}
+	c.next.ServeHTTP(w, r)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCSRF(t *testing.T) {
+	handler := CSRF{next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})}
+	cookie := &http.Cookie{Name: csrfCookie, Value: "token-1"}
+
+	tests := []struct {
+		name   string
+		method string
+		cookie *http.Cookie
+		header map[string]string
+		form   url.Values
+		want   int
+	}{
+		{"GET needs no token", "GET", nil, nil, nil, http.StatusNoContent},
+		{"POST without token", "POST", nil, nil, url.Values{"url": {"https://example.com"}}, http.StatusForbidden},
+		{"POST without cookie", "POST", nil, map[string]string{csrfHeader: "token-1"}, nil, http.StatusForbidden},
+		{"POST with header", "POST", cookie, map[string]string{csrfHeader: "token-1"}, nil, http.StatusNoContent},
+		{"POST with form field", "POST", cookie, nil, url.Values{csrfField: {"token-1"}}, http.StatusNoContent},
+		{"POST with wrong token", "POST", cookie, map[string]string{csrfHeader: "token-2"}, nil, http.StatusForbidden},
+		{"POST with empty token", "POST", &http.Cookie{Name: csrfCookie, Value: ""}, map[string]string{csrfHeader: ""}, nil, http.StatusForbidden},
+		{"POST with API key", "POST", nil, map[string]string{"Authorization": "Bearer usk_anything"}, nil, http.StatusNoContent},
+		{"DELETE without token", "DELETE", cookie, nil, nil, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/create", strings.NewReader(tt.form.Encode()))
+		if tt.form != nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		if tt.cookie != nil {
+			req.AddCookie(tt.cookie)
+		}
+		for key, value := range tt.header {
+			req.Header.Set(key, value)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
+
+func TestCSRFTokenInPage(t *testing.T) {
+	db := setupTestDB(t)
+	cache, _ := createCache(10)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	HomeHandler{db: db, cache: cache}.ServeHTTP(w, req)
+	var token string
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == csrfCookie {
+			token = cookie.Value
+		}
+	}
+	if token == "" {
+		t.Fatal("Expected the home page to issue a CSRF cookie")
+	}
+	if !strings.Contains(w.Body.String(), `"X-CSRF-Token": "`+token+`"`) {
+		t.Error("Expected the token in the hx-headers of the page")
+	}
+
+	// Browsers that have a token keep it
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: csrfCookie, Value: token})
+	w = httptest.NewRecorder()
+	HomeHandler{db: db, cache: cache}.ServeHTTP(w, req)
+	if len(w.Result().Cookies()) != 0 {
+		t.Error("Expected no new cookie for a browser with a token")
+	}
+
+	// The token from the page lets the browser create links
+	purgeLinksTo(db, "https://csrf.example.com/")
+	defer purgeLinksTo(db, "https://csrf.example.com/")
+	handler := CSRF{next: URLFormHandler{db: db, cache: cache}}
+	form := url.Values{"url": {"https://csrf.example.com/"}}
+	req = httptest.NewRequest("POST", "/create", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("HX-Request", "true")
+	req.Header.Set(csrfHeader, token)
+	req.AddCookie(&http.Cookie{Name: csrfCookie, Value: token})
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected link to be created with the token, got %d: %s", w.Code, w.Body.String())
+	}
+}
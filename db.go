@@ -2,35 +2,290 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 
-	_ "modernc.org/sqlite"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
 )
 
 type URL struct {
-	Name          string    `json:"name"`
-	CreatedAt     time.Time `json:"created_at"`
-	Short         string    `json:"short"`
-	RequestedFrom string    `json:"requested_from"`
-	Clicks        int       `json:"clicks"`
+	Name           string            `json:"name"`
+	CreatedAt      time.Time         `json:"created_at"`
+	Short          string            `json:"short"`
+	RequestedFrom  string            `json:"requested_from"`
+	Clicks         int               `json:"clicks"`
+	Notes          string            `json:"notes"`
+	Tags           []string          `json:"tags"`
+	Title          string            `json:"title"`
+	Description    string            `json:"description"`
+	ImageURL       string            `json:"image_url"`
+	CheckStatus    int               `json:"check_status"`
+	FinalURL       string            `json:"final_url"`
+	CheckedAt      time.Time         `json:"checked_at"`
+	Preview        bool              `json:"preview"`
+	Protected      bool              `json:"protected"`
+	IOSURL         string            `json:"ios_url"`
+	AndroidURL     string            `json:"android_url"`
+	DesktopURL     string            `json:"desktop_url"`
+	CountryTargets map[string]string `json:"country_targets"`
+	Variants       []Variant         `json:"variants"`
+	StickyVariants bool              `json:"sticky_variants"`
+	Passthrough    bool              `json:"passthrough"`
+	UTMTemplate    string            `json:"utm_template"`
+	NotBefore      time.Time         `json:"not_before"`
+	NotAfter       time.Time         `json:"not_after"`
+	OwnerID        int64             `json:"owner_id"`
+	Owner          string            `json:"owner"`
+	WorkspaceID    int64             `json:"workspace_id"`
+	DomainID       int64             `json:"domain_id"`
+	DomainURL      string            `json:"domain_url"`
+	// BlockedReason is set while a destination is listed in a threat feed
+	BlockedReason string `json:"blocked_reason"`
+
+	// Whether the current request may edit or purge the link, set before rendering
+	CanEdit  bool `json:"-"`
+	CanPurge bool `json:"-"`
+}
+
+// TagList returns the tags of a URL as a comma separated string
+func (u URL) TagList() string {
+	return strings.Join(u.Tags, ", ")
+}
+
+// Broken reports whether the last link check failed or returned an error status
+func (u URL) Broken() bool {
+	return !u.CheckedAt.IsZero() && (u.CheckStatus == 0 || u.CheckStatus >= 400)
+}
+
+// URLFilter narrows down the URLs returned by queryFilteredURLs
+type URLFilter struct {
+	Tag    string
+	Broken bool
+	// ByOwner limits the URLs to those of OwnerID, where 0 means nobody
+	ByOwner bool
+	OwnerID int64
+	// WorkspaceID limits the URLs to a workspace, where 0 means links that
+	// are in no workspace
+	WorkspaceID int64
+	// AllWorkspaces returns the URLs of every workspace, for background jobs
+	AllWorkspaces bool
+	Limit         int
+}
+
+// urlColumns lists the columns scanned by scanURL, in order. Tags are
+// collected from the url_tags join table into a single comma separated value,
+// country rules from geo_rules into a JSON object and variants from
+// link_variants into a JSON array.
+const urlColumns = `name, created_at, short, requested_from, clicks, notes, title, description, image_url,
+	check_status, final_url, checked_at, preview, password_hash != '',
+	ios_url, android_url, desktop_url,
+	(SELECT json_group_object(country, target) FROM geo_rules
+		WHERE geo_rules.domain_id = urls.domain_id AND geo_rules.short = urls.short),
+	(SELECT json_group_array(json_object('target', target, 'weight', weight)) FROM link_variants
+		WHERE link_variants.domain_id = urls.domain_id AND link_variants.short = urls.short),
+	sticky_variants, passthrough, utm_template, not_before, not_after,
+	owner_id, (SELECT username FROM users WHERE users.id = urls.owner_id), workspace_id,
+	domain_id, (SELECT base_url FROM domains WHERE domains.id = urls.domain_id), blocked_reason,
+	(SELECT GROUP_CONCAT(tags.name) FROM url_tags JOIN tags ON tags.id = url_tags.tag_id 
+		WHERE url_tags.domain_id = urls.domain_id AND url_tags.short = urls.short)`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanURL(row rowScanner) (URL, error) {
+	var url URL
+	var tags, owner, domainURL sql.NullString
+	var checkedAt, notBefore, notAfter sql.NullTime
+	var countryTargets, variants string
+	err := row.Scan(&url.Name, &url.CreatedAt, &url.Short, &url.RequestedFrom, &url.Clicks, &url.Notes,
+		&url.Title, &url.Description, &url.ImageURL,
+		&url.CheckStatus, &url.FinalURL, &checkedAt, &url.Preview, &url.Protected,
+		&url.IOSURL, &url.AndroidURL, &url.DesktopURL, &countryTargets,
+		&variants, &url.StickyVariants, &url.Passthrough, &url.UTMTemplate, &notBefore, &notAfter,
+		&url.OwnerID, &owner, &url.WorkspaceID, &url.DomainID, &domainURL, &url.BlockedReason, &tags)
+	if err != nil {
+		return URL{}, err
+	}
+	if err := json.Unmarshal([]byte(countryTargets), &url.CountryTargets); err != nil {
+		return URL{}, err
+	}
+	if err := json.Unmarshal([]byte(variants), &url.Variants); err != nil {
+		return URL{}, err
+	}
+	url.CheckedAt = checkedAt.Time
+	url.NotBefore = notBefore.Time
+	url.NotAfter = notAfter.Time
+	url.Owner = owner.String
+	url.DomainURL = domainURL.String
+	if tags.Valid {
+		url.Tags = parseTags(tags.String)
+	}
+	return url, nil
+}
+
+func scanURLs(rows *sql.Rows) ([]URL, error) {
+	defer rows.Close()
+	var urls []URL
+	for rows.Next() {
+		url, err := scanURL(rows)
+		if err != nil {
+			return nil, err
+		}
+		urls = append(urls, url)
+	}
+	return urls, rows.Err()
 }
 
+// schema creates the tables that do not exist yet. Every domain has its own
+// codes, so links are identified by their domain and code together.
+const schema = `
+	CREATE TABLE IF NOT EXISTS urls (
+		name TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		short TEXT NOT NULL,
+		requested_from TEXT NOT NULL,
+		clicks INTEGER DEFAULT 0,
+		notes TEXT NOT NULL DEFAULT '',
+		title TEXT NOT NULL DEFAULT '',
+		description TEXT NOT NULL DEFAULT '',
+		image_url TEXT NOT NULL DEFAULT '',
+		check_status INTEGER NOT NULL DEFAULT 0,
+		final_url TEXT NOT NULL DEFAULT '',
+		checked_at DATETIME,
+		preview BOOLEAN NOT NULL DEFAULT 0,
+		password_hash TEXT NOT NULL DEFAULT '',
+		ios_url TEXT NOT NULL DEFAULT '',
+		android_url TEXT NOT NULL DEFAULT '',
+		desktop_url TEXT NOT NULL DEFAULT '',
+		sticky_variants BOOLEAN NOT NULL DEFAULT 0,
+		passthrough BOOLEAN NOT NULL DEFAULT 0,
+		utm_template TEXT NOT NULL DEFAULT '',
+		not_before DATETIME,
+		not_after DATETIME,
+		owner_id INTEGER NOT NULL DEFAULT 0,
+		workspace_id INTEGER NOT NULL DEFAULT 0,
+		domain_id INTEGER NOT NULL DEFAULT 0,
+		blocked_reason TEXT NOT NULL DEFAULT ''
+	);
+	CREATE TABLE IF NOT EXISTS tags (
+		id INTEGER PRIMARY KEY,
+		name TEXT NOT NULL UNIQUE
+	);
+	CREATE TABLE IF NOT EXISTS url_tags (
+		domain_id INTEGER NOT NULL DEFAULT 0,
+		short TEXT NOT NULL,
+		tag_id INTEGER NOT NULL REFERENCES tags(id),
+		PRIMARY KEY (domain_id, short, tag_id)
+	);
+	CREATE TABLE IF NOT EXISTS geo_rules (
+		domain_id INTEGER NOT NULL DEFAULT 0,
+		short TEXT NOT NULL,
+		country TEXT NOT NULL,
+		target TEXT NOT NULL,
+		PRIMARY KEY (domain_id, short, country)
+	);
+	CREATE TABLE IF NOT EXISTS link_variants (
+		domain_id INTEGER NOT NULL DEFAULT 0,
+		short TEXT NOT NULL,
+		position INTEGER NOT NULL,
+		target TEXT NOT NULL,
+		weight INTEGER NOT NULL,
+		PRIMARY KEY (domain_id, short, position)
+	);
+	CREATE TABLE IF NOT EXISTS clicks (
+		domain_id INTEGER NOT NULL DEFAULT 0,
+		short TEXT NOT NULL,
+		clicked_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		variant TEXT NOT NULL DEFAULT '',
+		client_ip TEXT NOT NULL DEFAULT ''
+	);
+	CREATE TABLE IF NOT EXISTS utm_templates (
+		workspace_id INTEGER NOT NULL DEFAULT 0,
+		name TEXT NOT NULL,
+		source TEXT NOT NULL,
+		medium TEXT NOT NULL,
+		campaign TEXT NOT NULL,
+		term TEXT NOT NULL DEFAULT '',
+		content TEXT NOT NULL DEFAULT '',
+		PRIMARY KEY (workspace_id, name)
+	);
+	CREATE TABLE IF NOT EXISTS api_keys (
+		id INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		user_id INTEGER NOT NULL DEFAULT 0,
+		prefix TEXT NOT NULL,
+		key_hash TEXT NOT NULL UNIQUE,
+		scopes TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		expires_at DATETIME,
+		last_used_at DATETIME
+	);
+	CREATE TABLE IF NOT EXISTS users (
+		id INTEGER PRIMARY KEY,
+		username TEXT NOT NULL UNIQUE,
+		password_hash TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		role TEXT NOT NULL DEFAULT '',
+		group_role BOOLEAN NOT NULL DEFAULT 0,
+		oidc_issuer TEXT NOT NULL DEFAULT '',
+		oidc_subject TEXT NOT NULL DEFAULT ''
+	);
+	CREATE TABLE IF NOT EXISTS sessions (
+		token_hash TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id),
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		expires_at DATETIME NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS workspaces (
+		id INTEGER PRIMARY KEY,
+		name TEXT NOT NULL UNIQUE,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		default_tags TEXT NOT NULL DEFAULT '',
+		default_utm_template TEXT NOT NULL DEFAULT '',
+		default_preview BOOLEAN NOT NULL DEFAULT 0,
+		default_passthrough BOOLEAN NOT NULL DEFAULT 0
+	);
+	CREATE TABLE IF NOT EXISTS workspace_members (
+		workspace_id INTEGER NOT NULL REFERENCES workspaces(id),
+		user_id INTEGER NOT NULL REFERENCES users(id),
+		owner BOOLEAN NOT NULL DEFAULT 0,
+		PRIMARY KEY (workspace_id, user_id)
+	);
+	CREATE TABLE IF NOT EXISTS domains (
+		id INTEGER PRIMARY KEY,
+		host TEXT NOT NULL UNIQUE,
+		base_url TEXT NOT NULL,
+		workspace_id INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE TABLE IF NOT EXISTS policy_rules (
+		id INTEGER PRIMARY KEY,
+		action TEXT NOT NULL,
+		domain TEXT NOT NULL DEFAULT '',
+		scheme TEXT NOT NULL DEFAULT '',
+		extension TEXT NOT NULL DEFAULT '',
+		regex TEXT NOT NULL DEFAULT '',
+		reason TEXT NOT NULL DEFAULT '',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)
+`
+
 func openDatabase() (db *sql.DB, err error) {
 	db, err = sql.Open("sqlite", config.DatabasePath)
 	if err == nil {
 		fmt.Println("Opened Database")
 
 		// Create tables if they don't exist
-		_, err = db.Exec(`
-			CREATE TABLE IF NOT EXISTS urls (
-				name TEXT NOT NULL,
-				created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-				short TEXT NOT NULL UNIQUE,
-				requested_from TEXT NOT NULL,
-				clicks INTEGER DEFAULT 0
-			)
-		`)
+		_, err = db.Exec(schema)
+		if err == nil {
+			err = migrateDatabase(db)
+		}
 		if err == nil {
 			fmt.Println("Database schema ready")
 		}
@@ -38,13 +293,258 @@ func openDatabase() (db *sql.DB, err error) {
 	return
 }
 
+// migrateDatabase adds columns introduced after the urls table was first
+// created, so that existing databases keep working after an upgrade.
+func migrateDatabase(db *sql.DB) error {
+	columns := []struct {
+		name       string
+		definition string
+	}{
+		{"notes", "TEXT NOT NULL DEFAULT ''"},
+		{"title", "TEXT NOT NULL DEFAULT ''"},
+		{"description", "TEXT NOT NULL DEFAULT ''"},
+		{"image_url", "TEXT NOT NULL DEFAULT ''"},
+		{"check_status", "INTEGER NOT NULL DEFAULT 0"},
+		{"final_url", "TEXT NOT NULL DEFAULT ''"},
+		{"checked_at", "DATETIME"},
+		{"preview", "BOOLEAN NOT NULL DEFAULT 0"},
+		{"password_hash", "TEXT NOT NULL DEFAULT ''"},
+		{"ios_url", "TEXT NOT NULL DEFAULT ''"},
+		{"android_url", "TEXT NOT NULL DEFAULT ''"},
+		{"desktop_url", "TEXT NOT NULL DEFAULT ''"},
+		{"sticky_variants", "BOOLEAN NOT NULL DEFAULT 0"},
+		{"passthrough", "BOOLEAN NOT NULL DEFAULT 0"},
+		{"utm_template", "TEXT NOT NULL DEFAULT ''"},
+		{"not_before", "DATETIME"},
+		{"not_after", "DATETIME"},
+		{"owner_id", "INTEGER NOT NULL DEFAULT 0"},
+		{"workspace_id", "INTEGER NOT NULL DEFAULT 0"},
+		{"domain_id", "INTEGER NOT NULL DEFAULT 0"},
+		{"blocked_reason", "TEXT NOT NULL DEFAULT ''"},
+	}
+	for _, column := range columns {
+		if err := ensureColumn(db, "urls", column.name, column.definition); err != nil {
+			return err
+		}
+	}
+	if err := ensureColumn(db, "clicks", "client_ip", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := migrateDomainCodes(db); err != nil {
+		return err
+	}
+	_, err := db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS urls_domain_short ON urls (domain_id, short);
+		CREATE INDEX IF NOT EXISTS clicks_link ON clicks (domain_id, short)`)
+	if err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "api_keys", "user_id", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	userColumns := []struct {
+		name       string
+		definition string
+	}{
+		{"role", "TEXT NOT NULL DEFAULT ''"},
+		{"group_role", "BOOLEAN NOT NULL DEFAULT 0"},
+		{"oidc_issuer", "TEXT NOT NULL DEFAULT ''"},
+		{"oidc_subject", "TEXT NOT NULL DEFAULT ''"},
+	}
+	for _, column := range userColumns {
+		if err := ensureColumn(db, "users", column.name, column.definition); err != nil {
+			return err
+		}
+	}
+	if _, err := db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS users_oidc ON users (oidc_issuer, oidc_subject) WHERE oidc_subject != ''"); err != nil {
+		return err
+	}
+
+	// Workspaces are owned by their creator, which was always the first member
+	owners, err := hasColumn(db, "workspace_members", "owner")
+	if err != nil {
+		return err
+	}
+	if !owners {
+		_, err := db.Exec(`ALTER TABLE workspace_members ADD COLUMN owner BOOLEAN NOT NULL DEFAULT 0;
+			UPDATE workspace_members SET owner = 1 WHERE rowid IN (SELECT MIN(rowid) FROM workspace_members GROUP BY workspace_id)`)
+		if err != nil {
+			return err
+		}
+	}
+
+	scoped, err := hasColumn(db, "utm_templates", "workspace_id")
+	if err != nil || scoped {
+		return err
+	}
+	return migrateUTMTemplates(db)
+}
+
+// migrateUTMTemplates moves UTM templates from one list shared by everybody
+// to one list per workspace. Every workspace, and the links outside of
+// workspaces, start with a copy of the old templates, so links keep their
+// parameters.
+func migrateUTMTemplates(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`ALTER TABLE utm_templates RENAME TO utm_templates_shared;
+		CREATE TABLE utm_templates (
+			workspace_id INTEGER NOT NULL DEFAULT 0,
+			name TEXT NOT NULL,
+			source TEXT NOT NULL,
+			medium TEXT NOT NULL,
+			campaign TEXT NOT NULL,
+			term TEXT NOT NULL DEFAULT '',
+			content TEXT NOT NULL DEFAULT '',
+			PRIMARY KEY (workspace_id, name)
+		);
+		INSERT INTO utm_templates (workspace_id, name, source, medium, campaign, term, content)
+			SELECT 0, name, source, medium, campaign, term, content FROM utm_templates_shared;
+		INSERT INTO utm_templates (workspace_id, name, source, medium, campaign, term, content)
+			SELECT workspaces.id, t.name, t.source, t.medium, t.campaign, t.term, t.content
+			FROM workspaces, utm_templates_shared t;
+		DROP TABLE utm_templates_shared`)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// migrateDomainCodes gives every domain its own codes. Codes used to be
+// unique across all domains, and the tags, country rules, variants and clicks
+// of a link were found by its code alone, so they get the domain of their
+// link. SQLite cannot drop a constraint in place, so the tables are renamed,
+// created again from the schema and filled with the old rows.
+func migrateDomainCodes(db *sql.DB) error {
+	var uniqueCode bool
+	err := db.QueryRow(`SELECT COUNT(*) > 0 FROM pragma_index_list('urls') l
+		WHERE l."unique" AND l.origin = 'u'
+		AND (SELECT GROUP_CONCAT(name) FROM pragma_index_info(l.name)) = 'short'`).Scan(&uniqueCode)
+	if err != nil {
+		return err
+	}
+	var rebuild []string
+	if uniqueCode {
+		rebuild = append(rebuild, "urls")
+	}
+	for _, table := range []string{"url_tags", "geo_rules", "link_variants"} {
+		keyed, err := hasColumn(db, table, "domain_id")
+		if err != nil {
+			return err
+		}
+		if !keyed {
+			rebuild = append(rebuild, table)
+		}
+	}
+	clicksKeyed, err := hasColumn(db, "clicks", "domain_id")
+	if err != nil || (len(rebuild) == 0 && clicksKeyed) {
+		return err
+	}
+
+	columns := make(map[string][]string)
+	for _, table := range rebuild {
+		if columns[table], err = tableColumns(db, table); err != nil {
+			return err
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, table := range rebuild {
+		if _, err := tx.Exec("ALTER TABLE " + table + " RENAME TO " + table + "_shared"); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(schema); err != nil {
+		return err
+	}
+	linkDomain := "COALESCE((SELECT domain_id FROM urls WHERE urls.short = old.short), 0)"
+	for _, table := range rebuild {
+		list := strings.Join(columns[table], ", ")
+		query := fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s_shared old", table, list, list, table)
+		if table != "urls" {
+			query = fmt.Sprintf("INSERT INTO %s (domain_id, %s) SELECT %s, %s FROM %s_shared old",
+				table, list, linkDomain, list, table)
+		}
+		if _, err := tx.Exec(query); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DROP TABLE " + table + "_shared"); err != nil {
+			return err
+		}
+	}
+	if !clicksKeyed {
+		_, err := tx.Exec(`ALTER TABLE clicks ADD COLUMN domain_id INTEGER NOT NULL DEFAULT 0;
+			UPDATE clicks SET domain_id = ` + strings.ReplaceAll(linkDomain, "old.", "clicks.") + `;
+			DROP INDEX IF EXISTS clicks_short`)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// tableColumns returns the names of the columns of a table, in order
+func tableColumns(db *sql.DB, table string) ([]string, error) {
+	rows, err := db.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var columns []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		columns = append(columns, name)
+	}
+	return columns, rows.Err()
+}
+
+// isUniqueViolation reports whether a statement failed because a unique key
+// is already taken
+func isUniqueViolation(err error) bool {
+	var sqliteErr *sqlite.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE
+}
+
+// hasColumn reports whether a table has a column
+func hasColumn(db *sql.DB, table string, column string) (bool, error) {
+	columns, err := tableColumns(db, table)
+	if err != nil {
+		return false, err
+	}
+	for _, name := range columns {
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ensureColumn adds a column to a table unless it already exists
+func ensureColumn(db *sql.DB, table string, column string, definition string) error {
+	exists, err := hasColumn(db, table, column)
+	if err != nil || exists {
+		return err
+	}
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
 func createURL(db *sql.DB, name string, short string, requestedFrom string) (URL, error) {
 	_, err := db.Exec("INSERT INTO urls (name, short, requested_from) VALUES (?, ?, ?)", name, short, requestedFrom)
 	if err != nil {
 		return URL{}, err
 	}
 	var url URL
-	row := db.QueryRow("SELECT name, created_at, short, requested_from FROM urls WHERE name = ? AND short = ?", name, short)
+	row := db.QueryRow("SELECT name, created_at, short, requested_from FROM urls WHERE domain_id = 0 AND short = ?", short)
 	err = row.Scan(&url.Name, &url.CreatedAt, &url.Short, &url.RequestedFrom)
 	if err != nil {
 		return URL{}, err
@@ -52,71 +552,800 @@ func createURL(db *sql.DB, name string, short string, requestedFrom string) (URL
 	return url, nil
 }
 
-func addClicks(db *sql.DB, short string) error {
-	_, err := db.Exec("UPDATE urls SET clicks = clicks + 1 WHERE short = ?", short)
+func addClicks(db *sql.DB, domainID int64, short string) error {
+	_, err := db.Exec("UPDATE urls SET clicks = clicks + 1 WHERE domain_id = ? AND short = ?", domainID, short)
+	return err
+}
+
+// logClick counts a click and records which variant, if any, was served
+func logClick(db *sql.DB, domainID int64, short string, variant string, clientIP string) error {
+	if err := addClicks(db, domainID, short); err != nil {
+		return err
+	}
+	_, err := db.Exec("INSERT INTO clicks (domain_id, short, variant, client_ip) VALUES (?, ?, ?, ?)",
+		domainID, short, variant, clientIP)
 	return err
 }
 
+// VariantStats is the number of logged clicks on one destination of a link
+type VariantStats struct {
+	Variant string
+	Clicks  int
+}
+
+// queryVariantStats counts logged clicks per variant, most clicked first
+func queryVariantStats(db *sql.DB, domainID int64, short string) ([]VariantStats, error) {
+	rows, err := db.Query(`SELECT variant, COUNT(*) FROM clicks WHERE domain_id = ? AND short = ?
+		GROUP BY variant ORDER BY COUNT(*) DESC, variant`, domainID, short)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var stats []VariantStats
+	for rows.Next() {
+		var s VariantStats
+		if err := rows.Scan(&s.Variant, &s.Clicks); err != nil {
+			return nil, err
+		}
+		stats = append(stats, s)
+	}
+	return stats, rows.Err()
+}
+
 func queryURLs(db *sql.DB) ([]URL, error) {
-	rows, err := db.Query("SELECT * FROM urls")
+	return queryFilteredURLs(db, URLFilter{AllWorkspaces: true})
+}
+
+func queryURLsFromRequested(db *sql.DB, requestedFrom string) ([]URL, error) {
+	rows, err := db.Query("SELECT "+urlColumns+" FROM urls WHERE requested_from = ?", requestedFrom)
+	if err != nil {
+		return nil, err
+	}
+	return scanURLs(rows)
+}
+
+func queryRecentURLs(db *sql.DB, limit int) ([]URL, error) {
+	return queryFilteredURLs(db, URLFilter{Limit: limit})
+}
+
+// queryFilteredURLs returns URLs matching the filter, newest first
+func queryFilteredURLs(db *sql.DB, filter URLFilter) ([]URL, error) {
+	query := "SELECT " + urlColumns + " FROM urls"
+	var where []string
+	var args []any
+	if filter.Tag != "" {
+		where = append(where, `EXISTS (SELECT 1 FROM url_tags JOIN tags ON tags.id = url_tags.tag_id
+			WHERE url_tags.domain_id = urls.domain_id AND url_tags.short = urls.short AND tags.name = ?)`)
+		args = append(args, filter.Tag)
+	}
+	if filter.Broken {
+		where = append(where, "checked_at IS NOT NULL AND (check_status = 0 OR check_status >= 400)")
+	}
+	if !filter.AllWorkspaces {
+		where = append(where, "workspace_id = ?")
+		args = append(args, filter.WorkspaceID)
+	}
+	if filter.ByOwner {
+		where = append(where, "COALESCE(owner_id, 0) = ?")
+		args = append(args, filter.OwnerID)
+	}
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY created_at DESC"
+	if filter.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, filter.Limit)
+	}
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanURLs(rows)
+}
+
+// queryShortURL returns the link with a code on a domain, or on the base URL for 0
+func queryShortURL(db *sql.DB, domainID int64, short string) (URL, error) {
+	row := db.QueryRow("SELECT "+urlColumns+" FROM urls WHERE domain_id = ? AND short = ?", domainID, short)
+	return scanURL(row)
+}
+
+// insertURL stores a new URL together with its owner, workspace, domain,
+// password hash and details in one transaction, so that a failure never
+// leaves a partly saved link behind
+func insertURL(db *sql.DB, url URL, passwordHash string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT INTO urls (name, short, requested_from, owner_id, workspace_id, domain_id, password_hash)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`, url.Name, url.Short, url.RequestedFrom, url.OwnerID, url.WorkspaceID,
+		url.DomainID, passwordHash)
+	if err != nil {
+		return err
+	}
+	if err := saveURLDetails(tx, url); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// updateURLDetails saves the user editable fields of a URL, replacing its tags,
+// country rules and variants
+func updateURLDetails(db *sql.DB, url URL) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := saveURLDetails(tx, url); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func saveURLDetails(tx *sql.Tx, url URL) error {
+	domainID, short := url.DomainID, url.Short
+	result, err := tx.Exec(`UPDATE urls SET notes = ?, preview = ?, ios_url = ?, android_url = ?, desktop_url = ?,
+		sticky_variants = ?, passthrough = ?, utm_template = ?, not_before = ?, not_after = ?
+		WHERE domain_id = ? AND short = ?`,
+		url.Notes, url.Preview, url.IOSURL, url.AndroidURL, url.DesktopURL, url.StickyVariants, url.Passthrough,
+		url.UTMTemplate, sql.NullTime{Time: url.NotBefore, Valid: !url.NotBefore.IsZero()},
+		sql.NullTime{Time: url.NotAfter, Valid: !url.NotAfter.IsZero()}, domainID, short)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	if _, err := tx.Exec("DELETE FROM url_tags WHERE domain_id = ? AND short = ?", domainID, short); err != nil {
+		return err
+	}
+	for _, tag := range url.Tags {
+		if _, err := tx.Exec("INSERT OR IGNORE INTO tags (name) VALUES (?)", tag); err != nil {
+			return err
+		}
+		_, err := tx.Exec("INSERT OR IGNORE INTO url_tags (domain_id, short, tag_id) SELECT ?, ?, id FROM tags WHERE name = ?",
+			domainID, short, tag)
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM geo_rules WHERE domain_id = ? AND short = ?", domainID, short); err != nil {
+		return err
+	}
+	for country, target := range url.CountryTargets {
+		_, err := tx.Exec("INSERT INTO geo_rules (domain_id, short, country, target) VALUES (?, ?, ?, ?)",
+			domainID, short, country, target)
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM link_variants WHERE domain_id = ? AND short = ?", domainID, short); err != nil {
+		return err
+	}
+	for i, variant := range url.Variants {
+		_, err := tx.Exec("INSERT INTO link_variants (domain_id, short, position, target, weight) VALUES (?, ?, ?, ?, ?)",
+			domainID, short, i, variant.Target, variant.Weight)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateURLMetadata stores the title and Open Graph details fetched from the destination
+func updateURLMetadata(db *sql.DB, domainID int64, short string, meta PageMetadata) error {
+	_, err := db.Exec("UPDATE urls SET title = ?, description = ?, image_url = ? WHERE domain_id = ? AND short = ?",
+		meta.Title, meta.Description, meta.ImageURL, domainID, short)
+	return err
+}
+
+// updateURLCheck stores the result of the latest link check
+func updateURLCheck(db *sql.DB, domainID int64, short string, result CheckResult) error {
+	_, err := db.Exec("UPDATE urls SET check_status = ?, final_url = ?, checked_at = ? WHERE domain_id = ? AND short = ?",
+		result.Status, result.FinalURL, result.CheckedAt, domainID, short)
+	return err
+}
+
+// updateURLBlocked disables a link with the reason it was blocked, an empty
+// reason enables it again
+func updateURLBlocked(db *sql.DB, domainID int64, short string, reason string) error {
+	_, err := db.Exec("UPDATE urls SET blocked_reason = ? WHERE domain_id = ? AND short = ?", reason, domainID, short)
+	return err
+}
+
+// updateURLPassword sets the password hash of a URL, an empty hash removes the password
+func updateURLPassword(db *sql.DB, domainID int64, short string, hash string) error {
+	_, err := db.Exec("UPDATE urls SET password_hash = ? WHERE domain_id = ? AND short = ?", hash, domainID, short)
+	return err
+}
+
+// queryURLPasswordHash returns the password hash of a URL, which is never part of URL itself
+func queryURLPasswordHash(db *sql.DB, domainID int64, short string) (string, error) {
+	var hash string
+	err := db.QueryRow("SELECT password_hash FROM urls WHERE domain_id = ? AND short = ?", domainID, short).Scan(&hash)
+	return hash, err
+}
+
+// saveUTMTemplate creates a UTM template or replaces the one with the same
+// name in its workspace
+func saveUTMTemplate(db *sql.DB, t UTMTemplate) error {
+	_, err := db.Exec(`INSERT OR REPLACE INTO utm_templates (workspace_id, name, source, medium, campaign, term, content)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`, t.WorkspaceID, t.Name, t.Source, t.Medium, t.Campaign, t.Term, t.Content)
+	return err
+}
+
+func deleteUTMTemplate(db *sql.DB, workspaceID int64, name string) error {
+	_, err := db.Exec("DELETE FROM utm_templates WHERE workspace_id = ? AND name = ?", workspaceID, name)
+	return err
+}
+
+const utmTemplateColumns = "workspace_id, name, source, medium, campaign, term, content"
+
+func scanUTMTemplate(row rowScanner) (UTMTemplate, error) {
+	var t UTMTemplate
+	err := row.Scan(&t.WorkspaceID, &t.Name, &t.Source, &t.Medium, &t.Campaign, &t.Term, &t.Content)
+	return t, err
+}
+
+// queryUTMTemplate returns a template of a workspace, or of the links outside
+// of workspaces for 0
+func queryUTMTemplate(db *sql.DB, workspaceID int64, name string) (UTMTemplate, error) {
+	row := db.QueryRow("SELECT "+utmTemplateColumns+" FROM utm_templates WHERE workspace_id = ? AND name = ?", workspaceID, name)
+	return scanUTMTemplate(row)
+}
+
+func queryUTMTemplates(db *sql.DB, workspaceID int64) ([]UTMTemplate, error) {
+	rows, err := db.Query("SELECT "+utmTemplateColumns+" FROM utm_templates WHERE workspace_id = ? ORDER BY name", workspaceID)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	var urls []URL
+	var templates []UTMTemplate
 	for rows.Next() {
-		var url URL
-		err = rows.Scan(&url.Name, &url.CreatedAt, &url.Short, &url.RequestedFrom, &url.Clicks)
+		t, err := scanUTMTemplate(rows)
 		if err != nil {
 			return nil, err
 		}
-		urls = append(urls, url)
+		templates = append(templates, t)
 	}
-	return urls, nil
+	return templates, rows.Err()
 }
 
-func queryURLsFromRequested(db *sql.DB, requestedFrom string) ([]URL, error) {
-	rows, err := db.Query("SELECT * FROM urls WHERE requested_from = ?", requestedFrom)
+// createAPIKey generates and stores a new API key, returning it together with
+// the key itself, which cannot be recovered later
+func createAPIKey(db *sql.DB, name string, userID int64, scopes []string, expiresAt time.Time) (APIKey, string, error) {
+	token, err := generateAPIKey()
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	key := APIKey{
+		Name:      name,
+		UserID:    userID,
+		Prefix:    token[:len(apiKeyPrefix)+6],
+		Scopes:    scopes,
+		CreatedAt: time.Now(),
+		ExpiresAt: expiresAt,
+	}
+	result, err := db.Exec(`INSERT INTO api_keys (name, user_id, prefix, key_hash, scopes, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`, key.Name, key.UserID, key.Prefix, hashToken(token), strings.Join(scopes, ","), key.CreatedAt,
+		sql.NullTime{Time: expiresAt, Valid: !expiresAt.IsZero()})
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	key.ID, err = result.LastInsertId()
+	return key, token, err
+}
+
+const apiKeyColumns = `id, name, user_id, (SELECT username FROM users WHERE users.id = api_keys.user_id),
+	(SELECT role FROM users WHERE users.id = api_keys.user_id), prefix, scopes, created_at, expires_at, last_used_at`
+
+func scanAPIKey(row rowScanner) (APIKey, error) {
+	var key APIKey
+	var scopes string
+	var owner, ownerRole sql.NullString
+	var expiresAt, lastUsedAt sql.NullTime
+	err := row.Scan(&key.ID, &key.Name, &key.UserID, &owner, &ownerRole, &key.Prefix, &scopes, &key.CreatedAt,
+		&expiresAt, &lastUsedAt)
+	if err != nil {
+		return APIKey{}, err
+	}
+	key.Owner = owner.String
+	key.OwnerRole = ownerRole.String
+	key.Scopes = strings.Split(scopes, ",")
+	key.ExpiresAt = expiresAt.Time
+	key.LastUsedAt = lastUsedAt.Time
+	return key, nil
+}
+
+func queryAPIKeyByHash(db *sql.DB, hash string) (APIKey, error) {
+	return scanAPIKey(db.QueryRow("SELECT "+apiKeyColumns+" FROM api_keys WHERE key_hash = ?", hash))
+}
+
+func queryAPIKeys(db *sql.DB) ([]APIKey, error) {
+	rows, err := db.Query("SELECT " + apiKeyColumns + " FROM api_keys ORDER BY id")
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	var urls []URL
+	var keys []APIKey
 	for rows.Next() {
-		var url URL
-		err = rows.Scan(&url.Name, &url.CreatedAt, &url.Short, &url.RequestedFrom, &url.Clicks)
+		key, err := scanAPIKey(rows)
 		if err != nil {
 			return nil, err
 		}
-		urls = append(urls, url)
+		keys = append(keys, key)
 	}
-	return urls, nil
+	return keys, rows.Err()
 }
 
-func queryRecentURLs(db *sql.DB, limit int) ([]URL, error) {
-	rows, err := db.Query("SELECT * FROM urls ORDER BY created_at DESC LIMIT ?", limit)
+func updateAPIKeyLastUsed(db *sql.DB, id int64, usedAt time.Time) error {
+	_, err := db.Exec("UPDATE api_keys SET last_used_at = ? WHERE id = ?", usedAt, id)
+	return err
+}
+
+// deleteAPIKey revokes a key, returning sql.ErrNoRows if it does not exist
+func deleteAPIKey(db *sql.DB, id int64) error {
+	result, err := db.Exec("DELETE FROM api_keys WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// updateURLOwner records the user who created a URL
+func updateURLOwner(db *sql.DB, domainID int64, short string, ownerID int64) error {
+	_, err := db.Exec("UPDATE urls SET owner_id = ? WHERE domain_id = ? AND short = ?", ownerID, domainID, short)
+	return err
+}
+
+func createUser(db *sql.DB, username string, passwordHash string) (User, error) {
+	user := User{Username: username, CreatedAt: time.Now()}
+	result, err := db.Exec("INSERT INTO users (username, password_hash, created_at) VALUES (?, ?, ?)",
+		username, passwordHash, user.CreatedAt)
+	if err != nil {
+		return User{}, err
+	}
+	user.ID, err = result.LastInsertId()
+	return user, err
+}
+
+// queryUserByName returns a user together with their password hash
+func queryUserByName(db *sql.DB, username string) (User, string, error) {
+	var user User
+	var hash string
+	err := db.QueryRow("SELECT id, username, created_at, role, password_hash FROM users WHERE username = ?", username).
+		Scan(&user.ID, &user.Username, &user.CreatedAt, &user.Role, &hash)
+	return user, hash, err
+}
+
+func queryUsers(db *sql.DB) ([]User, error) {
+	rows, err := db.Query("SELECT id, username, created_at, role FROM users ORDER BY username")
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	var urls []URL
+	var users []User
+	for rows.Next() {
+		var user User
+		if err := rows.Scan(&user.ID, &user.Username, &user.CreatedAt, &user.Role); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+// createOIDCUser creates a user that signs in with an OpenID Connect provider
+// and has no password
+func createOIDCUser(db *sql.DB, username string, issuer string, subject string, role string) (User, error) {
+	user := User{Username: username, CreatedAt: time.Now(), Role: role, GroupRole: role != ""}
+	result, err := db.Exec(`INSERT INTO users (username, password_hash, created_at, role, group_role, oidc_issuer, oidc_subject)
+		VALUES (?, '', ?, ?, ?, ?, ?)`, username, user.CreatedAt, role, user.GroupRole, issuer, subject)
+	if err != nil {
+		return User{}, err
+	}
+	user.ID, err = result.LastInsertId()
+	return user, err
+}
+
+// queryUserBySubject returns the user linked to a subject of an OpenID Connect provider
+func queryUserBySubject(db *sql.DB, issuer string, subject string) (User, error) {
+	var user User
+	err := db.QueryRow(`SELECT id, username, created_at, role, group_role FROM users
+		WHERE oidc_issuer = ? AND oidc_subject = ?`, issuer, subject).
+		Scan(&user.ID, &user.Username, &user.CreatedAt, &user.Role, &user.GroupRole)
+	return user, err
+}
+
+// deleteURL purges a URL together with its tags, rules, variants and click log
+func deleteURL(db *sql.DB, domainID int64, short string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec("DELETE FROM urls WHERE domain_id = ? AND short = ?", domainID, short)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	for _, table := range []string{"url_tags", "geo_rules", "link_variants", "clicks"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE domain_id = ? AND short = ?", domainID, short); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// updateUserRole assigns a role by hand, which group rules of the identity
+// provider leave alone
+func updateUserRole(db *sql.DB, id int64, role string) error {
+	_, err := db.Exec("UPDATE users SET role = ?, group_role = 0 WHERE id = ?", role, id)
+	return err
+}
+
+// updateUserGroupRole sets the role granted by an oidc_group_roles rule, or
+// the default role for "" once no rule grants one any more
+func updateUserGroupRole(db *sql.DB, id int64, role string) error {
+	_, err := db.Exec("UPDATE users SET role = ?, group_role = ? WHERE id = ?", role, role != "", id)
+	return err
+}
+
+// updateUserPassword changes the password of a user and ends all their sessions
+func updateUserPassword(db *sql.DB, username string, passwordHash string) error {
+	user, _, err := queryUserByName(db, username)
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("UPDATE users SET password_hash = ? WHERE id = ?", passwordHash, user.ID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM sessions WHERE user_id = ?", user.ID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// deleteUser removes a user along with their sessions and API keys. Their
+// links are kept without an owner, because SQLite hands the id of the removed
+// user to the next user created.
+func deleteUser(db *sql.DB, username string) error {
+	user, _, err := queryUserByName(db, username)
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, query := range []string{
+		"DELETE FROM sessions WHERE user_id = ?",
+		"DELETE FROM api_keys WHERE user_id = ?",
+		"DELETE FROM workspace_members WHERE user_id = ?",
+		"UPDATE urls SET owner_id = 0 WHERE owner_id = ?",
+		"DELETE FROM users WHERE id = ?",
+	} {
+		if _, err := tx.Exec(query, user.ID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// createSession stores a new session, removing expired ones on the way
+func createSession(db *sql.DB, tokenHash string, userID int64, expiresAt time.Time) error {
+	if _, err := db.Exec("DELETE FROM sessions WHERE expires_at < ?", time.Now()); err != nil {
+		return err
+	}
+	_, err := db.Exec("INSERT INTO sessions (token_hash, user_id, created_at, expires_at) VALUES (?, ?, ?, ?)",
+		tokenHash, userID, time.Now(), expiresAt)
+	return err
+}
+
+// querySessionUser returns the user of a session that has not expired
+func querySessionUser(db *sql.DB, tokenHash string, now time.Time) (User, error) {
+	var user User
+	var expiresAt time.Time
+	err := db.QueryRow(`SELECT users.id, users.username, users.created_at, users.role, sessions.expires_at
+		FROM sessions JOIN users ON users.id = sessions.user_id WHERE sessions.token_hash = ?`, tokenHash).
+		Scan(&user.ID, &user.Username, &user.CreatedAt, &user.Role, &expiresAt)
+	if err != nil {
+		return User{}, err
+	}
+	if !now.Before(expiresAt) {
+		return User{}, sql.ErrNoRows
+	}
+	return user, nil
+}
+
+func deleteSession(db *sql.DB, tokenHash string) error {
+	_, err := db.Exec("DELETE FROM sessions WHERE token_hash = ?", tokenHash)
+	return err
+}
+
+// queryTags returns the names of all tags that are attached to at least one
+// URL in a workspace, or in no workspace for 0
+func queryTags(db *sql.DB, workspaceID int64) ([]string, error) {
+	rows, err := db.Query(`SELECT DISTINCT tags.name FROM tags
+		JOIN url_tags ON url_tags.tag_id = tags.id
+		JOIN urls ON urls.domain_id = url_tags.domain_id AND urls.short = url_tags.short
+		WHERE urls.workspace_id = ? ORDER BY tags.name`, workspaceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tags []string
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+// parseTags splits a comma separated list into normalized, unique, sorted tags
+func parseTags(s string) []string {
+	seen := make(map[string]bool)
+	var tags []string
+	for _, tag := range strings.Split(s, ",") {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// createWorkspace creates a workspace with the user creating it as its first member
+func createWorkspace(db *sql.DB, name string, userID int64) (Workspace, error) {
+	workspace := Workspace{Name: name, CreatedAt: time.Now()}
+	tx, err := db.Begin()
+	if err != nil {
+		return workspace, err
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec("INSERT INTO workspaces (name, created_at) VALUES (?, ?)", name, workspace.CreatedAt)
+	if err != nil {
+		return workspace, err
+	}
+	workspace.ID, err = result.LastInsertId()
+	if err != nil {
+		return workspace, err
+	}
+	if _, err := tx.Exec("INSERT INTO workspace_members (workspace_id, user_id, owner) VALUES (?, ?, 1)", workspace.ID, userID); err != nil {
+		return workspace, err
+	}
+	return workspace, tx.Commit()
+}
+
+const workspaceColumns = "id, name, created_at, default_tags, default_utm_template, default_preview, default_passthrough"
+
+func scanWorkspace(row rowScanner) (Workspace, error) {
+	var workspace Workspace
+	var tags string
+	err := row.Scan(&workspace.ID, &workspace.Name, &workspace.CreatedAt, &tags,
+		&workspace.DefaultUTMTemplate, &workspace.DefaultPreview, &workspace.DefaultPassthrough)
+	workspace.DefaultTags = parseTags(tags)
+	return workspace, err
+}
+
+func scanWorkspaces(rows *sql.Rows) ([]Workspace, error) {
+	defer rows.Close()
+	var workspaces []Workspace
 	for rows.Next() {
-		var url URL
-		err = rows.Scan(&url.Name, &url.CreatedAt, &url.Short, &url.RequestedFrom, &url.Clicks)
+		workspace, err := scanWorkspace(rows)
 		if err != nil {
 			return nil, err
 		}
-		urls = append(urls, url)
+		workspaces = append(workspaces, workspace)
 	}
-	return urls, nil
+	return workspaces, rows.Err()
 }
 
-func queryShortURL(db *sql.DB, short string) (URL, error) {
-	var url URL
-	row := db.QueryRow("SELECT * FROM urls WHERE short = ?", short)
-	err := row.Scan(&url.Name, &url.CreatedAt, &url.Short, &url.RequestedFrom, &url.Clicks)
+func queryWorkspace(db *sql.DB, id int64) (Workspace, error) {
+	return scanWorkspace(db.QueryRow("SELECT "+workspaceColumns+" FROM workspaces WHERE id = ?", id))
+}
+
+// queryWorkspaces returns every workspace, or only those of a user unless userID is 0
+func queryWorkspaces(db *sql.DB, userID int64) ([]Workspace, error) {
+	if userID == 0 {
+		rows, err := db.Query("SELECT " + workspaceColumns + " FROM workspaces ORDER BY name")
+		if err != nil {
+			return nil, err
+		}
+		return scanWorkspaces(rows)
+	}
+	rows, err := db.Query("SELECT "+workspaceColumns+" FROM workspaces WHERE id IN (SELECT workspace_id FROM workspace_members WHERE user_id = ?) ORDER BY name", userID)
 	if err != nil {
-		return URL{}, err
+		return nil, err
 	}
-	return url, nil
+	return scanWorkspaces(rows)
+}
+
+func queryWorkspaceMember(db *sql.DB, workspaceID int64, userID int64) (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM workspace_members WHERE workspace_id = ? AND user_id = ?", workspaceID, userID).Scan(&count)
+	return count > 0, err
+}
+
+// queryWorkspaceOwner reports whether a user owns a workspace
+func queryWorkspaceOwner(db *sql.DB, workspaceID int64, userID int64) (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM workspace_members WHERE workspace_id = ? AND user_id = ? AND owner",
+		workspaceID, userID).Scan(&count)
+	return count > 0, err
+}
+
+// queryWorkspaceMembers returns the users in a workspace, by username
+func queryWorkspaceMembers(db *sql.DB, workspaceID int64) ([]WorkspaceMember, error) {
+	rows, err := db.Query(`SELECT users.id, username, users.created_at, role, owner FROM users
+		JOIN workspace_members ON workspace_members.user_id = users.id
+		WHERE workspace_id = ? ORDER BY username`, workspaceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var members []WorkspaceMember
+	for rows.Next() {
+		var member WorkspaceMember
+		if err := rows.Scan(&member.ID, &member.Username, &member.CreatedAt, &member.Role, &member.Owner); err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	return members, rows.Err()
+}
+
+func addWorkspaceMember(db *sql.DB, workspaceID int64, userID int64) error {
+	_, err := db.Exec("INSERT OR IGNORE INTO workspace_members (workspace_id, user_id) VALUES (?, ?)", workspaceID, userID)
+	return err
+}
+
+func removeWorkspaceMember(db *sql.DB, workspaceID int64, userID int64) error {
+	_, err := db.Exec("DELETE FROM workspace_members WHERE workspace_id = ? AND user_id = ?", workspaceID, userID)
+	return err
+}
+
+// updateWorkspaceDefaults saves the defaults of new links in a workspace
+func updateWorkspaceDefaults(db *sql.DB, workspace Workspace) error {
+	_, err := db.Exec(`UPDATE workspaces SET default_tags = ?, default_utm_template = ?, default_preview = ?, default_passthrough = ?
+		WHERE id = ?`, strings.Join(workspace.DefaultTags, ","), workspace.DefaultUTMTemplate,
+		workspace.DefaultPreview, workspace.DefaultPassthrough, workspace.ID)
+	return err
+}
+
+func createDomain(db *sql.DB, domain Domain) (Domain, error) {
+	domain.CreatedAt = time.Now()
+	result, err := db.Exec("INSERT INTO domains (host, base_url, workspace_id, created_at) VALUES (?, ?, ?, ?)",
+		domain.Host, domain.BaseURL, domain.WorkspaceID, domain.CreatedAt)
+	if err != nil {
+		return domain, err
+	}
+	domain.ID, err = result.LastInsertId()
+	return domain, err
+}
+
+const domainColumns = "id, host, base_url, workspace_id, (SELECT name FROM workspaces WHERE workspaces.id = domains.workspace_id), created_at"
+
+func scanDomain(row rowScanner) (Domain, error) {
+	var domain Domain
+	var workspace sql.NullString
+	err := row.Scan(&domain.ID, &domain.Host, &domain.BaseURL, &domain.WorkspaceID, &workspace, &domain.CreatedAt)
+	domain.Workspace = workspace.String
+	return domain, err
+}
+
+// queryDomains returns every short domain, or only those of a workspace
+// (0 for personal links) unless all is set
+func queryDomains(db *sql.DB, workspaceID int64, all bool) ([]Domain, error) {
+	query := "SELECT " + domainColumns + " FROM domains"
+	var args []any
+	if !all {
+		query += " WHERE workspace_id = ?"
+		args = append(args, workspaceID)
+	}
+	rows, err := db.Query(query+" ORDER BY host", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var domains []Domain
+	for rows.Next() {
+		domain, err := scanDomain(rows)
+		if err != nil {
+			return nil, err
+		}
+		domains = append(domains, domain)
+	}
+	return domains, rows.Err()
+}
+
+func queryDomain(db *sql.DB, id int64) (Domain, error) {
+	return scanDomain(db.QueryRow("SELECT "+domainColumns+" FROM domains WHERE id = ?", id))
+}
+
+func queryDomainByHost(db *sql.DB, host string) (Domain, error) {
+	return scanDomain(db.QueryRow("SELECT "+domainColumns+" FROM domains WHERE host = ?", host))
+}
+
+// deleteDomain removes a short domain. Its links are served on the base URL
+// again, so it cannot be removed while one of their codes is used there.
+func deleteDomain(db *sql.DB, id int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var taken int
+	err = tx.QueryRow(`SELECT COUNT(*) FROM urls WHERE domain_id = ?
+		AND short IN (SELECT short FROM urls WHERE domain_id = 0)`, id).Scan(&taken)
+	if err != nil {
+		return err
+	}
+	if taken > 0 {
+		return fmt.Errorf("%d links on this domain use codes that are taken on the base URL, purge them first", taken)
+	}
+	for _, table := range []string{"urls", "url_tags", "geo_rules", "link_variants", "clicks"} {
+		if _, err := tx.Exec("UPDATE "+table+" SET domain_id = 0 WHERE domain_id = ?", id); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM domains WHERE id = ?", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func createPolicyRule(db *sql.DB, rule PolicyRule) (PolicyRule, error) {
+	result, err := db.Exec("INSERT INTO policy_rules (action, domain, scheme, extension, regex, reason) VALUES (?, ?, ?, ?, ?, ?)",
+		rule.Action, rule.Domain, rule.Scheme, rule.Extension, rule.Regex, rule.Reason)
+	if err != nil {
+		return rule, err
+	}
+	rule.ID, err = result.LastInsertId()
+	return rule, err
+}
+
+// queryPolicyRules returns the destination rules stored in the database, in the order they were added
+func queryPolicyRules(db *sql.DB) ([]PolicyRule, error) {
+	rows, err := db.Query("SELECT id, action, domain, scheme, extension, regex, reason FROM policy_rules ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var rules []PolicyRule
+	for rows.Next() {
+		rule := PolicyRule{Source: "database"}
+		if err := rows.Scan(&rule.ID, &rule.Action, &rule.Domain, &rule.Scheme, &rule.Extension, &rule.Regex, &rule.Reason); err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+func deletePolicyRule(db *sql.DB, id int64) error {
+	_, err := db.Exec("DELETE FROM policy_rules WHERE id = ?", id)
+	return err
 }
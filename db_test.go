@@ -1,6 +1,8 @@
 package main
 
 import (
+	"database/sql"
+	"path/filepath"
 	"testing"
 )
 
@@ -122,3 +124,168 @@ func TestQueryRecentURLs(t *testing.T) {
 		}
 	}
 }
+
+func TestUpdateURLDetails(t *testing.T) {
+	db, err := openDatabase()
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	short := "tagged01"
+	createURL(db, "https://tagged.com", short, "127.0.0.1")
+
+	err = updateURLDetails(db, URL{Short: short, Notes: "Spring launch", Tags: []string{"campaign", "spring"}})
+	if err != nil {
+		t.Fatalf("Failed to update URL details: %v", err)
+	}
+
+	url, err := queryShortURL(db, 0, short)
+	if err != nil {
+		t.Fatalf("Failed to query URL: %v", err)
+	}
+	if url.Notes != "Spring launch" {
+		t.Errorf("Expected notes %q, got %q", "Spring launch", url.Notes)
+	}
+	if url.TagList() != "campaign, spring" {
+		t.Errorf("Expected tags %q, got %q", "campaign, spring", url.TagList())
+	}
+
+	// Replacing the tags drops the ones that are no longer listed
+	err = updateURLDetails(db, URL{Short: short, Tags: []string{"spring"}})
+	if err != nil {
+		t.Fatalf("Failed to update URL details: %v", err)
+	}
+
+	urls, err := queryFilteredURLs(db, URLFilter{Tag: "campaign"})
+	if err != nil {
+		t.Fatalf("Failed to filter URLs: %v", err)
+	}
+	for _, url := range urls {
+		if url.Short == short {
+			t.Errorf("URL %s should no longer be tagged campaign", short)
+		}
+	}
+
+	urls, err = queryFilteredURLs(db, URLFilter{Tag: "spring"})
+	if err != nil {
+		t.Fatalf("Failed to filter URLs: %v", err)
+	}
+	if len(urls) == 0 || urls[0].Short != short {
+		t.Errorf("Expected URL %s when filtering by spring, got %v", short, urls)
+	}
+
+	if err := updateURLDetails(db, URL{Short: "missing"}); err == nil {
+		t.Error("Expected error when updating a missing URL")
+	}
+}
+
+func TestParseTags(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"", ""},
+		{"campaign", "campaign"},
+		{" Project , campaign,,project ", "campaign, project"},
+	}
+
+	for _, tt := range tests {
+		got := URL{Tags: parseTags(tt.input)}.TagList()
+		if got != tt.want {
+			t.Errorf("parseTags(%q) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestMigrateWorkspaceTables(t *testing.T) {
+	// A database from before UTM templates and owners were per workspace
+	path := filepath.Join(t.TempDir(), "old.db")
+	old, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = old.Exec(`
+		CREATE TABLE utm_templates (name TEXT PRIMARY KEY, source TEXT NOT NULL, medium TEXT NOT NULL,
+			campaign TEXT NOT NULL, term TEXT NOT NULL DEFAULT '', content TEXT NOT NULL DEFAULT '');
+		CREATE TABLE workspaces (id INTEGER PRIMARY KEY, name TEXT NOT NULL UNIQUE);
+		CREATE TABLE workspace_members (workspace_id INTEGER NOT NULL, user_id INTEGER NOT NULL,
+			PRIMARY KEY (workspace_id, user_id));
+		INSERT INTO utm_templates (name, source, medium, campaign) VALUES ('spring', 'mail', 'email', 'spring');
+		INSERT INTO workspaces (id, name) VALUES (7, 'Marketing');
+		INSERT INTO workspace_members (workspace_id, user_id) VALUES (7, 3), (7, 1)`)
+	old.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldPath := config.DatabasePath
+	config.DatabasePath = path
+	defer func() { config.DatabasePath = oldPath }()
+	db, err := openDatabase()
+	if err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+	defer db.Close()
+
+	for _, workspaceID := range []int64{0, 7} {
+		if template, err := queryUTMTemplate(db, workspaceID, "spring"); err != nil || template.Source != "mail" {
+			t.Errorf("Expected template copied to workspace %d, got %+v, %v", workspaceID, template, err)
+		}
+	}
+	if owner, _ := queryWorkspaceOwner(db, 7, 3); !owner {
+		t.Error("Expected the first member to own the workspace")
+	}
+	if owner, _ := queryWorkspaceOwner(db, 7, 1); owner {
+		t.Error("Expected later members not to own the workspace")
+	}
+}
+
+func TestMigrateDomainCodes(t *testing.T) {
+	// A database from when codes were unique across all domains
+	path := filepath.Join(t.TempDir(), "old.db")
+	old, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = old.Exec(`
+		CREATE TABLE urls (name TEXT NOT NULL, created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			short TEXT NOT NULL UNIQUE, requested_from TEXT NOT NULL, clicks INTEGER DEFAULT 0,
+			domain_id INTEGER NOT NULL DEFAULT 0);
+		CREATE TABLE tags (id INTEGER PRIMARY KEY, name TEXT NOT NULL UNIQUE);
+		CREATE TABLE url_tags (short TEXT NOT NULL, tag_id INTEGER NOT NULL, PRIMARY KEY (short, tag_id));
+		CREATE TABLE clicks (short TEXT NOT NULL, clicked_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			variant TEXT NOT NULL DEFAULT '');
+		CREATE INDEX clicks_short ON clicks (short);
+		INSERT INTO urls (name, short, requested_from, clicks, domain_id) VALUES ('https://team.example.com/', 'abc', '127.0.0.1', 1, 4);
+		INSERT INTO tags (id, name) VALUES (1, 'launch');
+		INSERT INTO url_tags (short, tag_id) VALUES ('abc', 1);
+		INSERT INTO clicks (short) VALUES ('abc')`)
+	old.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldPath := config.DatabasePath
+	config.DatabasePath = path
+	defer func() { config.DatabasePath = oldPath }()
+	db, err := openDatabase()
+	if err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+	defer db.Close()
+
+	link, err := queryShortURL(db, 4, "abc")
+	if err != nil || link.Name != "https://team.example.com/" || link.TagList() != "launch" {
+		t.Errorf("Expected link to keep its domain and tags, got %+v, %v", link, err)
+	}
+	if stats, _ := queryVariantStats(db, 4, "abc"); len(stats) != 1 || stats[0].Clicks != 1 {
+		t.Errorf("Expected clicks to keep their link, got %+v", stats)
+	}
+	if _, err := createURL(db, "https://base.example.com/", "abc", "127.0.0.1"); err != nil {
+		t.Errorf("Expected the code to be free on the base URL, got %v", err)
+	}
+	if _, err := createURL(db, "https://again.example.com/", "abc", "127.0.0.1"); err == nil {
+		t.Error("Expected codes to stay unique on each domain")
+	}
+}
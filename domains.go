@@ -0,0 +1,204 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Domain is an additional short domain served by this deployment. Each
+// domain belongs to a workspace, or to personal links for workspace 0, and
+// has its own codes, so links created there are only served on their domain.
+type Domain struct {
+	ID          int64
+	Host        string
+	BaseURL     string
+	WorkspaceID int64
+	Workspace   string
+	CreatedAt   time.Time
+}
+
+// parseDomainURL checks the base URL of a short domain and returns it without
+// a trailing slash, together with the host requests for it arrive with
+func parseDomainURL(raw string) (string, string, error) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", "", errors.New("domains need an http or https URL such as https://go.example.com")
+	}
+	if strings.Trim(u.Path, "/") != "" || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return "", "", errors.New("domain URLs cannot have a path, query or credentials")
+	}
+	host := strings.ToLower(u.Host)
+	return u.Scheme + "://" + host, host, nil
+}
+
+// ShortURL returns the full short URL of a link on its domain, or on the
+// base URL for links without one
+func (u URL) ShortURL() string {
+	base := config.BaseURL
+	if u.DomainURL != "" {
+		base = u.DomainURL
+	}
+	return strings.TrimSuffix(base, "/") + "/q/" + u.Short
+}
+
+// DomainHost returns the host of the link's short domain, or "" for the base URL
+func (u URL) DomainHost() string {
+	if u.DomainURL == "" {
+		return ""
+	}
+	parsed, err := url.Parse(u.DomainURL)
+	if err != nil {
+		return ""
+	}
+	return parsed.Host
+}
+
+// hostDomain returns the short domain a request arrived on, or 0 for the base
+// URL and every other host. Each domain has its own codes, so a code is
+// looked up together with this domain.
+func hostDomain(db *sql.DB, r *http.Request) (int64, error) {
+	domain, err := queryDomainByHost(db, strings.ToLower(r.Host))
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return domain.ID, err
+}
+
+// pathLink returns the domain and code of the link a page such as
+// /edit/<code> is about. The domain is taken from the domain query parameter,
+// which is left out for links on the base URL.
+func pathLink(r *http.Request, prefix string) (int64, string, error) {
+	short := strings.TrimPrefix(r.URL.Path, prefix)
+	value := r.URL.Query().Get("domain")
+	if value == "" {
+		return 0, short, nil
+	}
+	domainID, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, "", errors.New("invalid domain")
+	}
+	return domainID, short, nil
+}
+
+// linkDomain returns the domain a create request asked for in the domain
+// field, or the first domain of the active workspace if it left the field
+// out. A domain of 0 or "" uses the base URL.
+func linkDomain(db *sql.DB, r *http.Request, workspace Workspace) (Domain, error) {
+	if _, ok := r.Form["domain"]; !ok {
+		domains, err := queryDomains(db, workspace.ID, false)
+		if err != nil || len(domains) == 0 {
+			return Domain{}, err
+		}
+		return domains[0], nil
+	}
+	value := r.FormValue("domain")
+	if value == "" || value == "0" {
+		return Domain{}, nil
+	}
+	id, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return Domain{}, errors.New("invalid domain")
+	}
+	domain, err := queryDomain(db, id)
+	if err != nil || domain.WorkspaceID != workspace.ID {
+		return Domain{}, errors.New("this domain is not available in the current workspace")
+	}
+	return domain, nil
+}
+
+// DomainHandler lets admins add short domains and assign them to workspaces
+type DomainHandler struct {
+	db *sql.DB
+}
+
+// ServeHTTP implements the http.Handler interface
+func (h DomainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		if err := h.update(r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Redirect(w, r, "/domains", http.StatusSeeOther)
+		return
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	domains, err := queryDomains(h.db, 0, true)
+	if err != nil {
+		http.Error(w, "Failed to fetch domains", http.StatusInternalServerError)
+		return
+	}
+	workspaces, err := queryWorkspaces(h.db, 0)
+	if err != nil {
+		http.Error(w, "Failed to fetch workspaces", http.StatusInternalServerError)
+		return
+	}
+
+	page := struct {
+		Title      string
+		BaseURL    string
+		Domains    []Domain
+		Workspaces []Workspace
+		CSRFToken  string
+	}{
+		Title:      "Domains",
+		BaseURL:    config.BaseURL,
+		Domains:    domains,
+		Workspaces: workspaces,
+		CSRFToken:  csrfToken(w, r),
+	}
+
+	tmpl, err := template.ParseFiles("templates/domains.html")
+	if err != nil {
+		http.Error(w, "Failed to load template: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = tmpl.Execute(w, page)
+	if err != nil {
+		http.Error(w, "Failed to execute template: "+err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// update applies a form posted to the domains page
+func (h DomainHandler) update(r *http.Request) error {
+	if r.FormValue("action") == "delete" {
+		id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+		if err != nil {
+			return errors.New("invalid domain")
+		}
+		return deleteDomain(h.db, id)
+	}
+
+	baseURL, host, err := parseDomainURL(r.FormValue("base_url"))
+	if err != nil {
+		return err
+	}
+	if main, _, err := parseDomainURL(config.BaseURL); err == nil && main == baseURL {
+		return errors.New("the base URL is always served")
+	}
+	workspaceID, err := strconv.ParseInt(r.FormValue("workspace_id"), 10, 64)
+	if err != nil {
+		return errors.New("invalid workspace")
+	}
+	if workspaceID != 0 {
+		if _, err := queryWorkspace(h.db, workspaceID); err != nil {
+			return errors.New("unknown workspace")
+		}
+	}
+	_, err = createDomain(h.db, Domain{Host: host, BaseURL: baseURL, WorkspaceID: workspaceID})
+	if err != nil {
+		return errors.New("domain " + host + " already exists")
+	}
+	return nil
+}
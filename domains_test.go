@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestParseDomainURL(t *testing.T) {
+	tests := []struct {
+		raw     string
+		base    string
+		host    string
+		wantErr bool
+	}{
+		{"https://Go.Example.com/", "https://go.example.com", "go.example.com", false},
+		{"http://links.local:8080", "http://links.local:8080", "links.local:8080", false},
+		{"go.example.com", "", "", true},
+		{"ftp://go.example.com", "", "", true},
+		{"https://go.example.com/q", "", "", true},
+		{"https://user@go.example.com", "", "", true},
+	}
+	for _, tt := range tests {
+		base, host, err := parseDomainURL(tt.raw)
+		if (err != nil) != tt.wantErr || base != tt.base || host != tt.host {
+			t.Errorf("parseDomainURL(%q) = %q, %q, %v", tt.raw, base, host, err)
+		}
+	}
+}
+
+func TestDomains(t *testing.T) {
+	db := setupTestDB(t)
+	cache, _ := createCache(10)
+	db.Exec("DELETE FROM domains WHERE host IN ('go.team-a.example', 'go.team-b.example')")
+	db.Exec("DELETE FROM workspaces WHERE name = 'Domain team'")
+	team, err := createWorkspace(db, "Domain team", 0)
+	if err != nil {
+		t.Fatalf("createWorkspace failed: %v", err)
+	}
+	teamA, _ := createDomain(db, Domain{Host: "go.team-a.example", BaseURL: "https://go.team-a.example", WorkspaceID: team.ID})
+	teamB, _ := createDomain(db, Domain{Host: "go.team-b.example", BaseURL: "https://go.team-b.example"})
+	// New personal links would land on this domain in later tests
+	defer deleteDomain(db, teamB.ID)
+
+	// Each domain has its own codes, so the same code can lead elsewhere on
+	// the base URL
+	short := "domain01"
+	deleteURL(db, 0, short)
+	err = insertURL(db, URL{Name: "https://team-a.example.com/", Short: short, RequestedFrom: "127.0.0.1", DomainID: teamA.ID}, "")
+	if err != nil {
+		t.Fatalf("insertURL failed: %v", err)
+	}
+	createURL(db, "https://base.example.com/", short, "127.0.0.1")
+	plain := "domain02"
+	deleteURL(db, 0, plain)
+	createURL(db, "https://plain.example.com/", plain, "127.0.0.1")
+
+	link, _ := queryShortURL(db, teamA.ID, short)
+	if link.ShortURL() != "https://go.team-a.example/q/domain01" {
+		t.Errorf("Expected short URL on the link's domain, got %s", link.ShortURL())
+	}
+
+	handler := QueryHandler{db: db, cache: cache}
+	tests := []struct {
+		host     string
+		short    string
+		want     int
+		location string
+	}{
+		{"go.team-a.example", short, http.StatusMovedPermanently, "https://team-a.example.com/"},
+		{"GO.TEAM-A.EXAMPLE", short, http.StatusMovedPermanently, "https://team-a.example.com/"},
+		{"go.team-b.example", short, http.StatusNotFound, ""},
+		{"localhost:8080", short, http.StatusMovedPermanently, "https://base.example.com/"},
+		{"localhost:8080", plain, http.StatusMovedPermanently, "https://plain.example.com/"},
+		{"go.team-b.example", plain, http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/q/"+tt.short, nil)
+		req.Host = tt.host
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != tt.want || w.Header().Get("Location") != tt.location {
+			t.Errorf("%s on %s: got %d to %q, want %d to %q", tt.short, tt.host, w.Code, w.Header().Get("Location"), tt.want, tt.location)
+		}
+	}
+
+	// New links use the first domain of their workspace unless they pick one
+	domainOf := func(form url.Values, workspace Workspace) (Domain, error) {
+		req := httptest.NewRequest("POST", "/create", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.ParseForm()
+		return linkDomain(db, req, workspace)
+	}
+	if domain, err := domainOf(url.Values{}, team); err != nil || domain.ID != teamA.ID {
+		t.Errorf("Expected the workspace domain by default, got %+v, %v", domain, err)
+	}
+	if domain, err := domainOf(url.Values{"domain": {"0"}}, team); err != nil || domain.ID != 0 {
+		t.Errorf("Expected the base URL for domain 0, got %+v, %v", domain, err)
+	}
+	if _, err := domainOf(url.Values{"domain": {fmt.Sprint(teamB.ID)}}, team); err == nil {
+		t.Error("Expected a domain of another workspace to be refused")
+	}
+
+	// Removing a domain moves its links to the base URL, once their codes are free there
+	if err := deleteDomain(db, teamA.ID); err == nil {
+		t.Error("Expected a domain whose codes are taken on the base URL to stay")
+	}
+	deleteURL(db, 0, short)
+	if err := deleteDomain(db, teamA.ID); err != nil {
+		t.Fatalf("deleteDomain failed: %v", err)
+	}
+	link, _ = queryShortURL(db, 0, short)
+	if link.Name != "https://team-a.example.com/" || link.ShortURL() != config.BaseURL+"/q/"+short {
+		t.Errorf("Expected link to move to the base URL, got %+v", link)
+	}
+}
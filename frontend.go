@@ -2,18 +2,77 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"html/template"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 )
 
 // Page holds the data to be passed to HTML templates
 type Page struct {
-	Title       string
-	URLs        []URL // This should match the type you're using in your DB queries
-	CurrentTime string
+	Title        string
+	URLs         []URL // This should match the type you're using in your DB queries
+	Tags         []string
+	Tag          string
+	Status       string
+	Owner        string
+	User         string
+	Role         string
+	Workspace    Workspace
+	Workspaces   []Workspace
+	Domains      []Domain
+	BaseURL      string
+	UTMTemplates []UTMTemplate
+	CurrentTime  string
+	// CSRFToken is sent back by the forms and HTMX requests of the page
+	CSRFToken string
+}
+
+// urlFilterFromRequest builds a URL filter from the tag, status and owner
+// query parameters, limited to the active workspace. Outside of workspaces
+// only admins can see links of other users, anonymous visitors see the links
+// nobody owns.
+func urlFilterFromRequest(r *http.Request, limit int) URLFilter {
+	query := r.URL.Query()
+	filter := URLFilter{
+		Tag:         query.Get("tag"),
+		Broken:      query.Get("status") == "broken",
+		WorkspaceID: requestAuth(r).workspace.ID,
+		Limit:       limit,
+	}
+	if owner := listOwner(r); owner == "mine" {
+		filter.ByOwner = true
+		filter.OwnerID = requestAuth(r).ownerID()
+	}
+	return filter
+}
+
+// listOwner returns whose links a request lists, "mine" or "all". Workspaces
+// list the links of all members unless asked for owner=mine. Elsewhere,
+// admins signed in as a user see their own links unless they ask for
+// owner=all, and admin API keys see all links unless they ask for owner=mine.
+func listOwner(r *http.Request) string {
+	auth := requestAuth(r)
+	switch owner := r.URL.Query().Get("owner"); {
+	case auth.workspace.ID != 0 && owner == "mine":
+		return owner
+	case auth.workspace.ID != 0:
+		return "all"
+	case !auth.atLeast(roleAdmin):
+		return "mine"
+	case auth.ownerID() == 0:
+		return "all"
+	case owner == "mine" || owner == "all":
+		return owner
+	case auth.user.ID != 0:
+		return "mine"
+	}
+	return "all"
 }
 
 // HomeHandler handles the root path and serves the main page
@@ -25,17 +84,58 @@ type HomeHandler struct {
 // ServeHTTP implements the http.Handler interface
 func (h HomeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Get the 10 most recent URLs from the database
-	urls, err := queryRecentURLs(h.db, 10)
+	filter := urlFilterFromRequest(r, 10)
+	urls, err := queryFilteredURLs(h.db, filter)
 	if err != nil {
 		http.Error(w, "Failed to fetch URLs", http.StatusInternalServerError)
 		return
 	}
 
+	tags, err := queryTags(h.db, filter.WorkspaceID)
+	if err != nil {
+		http.Error(w, "Failed to fetch tags", http.StatusInternalServerError)
+		return
+	}
+
+	auth := requestAuth(r)
+	domains, err := queryDomains(h.db, auth.workspace.ID, false)
+	if err != nil {
+		http.Error(w, "Failed to fetch domains", http.StatusInternalServerError)
+		return
+	}
+
+	var workspaces []Workspace
+	if auth.user.ID != 0 {
+		workspaces, err = queryWorkspaces(h.db, auth.user.ID)
+		if err != nil {
+			http.Error(w, "Failed to fetch workspaces", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	utmTemplates, err := queryUTMTemplates(h.db, auth.workspace.ID)
+	if err != nil {
+		http.Error(w, "Failed to fetch UTM templates", http.StatusInternalServerError)
+		return
+	}
+
 	// Create page data
 	page := Page{
-		Title:       "URL Shortener",
-		URLs:        urls,
-		CurrentTime: time.Now().Format("2006-01-02 15:04:05"),
+		Title:        "URL Shortener",
+		URLs:         auth.withPermissions(urls),
+		Tags:         tags,
+		Tag:          filter.Tag,
+		Status:       r.URL.Query().Get("status"),
+		Owner:        listOwner(r),
+		User:         auth.user.Username,
+		Role:         auth.role(),
+		Workspace:    auth.workspace,
+		Workspaces:   workspaces,
+		Domains:      domains,
+		BaseURL:      config.BaseURL,
+		UTMTemplates: utmTemplates,
+		CurrentTime:  time.Now().Format("2006-01-02 15:04:05"),
+		CSRFToken:    csrfToken(w, r),
 	}
 
 	// Parse and execute the template
@@ -55,6 +155,7 @@ func (h HomeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 type URLFormHandler struct {
 	db    *sql.DB
 	cache *Cache
+	meta  *MetadataFetcher
 }
 
 // ServeHTTP implements the http.Handler interface
@@ -71,55 +172,68 @@ func (h URLFormHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	/*
-		Check if the URL is valid
-	*/
-	_, err := url.ParseRequestURI(originalURL)
+	originalURL, err := normalizeDestination(originalURL)
 	if err != nil {
-		http.Error(w, "Invalid URL format", http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	if len(originalURL) > config.MaxURLLength {
-		http.Error(w, "URL exceeds maximum length", http.StatusBadRequest)
+	originalURL, err = resolveDestination(h.db, originalURL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	if !strings.HasPrefix(originalURL, "http://") && !strings.HasPrefix(originalURL, "https://") {
-		originalURL = "https://" + originalURL
+	auth := requestAuth(r)
+	urlData := URL{
+		Name:          originalURL,
+		CreatedAt:     time.Now(),
+		RequestedFrom: clientIP(r),
+		Clicks:        0,
+		OwnerID:       auth.ownerID(),
+		Owner:         auth.ownerName(),
+		CanEdit:       true,
+		CanPurge:      auth.atLeast(roleAdmin),
 	}
 
-	blockedPatterns := []string{".exe", "javascript:", "data:"}
-	for _, pattern := range blockedPatterns {
-		if strings.Contains(strings.ToLower(originalURL), pattern) {
-			http.Error(w, "URL contains forbidden content", http.StatusBadRequest)
-			return
-		}
+	// Check the whole form before anything is saved
+	if err := readURLForm(r, &urlData); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-
-	// Create short URL
-	shortUrl, err := shorten(originalURL)
+	if err := resolveDestinations(h.db, &urlData); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	applyWorkspaceDefaults(r, &urlData, auth.workspace)
+	domain, err := linkDomain(h.db, r, auth.workspace)
 	if err != nil {
-		http.Error(w, "Failed to generate short URL", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	urlData.DomainID, urlData.DomainURL = domain.ID, domain.BaseURL
 
-	_, err = createURL(h.db, originalURL, shortUrl, r.RemoteAddr)
-	if err != nil {
+	var passwordHash string
+	if password := r.FormValue("password"); password != "" {
+		passwordHash, err = hashPassword(password)
+		if err != nil {
+			http.Error(w, "Failed to save password", http.StatusInternalServerError)
+			return
+		}
+		urlData.Protected = true
+	}
+
+	// Create short URL
+	if err := insertNewURL(h.db, &urlData, passwordHash); err != nil {
 		http.Error(w, "Failed to create short URL", http.StatusInternalServerError)
 		return
 	}
 
 	// Add to cache
-	h.cache.cacheURL(shortUrl, originalURL)
+	h.cache.cacheLink(urlData)
 
-	// Return just the new URL row as HTML for HTMX to insert
-	urlData := URL{
-		Name:          originalURL,
-		CreatedAt:     time.Now(),
-		Short:         shortUrl,
-		RequestedFrom: r.RemoteAddr,
-		Clicks:        0,
+	// Fetch the page title in the background
+	if h.meta != nil {
+		h.meta.Enqueue(urlData)
 	}
 
 	// Parse and execute the partial template
@@ -145,7 +259,7 @@ type RefreshHandler struct {
 // ServeHTTP implements the http.Handler interface
 func (h RefreshHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Get the 10 most recent URLs from the database
-	urls, err := queryRecentURLs(h.db, 10)
+	urls, err := queryFilteredURLs(h.db, urlFilterFromRequest(r, 10))
 	if err != nil {
 		http.Error(w, "Failed to fetch URLs", http.StatusInternalServerError)
 		return
@@ -156,7 +270,7 @@ func (h RefreshHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		URLs        []URL
 		CurrentTime string
 	}{
-		URLs:        urls,
+		URLs:        requestAuth(r).withPermissions(urls),
 		CurrentTime: time.Now().Format("2006-01-02 15:04:05"),
 	}
 
@@ -173,55 +287,596 @@ func (h RefreshHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// normalizeDestination checks that a destination URL is valid, allowed by
+// the destination policy, not listed in a threat feed and not on an internal
+// address, adding https:// when no scheme is given
+func normalizeDestination(destination string) (string, error) {
+	/*
+		Check if the URL is valid
+	*/
+	_, err := url.ParseRequestURI(destination)
+	if err != nil {
+		return "", errors.New("Invalid URL format")
+	}
+
+	if len(destination) > config.MaxURLLength {
+		return "", errors.New("URL exceeds maximum length")
+	}
+
+	if err := destinationPolicy.check(destination); err != nil {
+		return "", err
+	}
+
+	if !strings.HasPrefix(destination, "http://") && !strings.HasPrefix(destination, "https://") {
+		destination = "https://" + destination
+	}
+
+	if err := threatBlocklist.check(destination); err != nil {
+		return "", err
+	}
+
+	if err := checkDestinationHost(destination); err != nil {
+		return "", err
+	}
+	return destination, nil
+}
+
+// readURLForm copies the user editable fields of a URL from a submitted form
+func readURLForm(r *http.Request, url *URL) error {
+	url.Notes = strings.TrimSpace(r.FormValue("notes"))
+	url.Tags = parseTags(r.FormValue("tags"))
+	url.Preview = r.FormValue("preview") != ""
+
+	targets := []struct {
+		field  string
+		target *string
+	}{
+		{"ios_url", &url.IOSURL},
+		{"android_url", &url.AndroidURL},
+		{"desktop_url", &url.DesktopURL},
+	}
+	for _, t := range targets {
+		*t.target = ""
+		value := strings.TrimSpace(r.FormValue(t.field))
+		if value == "" {
+			continue
+		}
+		destination, err := normalizeDestination(value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", t.field, err)
+		}
+		*t.target = destination
+	}
+
+	countryTargets, err := parseCountryTargets(r.FormValue("country_targets"))
+	if err != nil {
+		return err
+	}
+	url.CountryTargets = countryTargets
+
+	variants, err := parseVariants(r.FormValue("variants"))
+	if err != nil {
+		return err
+	}
+	url.Variants = variants
+	url.StickyVariants = r.FormValue("sticky_variants") != ""
+	url.Passthrough = r.FormValue("passthrough") != ""
+	url.UTMTemplate = strings.TrimSpace(r.FormValue("utm_template"))
+
+	notBefore, err := parseNotBefore(r.FormValue("not_before"))
+	if err != nil {
+		return err
+	}
+	url.NotBefore = notBefore
+
+	notAfter, err := parseNotAfter(r.FormValue("not_after"))
+	if err != nil {
+		return err
+	}
+	if !notAfter.IsZero() && !notBefore.IsZero() && !notAfter.After(notBefore) {
+		return errors.New("The expiry time has to be after the activation time")
+	}
+	url.NotAfter = notAfter
+	return nil
+}
+
+// savePasswordForm sets or removes the password of a URL from a submitted
+// form. An empty password field keeps the current password.
+func savePasswordForm(db *sql.DB, r *http.Request, url *URL) error {
+	if r.FormValue("remove_password") != "" {
+		url.Protected = false
+		return updateURLPassword(db, url.DomainID, url.Short, "")
+	}
+	password := r.FormValue("password")
+	if password == "" {
+		return nil
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	url.Protected = true
+	return updateURLPassword(db, url.DomainID, url.Short, hash)
+}
+
+// EditHandler shows and saves the user editable fields of a short URL. Only
+// admins and owners with at least the editor role can change a link.
+type EditHandler struct {
+	db    *sql.DB
+	cache *Cache
+}
+
+// ServeHTTP implements the http.Handler interface
+func (h EditHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var url URL
+	domainID, shortURL, err := pathLink(r, "/edit/")
+	if err == nil {
+		url, err = queryShortURL(h.db, domainID, shortURL)
+	}
+	auth := requestAuth(r)
+	if err != nil || !auth.canView(url) {
+		http.NotFound(w, r)
+		return
+	}
+	if !auth.canModify(url) {
+		http.Error(w, "Your role does not allow changing this link", http.StatusForbidden)
+		return
+	}
+
+	templateName := "url_edit"
+	var data any = url
+	switch r.Method {
+	case "GET":
+		utmTemplates, err := queryUTMTemplates(h.db, url.WorkspaceID)
+		if err != nil {
+			http.Error(w, "Failed to fetch UTM templates", http.StatusInternalServerError)
+			return
+		}
+		data = struct {
+			URL
+			UTMTemplates []UTMTemplate
+		}{url, utmTemplates}
+	case "POST":
+		if err := readURLForm(r, &url); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := resolveDestinations(h.db, &url); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := updateURLDetails(h.db, url); err != nil {
+			http.Error(w, "Failed to save URL details", http.StatusInternalServerError)
+			return
+		}
+		if err := savePasswordForm(h.db, r, &url); err != nil {
+			http.Error(w, "Failed to save password", http.StatusInternalServerError)
+			return
+		}
+		h.cache.forgetLink(domainID, shortURL)
+		templateName = "url_row"
+		data = auth.withPermissions([]URL{url})[0]
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	tmpl, err := template.ParseFiles("templates/url_row.html", "templates/url_edit.html")
+	if err != nil {
+		http.Error(w, "Failed to load template: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = tmpl.ExecuteTemplate(w, templateName, data)
+	if err != nil {
+		http.Error(w, "Failed to execute template: "+err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// ListHandler exports all URLs, including their notes and tags, as JSON
+type ListHandler struct {
+	db *sql.DB
+}
+
+// ServeHTTP implements the http.Handler interface
+func (h ListHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	urls, err := queryFilteredURLs(h.db, urlFilterFromRequest(r, 0))
+	if err != nil {
+		http.Error(w, "Failed to fetch URLs", http.StatusInternalServerError)
+		return
+	}
+	if urls == nil {
+		urls = []URL{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(urls)
+}
+
+// PurgeHandler deletes a short URL together with its clicks, tags, rules and
+// variants. It is only routed for admins.
+type PurgeHandler struct {
+	db    *sql.DB
+	cache *Cache
+}
+
+// ServeHTTP implements the http.Handler interface
+func (h PurgeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	domainID, shortURL, err := pathLink(r, "/purge/")
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if err := deleteURL(h.db, domainID, shortURL); err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to purge URL", http.StatusInternalServerError)
+		return
+	}
+	h.cache.forgetLink(domainID, shortURL)
+
+	// HTMX replaces the row with the empty response
+	w.WriteHeader(http.StatusOK)
+}
+
+// StatsHandler shows the clicks of a short URL, split by the variant served.
+// Like the link list, it is limited to the owner of the link and admins.
+type StatsHandler struct {
+	db *sql.DB
+}
+
+// ServeHTTP implements the http.Handler interface
+func (h StatsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var url URL
+	domainID, shortURL, err := pathLink(r, "/stats/")
+	if err == nil {
+		url, err = queryShortURL(h.db, domainID, shortURL)
+	}
+	if err != nil || !requestAuth(r).canView(url) {
+		http.NotFound(w, r)
+		return
+	}
+
+	stats, err := queryVariantStats(h.db, domainID, shortURL)
+	if err != nil {
+		http.Error(w, "Failed to fetch stats", http.StatusInternalServerError)
+		return
+	}
+
+	type variantRow struct {
+		VariantStats
+		Weight int
+		Share  float64
+	}
+	logged := 0
+	for _, s := range stats {
+		logged += s.Clicks
+	}
+	var rows []variantRow
+	for _, s := range stats {
+		row := variantRow{VariantStats: s, Share: float64(s.Clicks) * 100 / float64(logged)}
+		for _, v := range url.Variants {
+			if v.Target == s.Variant {
+				row.Weight = v.Weight
+			}
+		}
+		rows = append(rows, row)
+	}
+
+	page := struct {
+		Title    string
+		URL      URL
+		Variants []variantRow
+		Logged   int
+	}{
+		Title:    "Stats for " + url.Short,
+		URL:      url,
+		Variants: rows,
+		Logged:   logged,
+	}
+
+	tmpl, err := template.ParseFiles("templates/stats.html")
+	if err != nil {
+		http.Error(w, "Failed to load template: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = tmpl.Execute(w, page)
+	if err != nil {
+		http.Error(w, "Failed to execute template: "+err.Error(), http.StatusInternalServerError)
+	}
+}
+
 // StaticFileHandler serves static files (CSS, JS, etc.)
 func StaticFileHandler() http.Handler {
 	return http.StripPrefix("/static/", http.FileServer(http.Dir("static")))
 }
 
+// QueryHandler redirects short URLs to their destination
 type QueryHandler struct {
 	db    *sql.DB
 	cache *Cache
+	geo   CountryLocator
 }
 
+// ServeHTTP implements the http.Handler interface. Appending "+" to the short
+// URL shows the preview page instead of redirecting. Password protected links
+// show a password form, which is submitted back to the same path. Links with
+// an activation time in the future show the "coming soon" page.
 func (qh QueryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.Method == "GET" {
-		// Extract short URL from path
-		shortURL := strings.TrimPrefix(r.URL.Path, "/q/")
-		if shortURL != "" {
-			url, err := qh.cache.getURL(shortURL)
+	if r.Method != "GET" && r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Extract short URL and any extra path
+	shortURL, extraPath, forcePreview := splitQueryPath(strings.TrimPrefix(r.URL.Path, "/q/"))
+	if shortURL == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Every domain has its own codes
+	domainID, err := hostDomain(qh.db, r)
+	if err != nil {
+		http.Error(w, "Failed to look up the domain", http.StatusInternalServerError)
+		return
+	}
+	link, err := qh.cache.getLink(domainID, shortURL)
+	if err != nil {
+		link, err = queryShortURL(qh.db, domainID, shortURL)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		// Cache the link after successfully retrieving it
+		qh.cache.cacheLink(link)
+	}
+
+	// Destinations can be listed after the last blocklist refresh
+	if !link.Blocked() {
+		if reason := threatBlocklist.listedReason(link); reason != "" {
+			updateURLBlocked(qh.db, link.DomainID, link.Short, reason)
+			qh.cache.forgetLink(link.DomainID, link.Short)
+			link.BlockedReason = reason
+		}
+	}
+	if link.Blocked() {
+		renderBlocked(w)
+		return
+	}
+
+	now := time.Now()
+	if link.expiredAt(now) {
+		renderExpired(w)
+		return
+	}
+	if !link.Active(now) {
+		renderComingSoon(w, link)
+		return
+	}
+
+	passthrough := link.Passthrough || config.Passthrough
+	if extraPath != "" && !passthrough {
+		http.NotFound(w, r)
+		return
+	}
+
+	status := http.StatusMovedPermanently
+	if link.Protected {
+		if !qh.checkPassword(w, r, link) {
+			return
+		}
+		status = http.StatusSeeOther
+	} else if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	destination, variant := qh.chooseDestination(w, r, link)
+	if passthrough {
+		destination, err = applyPassthrough(destination, extraPath, r.URL.Query())
+		if err != nil {
+			http.Error(w, "Invalid destination", http.StatusInternalServerError)
+			return
+		}
+	}
+	if link.UTMTemplate != "" {
+		// Links keep working without parameters if their template was deleted
+		if t, err := queryUTMTemplate(qh.db, link.WorkspaceID, link.UTMTemplate); err == nil {
+			destination, err = applyUTM(destination, t)
 			if err != nil {
-				url, err := queryShortURL(qh.db, shortURL)
-				if err != nil {
-					http.NotFound(w, r)
-					return
-				}
-				qh.cache.cacheURL(shortURL, url.Name)
+				http.Error(w, "Invalid destination", http.StatusInternalServerError)
+				return
 			}
-			// Cache the URL after successfully retrieving it
-			qh.cache.cacheURL(shortURL, url)
-			// Redirect to long URL for all HTTP methods
-			addClicks(qh.db, shortURL)
-			http.Redirect(w, r, url, http.StatusMovedPermanently)
-			return
-		} else {
-			http.NotFound(w, r)
+		}
+	}
+	if passthrough {
+		// The visitor chose the path and query, which the checks at creation never saw
+		if err := checkPassthroughDestination(destination); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
 			return
 		}
 	}
-	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	if status == http.StatusMovedPermanently && (link.hasTargeting() || !link.NotAfter.IsZero()) {
+		// Browsers cache permanent redirects, which would pin visitors to one
+		// destination or keep redirecting them after the link expired
+		status = http.StatusFound
+	}
+
+	logClick(qh.db, link.DomainID, link.Short, variant, clientIP(r))
+	if forcePreview || link.Preview || config.PreviewLinks {
+		renderPreview(w, link, destination)
+		return
+	}
+	// Browsers would otherwise keep a permanent redirect forever and never
+	// learn that the link was disabled, changed or expired
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, destination, status)
+}
+
+// chooseDestination picks where to send a visitor and which variant, if any,
+// was served. Platform targets take precedence over country rules, and both
+// over variants, which rotate the default destination. A variant is only
+// picked, and remembered in the sticky cookie, for visitors that no platform
+// target or country rule applies to, so clicks are only logged under variants
+// that were actually served.
+func (qh QueryHandler) chooseDestination(w http.ResponseWriter, r *http.Request, link URL) (string, string) {
+	if link.HasPlatformTargets() {
+		w.Header().Set("Vary", "User-Agent")
+		if target := link.platformTarget(detectPlatform(r.UserAgent())); target != "" {
+			return target, ""
+		}
+	}
+	if target := link.countryTarget(qh.geo, clientIP(r)); target != "" {
+		return target, ""
+	}
+	if len(link.Variants) > 0 {
+		variant := chooseVariant(w, r, link).Target
+		return variant, variant
+	}
+	return link.Name, ""
+}
+
+// checkPassword verifies the password submitted for a protected link. It
+// renders the password form and returns false until the correct password has
+// been posted, limiting the number of failed attempts per client on the link.
+func (qh QueryHandler) checkPassword(w http.ResponseWriter, r *http.Request, link URL) bool {
+	if r.Method != "POST" {
+		renderPasswordForm(w, r, "", http.StatusOK)
+		return false
+	}
+
+	attempt := linkAttemptKey(link.DomainID, link.Short, clientIP(r))
+	if ok, wait := passwordAttempts.allow(attempt); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		renderPasswordForm(w, r, "Too many attempts, please try again later", http.StatusTooManyRequests)
+		return false
+	}
+
+	hash, err := queryURLPasswordHash(qh.db, link.DomainID, link.Short)
+	if err != nil {
+		http.Error(w, "Failed to check password", http.StatusInternalServerError)
+		return false
+	}
+	if ok, err := verifyPassword(r.FormValue("password"), hash); err != nil || !ok {
+		passwordAttempts.fail(attempt)
+		renderPasswordForm(w, r, "Incorrect password", http.StatusUnauthorized)
+		return false
+	}
+	passwordAttempts.reset(attempt)
+	return true
+}
+
+// renderPasswordForm asks for the password of a protected link
+func renderPasswordForm(w http.ResponseWriter, r *http.Request, message string, status int) {
+	tmpl, err := template.ParseFiles("templates/password.html")
+	if err != nil {
+		http.Error(w, "Failed to load template: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	page := struct {
+		Action string
+		Error  string
+	}{
+		Action: r.URL.RequestURI(),
+		Error:  message,
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	err = tmpl.Execute(w, page)
+	if err != nil {
+		http.Error(w, "Failed to execute template: "+err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// renderPreview shows the destination of a link with a button to continue to it
+func renderPreview(w http.ResponseWriter, link URL, destination string) {
+	tmpl, err := template.ParseFiles("templates/preview.html")
+	if err != nil {
+		http.Error(w, "Failed to load template: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	page := struct {
+		URL
+		Destination string
+	}{
+		URL:         link,
+		Destination: destination,
+	}
+
+	err = tmpl.Execute(w, page)
+	if err != nil {
+		http.Error(w, "Failed to execute template: "+err.Error(), http.StatusInternalServerError)
+	}
 }
 
 // SetupRoutes sets up the routes for the web application
-func SetupRoutes(db *sql.DB, cache *Cache) {
+func SetupRoutes(db *sql.DB, cache *Cache, meta *MetadataFetcher, geo CountryLocator, sso *OIDCLogin) {
+	// links wraps a handler so that it knows who is signed in, and requires a
+	// role and API key scope that allow reading or changing links. Changes
+	// from the web interface need the CSRF token.
+	links := func(h http.Handler) http.Handler {
+		return CSRF{next: Auth{db: db, read: scopeLinksRead, write: scopeLinksWrite, next: h}}
+	}
+	// admin wraps a handler that only admins and API keys with the keys:admin scope may use
+	admin := func(h http.Handler) http.Handler {
+		return CSRF{next: Auth{db: db, read: scopeKeysAdmin, write: scopeKeysAdmin, next: h}}
+	}
+
+	// Separate budgets for creating links and for redirects
+	createLimits := newRateLimitStore(config.RateLimitStore, cache)
+	limitCreate := func(h http.Handler) http.Handler {
+		return RateLimiter{store: createLimits, name: "create", limit: config.CreateRateLimit, next: h}
+	}
+	redirectLimits := newRateLimitStore(config.RateLimitStore, cache)
+
 	// Add new handlers for the web frontend
-	http.Handle("/", HomeHandler{db: db, cache: cache})
-	http.Handle("/create", URLFormHandler{db: db, cache: cache})
-	http.Handle("/refresh", RefreshHandler{db: db})
+	http.Handle("/", links(HomeHandler{db: db, cache: cache}))
+	http.Handle("/create", links(limitCreate(URLFormHandler{db: db, cache: cache, meta: meta})))
+	http.Handle("/refresh", links(RefreshHandler{db: db}))
+	http.Handle("/edit/", links(EditHandler{db: db, cache: cache}))
+	http.Handle("/stats/", links(StatsHandler{db: db}))
+	http.Handle("/qr/", links(QRHandler{db: db}))
+	http.Handle("/utm", links(UTMHandler{db: db}))
+	http.Handle("/purge/", admin(PurgeHandler{db: db, cache: cache}))
+	http.Handle("/keys", admin(APIKeyHandler{db: db}))
+	http.Handle("/users", admin(UsersHandler{db: db}))
+	http.Handle("/domains", admin(DomainHandler{db: db}))
+	http.Handle("/policy", admin(PolicyHandler{db: db}))
+	// Viewers may switch workspaces, the handler checks the role for changes
+	http.Handle("/workspaces", CSRF{next: Auth{db: db, read: scopeLinksRead, write: scopeLinksRead, next: WorkspaceHandler{db: db}}})
+	http.Handle("/login", CSRF{next: LoginHandler{db: db}})
+	http.Handle("/logout", CSRF{next: LogoutHandler{db: db}})
+	if sso != nil {
+		http.Handle("/oidc/", sso)
+	}
 	http.Handle("/static/", StaticFileHandler())
 
 	// Add the existing REST API
-	http.Handle("/s/", URLFormHandler{db: db, cache: cache})
-	http.Handle("/q/", QueryHandler{db: db, cache: cache})
+	http.Handle("/s/", links(limitCreate(URLFormHandler{db: db, cache: cache, meta: meta})))
+	http.Handle("/u", links(ListHandler{db: db}))
+	http.Handle("/q/", RateLimiter{store: redirectLimits, name: "redirect", limit: config.RedirectRateLimit,
+		next: QueryHandler{db: db, cache: cache, geo: geo}})
 }
 
 // Serve sets up and starts the server
@@ -229,7 +884,47 @@ func Serve() {
 	db, _ := openDatabase()
 	cache, _ := createCache(1024)
 
-	SetupRoutes(db, cache)
+	if !config.RequireAuth {
+		fmt.Println("Warning: require_auth is off, anyone who can reach the server can create, change and delete links")
+	}
+
+	if err := destinationPolicy.reload(db); err != nil {
+		fmt.Println("Error loading destination policy, using the built-in rules:", err)
+	}
+	reloadPolicyOnSignal(db)
+
+	var meta *MetadataFetcher
+	if config.FetchMetadata {
+		meta = newMetadataFetcher(db)
+		meta.Start()
+	}
+
+	if len(config.BlocklistFiles) > 0 {
+		refresher := &BlocklistRefresher{db: db, cache: cache, files: config.BlocklistFiles,
+			interval: time.Duration(config.BlocklistRefreshInterval) * time.Minute}
+		refresher.Start()
+	}
+
+	if config.LinkCheckInterval > 0 {
+		newLinkChecker(db, time.Duration(config.LinkCheckInterval)*time.Minute).Start()
+	}
+
+	var geo CountryLocator
+	if config.GeoIPDatabase != "" {
+		locator, err := openCountryLocator(config.GeoIPDatabase)
+		if err != nil {
+			fmt.Println("Error opening GeoIP database, country rules are disabled:", err)
+		} else {
+			geo = locator
+		}
+	}
+
+	var sso *OIDCLogin
+	if config.OIDCIssuer != "" {
+		sso = newOIDCLogin(db, config)
+	}
+
+	SetupRoutes(db, cache, meta, geo, sso)
 
 	println("Server started on http://localhost:8080")
 	err := http.ListenAndServe(":8080", nil)
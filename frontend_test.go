@@ -2,6 +2,7 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -92,6 +93,97 @@ func TestURLFormHandler(t *testing.T) {
 	}
 }
 
+func TestURLFormHandlerRejectsWholeForm(t *testing.T) {
+	db := setupTestDB(t)
+	cache, _ := createCache(10)
+	handler := URLFormHandler{db: db, cache: cache}
+
+	destination := "https://example.com/rejected-form"
+	purgeLinksTo(db, destination)
+
+	// Every field is checked before the link is stored
+	for _, form := range []url.Values{
+		{"url": {destination}, "variants": {"heavy https://example.com/a"}},
+		{"url": {destination}, "ios_url": {"javascript:alert(1)"}},
+		{"url": {destination}, "domain": {"999999"}},
+		{"url": {destination}, "not_before": {"2030-05-08T09:30"}, "not_after": {"2030-05-01T09:30"}},
+	} {
+		req := httptest.NewRequest("POST", "/create", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status code %d for %v, got %d", http.StatusBadRequest, form, w.Code)
+		}
+		if _, err := linkTo(db, destination); err != sql.ErrNoRows {
+			t.Fatalf("Expected rejected form %v to save nothing, got %v", form, err)
+		}
+	}
+}
+
+func TestURLFormHandlerRandomCodes(t *testing.T) {
+	db := setupTestDB(t)
+	cache, _ := createCache(10)
+	handler := URLFormHandler{db: db, cache: cache}
+
+	// Shortening a URL again, from any workspace, never runs into the
+	// existing link
+	destination := "https://example.com/shared-destination"
+	purgeLinksTo(db, destination)
+	defer purgeLinksTo(db, destination)
+	for i := 0; i < 2; i++ {
+		form := url.Values{"url": {destination}}
+		req := httptest.NewRequest("POST", "/create", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected link %d to be created, got %d: %s", i+1, w.Code, w.Body.String())
+		}
+	}
+	var codes []string
+	links, _ := queryURLs(db)
+	for _, link := range links {
+		if link.Name == destination {
+			codes = append(codes, link.Short)
+		}
+	}
+	if len(codes) != 2 || codes[0] == codes[1] {
+		t.Fatalf("Expected two links with their own codes, got %v", codes)
+	}
+
+	// A taken code is drawn again
+	err := insertURL(db, URL{Name: destination, Short: codes[0], RequestedFrom: "127.0.0.1"}, "")
+	if !isUniqueViolation(err) {
+		t.Errorf("Expected a taken code to be reported as such, got %v", err)
+	}
+}
+
+// linkTo returns the newest link to a destination, whose code is random
+func linkTo(db *sql.DB, destination string) (URL, error) {
+	links, err := queryURLs(db)
+	if err != nil {
+		return URL{}, err
+	}
+	for _, link := range links {
+		if link.Name == destination {
+			return link, nil
+		}
+	}
+	return URL{}, sql.ErrNoRows
+}
+
+// purgeLinksTo deletes every link to a destination left by earlier runs
+func purgeLinksTo(db *sql.DB, destination string) {
+	links, _ := queryURLs(db)
+	for _, link := range links {
+		if link.Name == destination {
+			deleteURL(db, link.DomainID, link.Short)
+		}
+	}
+}
+
 func TestRefreshHandler(t *testing.T) {
 	db := setupTestDB(t)
 	handler := RefreshHandler{db: db}
@@ -158,6 +250,7 @@ func TestSetupRoutes(t *testing.T) {
 	}{
 		{"/", "GET", "", http.StatusOK},
 		{"/create", "POST", "url=https://example.com", http.StatusOK},
+		{"/create", "POST", "url=https://example.com", http.StatusOK},
 		{"/refresh", "GET", "", http.StatusOK},
 		{"/static/style.css", "GET", "", http.StatusOK},
 		{"/s", "POST", "url=https://example.com", http.StatusMovedPermanently},
@@ -179,3 +272,266 @@ func TestSetupRoutes(t *testing.T) {
 		})
 	}
 }
+
+func TestEditHandler(t *testing.T) {
+	db := setupTestDB(t)
+	cache, _ := createCache(10)
+	handler := EditHandler{db: db, cache: cache}
+
+	short := "editme01"
+	createURL(db, "https://edit.example.com", short, "127.0.0.1")
+
+	req := httptest.NewRequest("GET", "/edit/"+short, nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	if !strings.Contains(w.Body.String(), `name="tags"`) {
+		t.Error("Edit form should contain a tags input")
+	}
+
+	form := url.Values{}
+	form.Add("tags", "docs, Launch")
+	form.Add("notes", "Owned by the docs team")
+	req = httptest.NewRequest("POST", "/edit/"+short, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, "launch") || !strings.Contains(body, "Owned by the docs team") {
+		t.Errorf("Updated row should show the new tags and notes, got %s", body)
+	}
+
+	req = httptest.NewRequest("GET", "/edit/doesnotexist", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d, got %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestListHandler(t *testing.T) {
+	db := setupTestDB(t)
+	handler := ListHandler{db: db}
+
+	short := "export01"
+	createURL(db, "https://export.example.com", short, "127.0.0.1")
+	updateURLDetails(db, URL{Short: short, Notes: "exported", Tags: []string{"exporttest"}})
+
+	req := httptest.NewRequest("GET", "/u?tag=exporttest", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+
+	var urls []URL
+	if err := json.NewDecoder(w.Body).Decode(&urls); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(urls) == 0 {
+		t.Fatal("Expected at least one URL tagged exporttest")
+	}
+	for _, u := range urls {
+		if u.TagList() != "exporttest" {
+			t.Errorf("Unexpected tags %v on exported URL %s", u.Tags, u.Short)
+		}
+	}
+}
+
+func TestQueryHandlerPreview(t *testing.T) {
+	db := setupTestDB(t)
+	cache, _ := createCache(10)
+	handler := QueryHandler{db: db, cache: cache}
+
+	createURL(db, "https://preview.example.com/page", "preview1", "127.0.0.1")
+	createURL(db, "https://always.example.com/page", "preview2", "127.0.0.1")
+	updateURLDetails(db, URL{Short: "preview2", Preview: true})
+
+	tests := []struct {
+		name         string
+		path         string
+		wantStatus   int
+		wantLocation string
+	}{
+		{"Redirect", "/q/preview1", http.StatusMovedPermanently, "https://preview.example.com/page"},
+		{"Forced preview", "/q/preview1+", http.StatusOK, ""},
+		{"Link preview", "/q/preview2", http.StatusOK, ""},
+		{"Missing", "/q/missing+", http.StatusNotFound, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.path, nil)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("Expected status code %d, got %d", tt.wantStatus, w.Code)
+			}
+			if tt.wantLocation != "" && w.Header().Get("Location") != tt.wantLocation {
+				t.Errorf("Expected redirect to %s, got %s", tt.wantLocation, w.Header().Get("Location"))
+			}
+			if w.Code == http.StatusOK && !strings.Contains(w.Body.String(), "Continue") {
+				t.Error("Preview page should contain a continue button")
+			}
+		})
+	}
+}
+
+func TestQueryHandlerPassword(t *testing.T) {
+	db := setupTestDB(t)
+	cache, _ := createCache(10)
+	handler := QueryHandler{db: db, cache: cache}
+
+	short := "secret01"
+	createURL(db, "https://docs.example.com/internal", short, "127.0.0.1")
+	hash, _ := hashPassword("letmein")
+	updateURLPassword(db, 0, short, hash)
+
+	post := func(password string, remoteAddr string) *httptest.ResponseRecorder {
+		form := url.Values{}
+		form.Add("password", password)
+		req := httptest.NewRequest("POST", "/q/"+short, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	req := httptest.NewRequest("GET", "/q/"+short, nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `type="password"`) {
+		t.Fatalf("Expected password form, got %d", w.Code)
+	}
+
+	if w := post("wrong", "192.0.2.10:1234"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status code %d for a wrong password, got %d", http.StatusUnauthorized, w.Code)
+	}
+
+	w = post("letmein", "192.0.2.10:1234")
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("Expected status code %d for the right password, got %d", http.StatusSeeOther, w.Code)
+	}
+	if w.Header().Get("Location") != "https://docs.example.com/internal" {
+		t.Errorf("Unexpected redirect to %s", w.Header().Get("Location"))
+	}
+
+	// Clients are locked out after too many failures, even with the right password
+	for i := 0; i < 5; i++ {
+		post("guess", "192.0.2.20:1234")
+	}
+	w = post("letmein", "192.0.2.20:1234")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected status code %d with Retry-After, got %d", http.StatusTooManyRequests, w.Code)
+	}
+}
+
+func TestQueryHandlerPlatformTargets(t *testing.T) {
+	db := setupTestDB(t)
+	cache, _ := createCache(10)
+	edit := EditHandler{db: db, cache: cache}
+	handler := QueryHandler{db: db, cache: cache}
+
+	short := "platfor1"
+	createURL(db, "https://example.com/app", short, "127.0.0.1")
+
+	form := url.Values{}
+	form.Add("ios_url", "https://apps.apple.com/app/example")
+	form.Add("android_url", "https://play.google.com/store/apps/details?id=com.example")
+	req := httptest.NewRequest("POST", "/edit/"+short, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	edit.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+
+	tests := []struct {
+		userAgent string
+		want      string
+	}{
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X)", "https://apps.apple.com/app/example"},
+		{"Mozilla/5.0 (Linux; Android 14; Pixel 8) Mobile", "https://play.google.com/store/apps/details?id=com.example"},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64)", "https://example.com/app"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/q/"+short, nil)
+		req.Header.Set("User-Agent", tt.userAgent)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Header().Get("Location") != tt.want {
+			t.Errorf("Expected redirect to %s for %q, got %s", tt.want, tt.userAgent, w.Header().Get("Location"))
+		}
+	}
+
+	form.Set("ios_url", "javascript:alert(1)")
+	req = httptest.NewRequest("POST", "/edit/"+short, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	edit.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d for an invalid platform URL, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestStatsHandlerVariants(t *testing.T) {
+	db := setupTestDB(t)
+	cache, _ := createCache(10)
+	query := QueryHandler{db: db, cache: cache}
+	handler := StatsHandler{db: db}
+
+	short := "abtest01"
+	createURL(db, "https://example.com/landing", short, "127.0.0.1")
+	db.Exec("DELETE FROM clicks WHERE short = ?", short)
+	updateURLDetails(db, URL{Short: short, Variants: []Variant{
+		{"https://example.com/landing-a", 1},
+		{"https://example.com/landing-b", 1},
+	}})
+
+	served := make(map[string]int)
+	for i := 0; i < 20; i++ {
+		req := httptest.NewRequest("GET", "/q/"+short, nil)
+		w := httptest.NewRecorder()
+		query.ServeHTTP(w, req)
+		if w.Code != http.StatusFound {
+			t.Fatalf("Expected temporary redirect for a link with variants, got %d", w.Code)
+		}
+		served[w.Header().Get("Location")]++
+	}
+
+	stats, err := queryVariantStats(db, 0, short)
+	if err != nil {
+		t.Fatalf("Failed to query variant stats: %v", err)
+	}
+	for _, s := range stats {
+		if s.Clicks != served[s.Variant] {
+			t.Errorf("Expected %d logged clicks for %s, got %d", served[s.Variant], s.Variant, s.Clicks)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/stats/"+short, nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "https://example.com/landing-a") {
+		t.Error("Stats page should list the variants")
+	}
+
+	req = httptest.NewRequest("GET", "/stats/missing", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d, got %d", http.StatusNotFound, w.Code)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// CountryLocator looks up the ISO country code of an IP address
+type CountryLocator interface {
+	Country(ip net.IP) (string, error)
+}
+
+// mmdbLocator reads countries from a local MaxMind (GeoLite2 / GeoIP2) database
+type mmdbLocator struct {
+	reader *maxminddb.Reader
+}
+
+var errCountryNotFound = errors.New("country not found")
+
+// openCountryLocator opens a .mmdb file such as GeoLite2-Country.mmdb
+func openCountryLocator(path string) (CountryLocator, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &mmdbLocator{reader: reader}, nil
+}
+
+// Country implements CountryLocator
+func (l *mmdbLocator) Country(ip net.IP) (string, error) {
+	if ip == nil {
+		return "", errCountryNotFound
+	}
+	var record struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+	}
+	if err := l.reader.Lookup(ip, &record); err != nil {
+		return "", err
+	}
+	if record.Country.ISOCode == "" {
+		return "", errCountryNotFound
+	}
+	return record.Country.ISOCode, nil
+}
+
+// countryTarget returns the destination for a visitor's country, or an empty
+// string when there is no rule for it or the lookup fails
+func (u URL) countryTarget(locator CountryLocator, ip string) string {
+	if locator == nil || len(u.CountryTargets) == 0 {
+		return ""
+	}
+	country, err := locator.Country(net.ParseIP(ip))
+	if err != nil {
+		return ""
+	}
+	return u.CountryTargets[strings.ToUpper(country)]
+}
+
+// CountryTargetList returns the country rules as "CC destination" lines
+func (u URL) CountryTargetList() string {
+	countries := make([]string, 0, len(u.CountryTargets))
+	for country := range u.CountryTargets {
+		countries = append(countries, country)
+	}
+	sort.Strings(countries)
+	var lines []string
+	for _, country := range countries {
+		lines = append(lines, country+" "+u.CountryTargets[country])
+	}
+	return strings.Join(lines, "\n")
+}
+
+// parseCountryTargets reads "CC destination" lines into a map of country
+// codes to normalized destinations
+func parseCountryTargets(s string) (map[string]string, error) {
+	targets := make(map[string]string)
+	for _, line := range strings.Split(s, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 || len(fields[0]) != 2 {
+			return nil, fmt.Errorf("invalid country rule %q, expected a country code and a URL", strings.TrimSpace(line))
+		}
+		destination, err := normalizeDestination(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", fields[0], err)
+		}
+		targets[strings.ToUpper(fields[0])] = destination
+	}
+	return targets, nil
+}
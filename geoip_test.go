@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// stubLocator maps IP addresses to countries without a database
+type stubLocator map[string]string
+
+func (l stubLocator) Country(ip net.IP) (string, error) {
+	if country, ok := l[ip.String()]; ok {
+		return country, nil
+	}
+	return "", errors.New("not found")
+}
+
+func TestCountryTarget(t *testing.T) {
+	locator := stubLocator{"192.0.2.1": "DE", "192.0.2.2": "fr", "192.0.2.3": "US"}
+	url := URL{
+		Name:           "https://example.com",
+		CountryTargets: map[string]string{"DE": "https://example.de", "FR": "https://example.fr"},
+	}
+
+	tests := []struct {
+		name    string
+		locator CountryLocator
+		ip      string
+		want    string
+	}{
+		{"Germany", locator, "192.0.2.1", "https://example.de"},
+		{"Lowercase code", locator, "192.0.2.2", "https://example.fr"},
+		{"No rule", locator, "192.0.2.3", ""},
+		{"Lookup fails", locator, "192.0.2.99", ""},
+		{"Invalid IP", locator, "not-an-ip", ""},
+		{"No database", nil, "192.0.2.1", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := url.countryTarget(tt.locator, tt.ip); got != tt.want {
+				t.Errorf("countryTarget() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCountryTargets(t *testing.T) {
+	targets, err := parseCountryTargets("de https://example.de\n\n  FR   https://example.fr/path  \n")
+	if err != nil {
+		t.Fatalf("Failed to parse country targets: %v", err)
+	}
+	if len(targets) != 2 || targets["DE"] != "https://example.de" || targets["FR"] != "https://example.fr/path" {
+		t.Errorf("Unexpected country targets %v", targets)
+	}
+	if got := (URL{CountryTargets: targets}).CountryTargetList(); got != "DE https://example.de\nFR https://example.fr/path" {
+		t.Errorf("Unexpected country target list %q", got)
+	}
+
+	invalid := []string{
+		"https://example.de",
+		"DEU https://example.de",
+		"DE https://example.de extra",
+		"DE javascript:alert(1)",
+	}
+	for _, input := range invalid {
+		if _, err := parseCountryTargets(input); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestOpenCountryLocator(t *testing.T) {
+	if _, err := openCountryLocator("does-not-exist.mmdb"); err == nil {
+		t.Error("Expected error for a missing database")
+	}
+}
+
+func TestQueryHandlerCountryTargets(t *testing.T) {
+	db := setupTestDB(t)
+	cache, _ := createCache(10)
+	handler := QueryHandler{db: db, cache: cache, geo: stubLocator{"192.0.2.1": "DE"}}
+
+	short := "country1"
+	createURL(db, "https://example.com", short, "127.0.0.1")
+	updateURLDetails(db, URL{Short: short, CountryTargets: map[string]string{"DE": "https://example.de"}})
+
+	tests := []struct {
+		remoteAddr string
+		want       string
+	}{
+		{"192.0.2.1:4321", "https://example.de"},
+		{"192.0.2.50:4321", "https://example.com"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/q/"+short, nil)
+		req.RemoteAddr = tt.remoteAddr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusFound || w.Header().Get("Location") != tt.want {
+			t.Errorf("Expected redirect to %s from %s, got %d %s", tt.want, tt.remoteAddr, w.Code, w.Header().Get("Location"))
+		}
+	}
+}
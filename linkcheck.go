@@ -0,0 +1,128 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LinkChecker periodically requests every destination and records whether it still works
+type LinkChecker struct {
+	db        *sql.DB
+	client    *http.Client
+	interval  time.Duration
+	hostDelay time.Duration
+
+	mu          sync.Mutex
+	nextRequest map[string]time.Time
+}
+
+// CheckResult is the outcome of checking a single destination
+type CheckResult struct {
+	Status    int
+	FinalURL  string
+	CheckedAt time.Time
+}
+
+const linkCheckHostDelay = time.Second
+
+// newLinkChecker creates a checker that runs every interval and waits at
+// least a second between requests to the same host
+func newLinkChecker(db *sql.DB, interval time.Duration) *LinkChecker {
+	return &LinkChecker{
+		db:          db,
+		client:      newOutboundClient(rejectInternalIP),
+		interval:    interval,
+		hostDelay:   linkCheckHostDelay,
+		nextRequest: make(map[string]time.Time),
+	}
+}
+
+// Start checks all links right away and then once per interval in the
+// background
+func (c *LinkChecker) Start() {
+	go func() {
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+		for {
+			if err := c.checkAll(); err != nil && config.EnableLogging {
+				fmt.Println("Link check failed:", err)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+// checkAll checks every stored link and saves the results
+func (c *LinkChecker) checkAll() error {
+	urls, err := queryURLs(c.db)
+	if err != nil {
+		return err
+	}
+	return c.checkURLs(urls)
+}
+
+// checkURLs checks the given links and saves the results
+func (c *LinkChecker) checkURLs(urls []URL) error {
+	for _, url := range urls {
+		result := c.check(url.Name)
+		if err := updateURLCheck(c.db, url.DomainID, url.Short, result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// check requests a destination with HEAD, falling back to GET for servers
+// that do not support it. A status of 0 means the request failed entirely.
+func (c *LinkChecker) check(rawURL string) CheckResult {
+	result := CheckResult{CheckedAt: time.Now()}
+	if u, err := url.Parse(rawURL); err == nil {
+		c.wait(strings.ToLower(u.Hostname()))
+	}
+
+	resp, err := c.request("HEAD", rawURL)
+	if err == nil && (resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented) {
+		resp, err = c.request("GET", rawURL)
+	}
+	if err != nil {
+		return result
+	}
+	result.Status = resp.StatusCode
+	result.FinalURL = resp.Request.URL.String()
+	return result
+}
+
+func (c *LinkChecker) request(method string, rawURL string) (*http.Response, error) {
+	req, err := http.NewRequest(method, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "url_shortener link checker")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, metadataMaxBytes))
+	resp.Body.Close()
+	return resp, nil
+}
+
+// wait blocks until the per-host delay since the previous request has passed
+func (c *LinkChecker) wait(host string) {
+	c.mu.Lock()
+	now := time.Now()
+	next := c.nextRequest[host]
+	if next.Before(now) {
+		next = now
+	}
+	c.nextRequest[host] = next.Add(c.hostDelay)
+	c.mu.Unlock()
+
+	time.Sleep(time.Until(next))
+}
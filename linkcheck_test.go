@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestLinkChecker(t *testing.T) *LinkChecker {
+	checker := newLinkChecker(setupTestDB(t), time.Hour)
+	// httptest servers listen on loopback, which the default client refuses
+	checker.client = newOutboundClient(func(net.IP) error { return nil })
+	checker.hostDelay = 0
+	return checker
+}
+
+func TestLinkCheckerCheck(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ok":
+			w.WriteHeader(http.StatusOK)
+		case "/moved":
+			http.Redirect(w, r, "/ok", http.StatusMovedPermanently)
+		case "/no-head":
+			if r.Method == "HEAD" {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	checker := newTestLinkChecker(t)
+
+	tests := []struct {
+		path       string
+		wantStatus int
+		wantFinal  string
+	}{
+		{"/ok", http.StatusOK, server.URL + "/ok"},
+		{"/moved", http.StatusOK, server.URL + "/ok"},
+		{"/no-head", http.StatusOK, server.URL + "/no-head"},
+		{"/gone", http.StatusNotFound, server.URL + "/gone"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			result := checker.check(server.URL + tt.path)
+			if result.Status != tt.wantStatus {
+				t.Errorf("Expected status %d, got %d", tt.wantStatus, result.Status)
+			}
+			if result.FinalURL != tt.wantFinal {
+				t.Errorf("Expected final URL %s, got %s", tt.wantFinal, result.FinalURL)
+			}
+		})
+	}
+
+	// Unreachable destinations are recorded with a status of 0
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	result := checker.check(closed.URL)
+	if result.Status != 0 || result.CheckedAt.IsZero() {
+		t.Errorf("Expected failed check with status 0, got %+v", result)
+	}
+}
+
+func TestLinkCheckerCheckURLs(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/dead" {
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	checker := newTestLinkChecker(t)
+	createURL(checker.db, server.URL+"/alive", "check001", "127.0.0.1")
+	createURL(checker.db, server.URL+"/dead", "check002", "127.0.0.1")
+
+	urls := []URL{
+		{Name: server.URL + "/alive", Short: "check001"},
+		{Name: server.URL + "/dead", Short: "check002"},
+	}
+	if err := checker.checkURLs(urls); err != nil {
+		t.Fatalf("checkURLs failed: %v", err)
+	}
+
+	alive, _ := queryShortURL(checker.db, 0, "check001")
+	if alive.Broken() || alive.CheckStatus != http.StatusOK {
+		t.Errorf("Expected alive link to be healthy, got status %d", alive.CheckStatus)
+	}
+
+	dead, _ := queryShortURL(checker.db, 0, "check002")
+	if !dead.Broken() || dead.CheckedAt.IsZero() {
+		t.Errorf("Expected dead link to be broken, got status %d", dead.CheckStatus)
+	}
+
+	broken, err := queryFilteredURLs(checker.db, URLFilter{Broken: true})
+	if err != nil {
+		t.Fatalf("Failed to filter broken URLs: %v", err)
+	}
+	found := false
+	for _, url := range broken {
+		if url.Short == "check001" {
+			t.Error("Healthy link should not be listed as broken")
+		}
+		if url.Short == "check002" {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("Broken link should be listed by the broken filter")
+	}
+}
+
+func TestLinkCheckerHostDelay(t *testing.T) {
+	checker := newTestLinkChecker(t)
+	checker.hostDelay = 50 * time.Millisecond
+
+	start := time.Now()
+	checker.wait("example.com")
+	checker.wait("example.org")
+	if elapsed := time.Since(start); elapsed >= checker.hostDelay {
+		t.Errorf("Requests to different hosts should not wait, took %v", elapsed)
+	}
+
+	checker.wait("example.com")
+	if elapsed := time.Since(start); elapsed < checker.hostDelay {
+		t.Errorf("Second request to the same host should wait %v, took %v", checker.hostDelay, elapsed)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// defaultKnownShorteners are public URL shorteners that
+// Settings.ResolveShorteners follows
+var defaultKnownShorteners = []string{
+	"bit.ly", "bitly.com", "buff.ly", "cutt.ly", "goo.gl", "is.gd", "ow.ly", "rb.gy",
+	"rebrand.ly", "s.id", "shorturl.at", "t.co", "t.ly", "tiny.cc", "tinyurl.com", "v.gd",
+}
+
+var errServiceLoop = errors.New("Destination points back to this service")
+
+// shortenerClient follows shortened destinations one hop at a time
+var shortenerClient = newShortenerClient()
+
+func newShortenerClient() *http.Client {
+	client := newOutboundClient(rejectInternalIP)
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	return client
+}
+
+// hostKey returns the host of a URL in lower case without its default port,
+// so that http://Example.com:80 and http://example.com compare equal
+func hostKey(u *url.URL) string {
+	host := strings.ToLower(u.Host)
+	if (u.Scheme == "http" && strings.HasSuffix(host, ":80")) || (u.Scheme == "https" && strings.HasSuffix(host, ":443")) {
+		host = host[:strings.LastIndex(host, ":")]
+	}
+	return strings.TrimSuffix(host, ".")
+}
+
+// servedByService reports whether a URL is on the base URL or one of the
+// custom short domains of this deployment
+func servedByService(db *sql.DB, u *url.URL) bool {
+	host := hostKey(u)
+	if base, err := url.Parse(config.BaseURL); err == nil && host == hostKey(base) {
+		return true
+	}
+	_, err := queryDomainByHost(db, host)
+	return err == nil
+}
+
+// knownShortener reports whether a URL is on one of Settings.KnownShorteners
+// or a subdomain of one
+func knownShortener(u *url.URL) bool {
+	host := strings.ToLower(u.Hostname())
+	for _, shortener := range config.KnownShorteners {
+		shortener = strings.ToLower(strings.TrimSpace(shortener))
+		if shortener != "" && (host == shortener || strings.HasSuffix(host, "."+shortener)) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveDestination rejects destinations that point back to this service,
+// which would let links redirect to each other forever. With
+// Settings.ResolveShorteners, destinations on known shorteners are followed
+// until they leave them, and the URL they lead to is returned instead.
+func resolveDestination(db *sql.DB, destination string) (string, error) {
+	u, err := url.Parse(destination)
+	if err != nil {
+		return "", errors.New("Invalid URL format")
+	}
+	if servedByService(db, u) {
+		return "", errServiceLoop
+	}
+	if !config.ResolveShorteners || !knownShortener(u) {
+		return destination, nil
+	}
+
+	for hop := 0; hop < config.ShortenerHops; hop++ {
+		next, err := followShortener(u)
+		if err != nil {
+			return "", fmt.Errorf("Could not follow the shortened URL %s: %v", destination, err)
+		}
+		if servedByService(db, next) {
+			return "", errServiceLoop
+		}
+		if !knownShortener(next) {
+			// The final URL has to pass the same checks as one entered directly
+			return normalizeDestination(next.String())
+		}
+		u = next
+	}
+	return "", fmt.Errorf("Shortened URL %s redirects through more than %d shorteners", destination, config.ShortenerHops)
+}
+
+// followShortener returns where a shortened URL redirects to. It asks with
+// HEAD, falling back to GET for shorteners that do not support it.
+func followShortener(u *url.URL) (*url.URL, error) {
+	resp, err := shortenerRequest("HEAD", u)
+	if err == nil && (resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented) {
+		resp, err = shortenerRequest("GET", u)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	location := resp.Header.Get("Location")
+	if resp.StatusCode < 300 || resp.StatusCode >= 400 || location == "" {
+		return nil, fmt.Errorf("expected a redirect, got status %d", resp.StatusCode)
+	}
+	next, err := u.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	if next.Scheme != "http" && next.Scheme != "https" {
+		return nil, errors.New("unsupported redirect scheme")
+	}
+	return next, nil
+}
+
+func shortenerRequest(method string, u *url.URL) (*http.Response, error) {
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "url_shortener link resolver")
+	resp, err := shortenerClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+// resolveDestinations applies resolveDestination to the platform, country
+// and variant destinations of a link
+func resolveDestinations(db *sql.DB, link *URL) error {
+	for _, target := range []*string{&link.IOSURL, &link.AndroidURL, &link.DesktopURL} {
+		if *target == "" {
+			continue
+		}
+		destination, err := resolveDestination(db, *target)
+		if err != nil {
+			return err
+		}
+		*target = destination
+	}
+	for country, target := range link.CountryTargets {
+		destination, err := resolveDestination(db, target)
+		if err != nil {
+			return err
+		}
+		link.CountryTargets[country] = destination
+	}
+	for i, variant := range link.Variants {
+		destination, err := resolveDestination(db, variant.Target)
+		if err != nil {
+			return err
+		}
+		link.Variants[i].Target = destination
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestResolveDestinationLoops(t *testing.T) {
+	db := setupTestDB(t)
+	oldBase := config.BaseURL
+	config.BaseURL = "https://short.example"
+	defer func() { config.BaseURL = oldBase }()
+	db.Exec("DELETE FROM domains WHERE host = 'go.loops.example'")
+	domain, _ := createDomain(db, Domain{Host: "go.loops.example", BaseURL: "https://go.loops.example"})
+	defer deleteDomain(db, domain.ID)
+
+	tests := []struct {
+		destination string
+		loop        bool
+	}{
+		{"https://short.example/q/abc", true},
+		{"https://SHORT.example:443/", true},
+		{"http://short.example/q/abc", true},
+		{"https://go.loops.example/q/abc", true},
+		{"https://short.example:8443/q/abc", false},
+		{"https://other.example/q/abc", false},
+	}
+	for _, tt := range tests {
+		_, err := resolveDestination(db, tt.destination)
+		if (err == errServiceLoop) != tt.loop {
+			t.Errorf("resolveDestination(%q) = %v, want loop %v", tt.destination, err, tt.loop)
+		}
+	}
+
+	link := URL{Variants: []Variant{{Target: "https://other.example/", Weight: 1}, {Target: "https://go.loops.example/q/x", Weight: 1}}}
+	if err := resolveDestinations(db, &link); err != errServiceLoop {
+		t.Errorf("Expected variant pointing back to the service to be rejected, got %v", err)
+	}
+}
+
+func TestResolveShorteners(t *testing.T) {
+	db := setupTestDB(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a":
+			http.Redirect(w, r, "/b", http.StatusMovedPermanently)
+		case "/b":
+			http.Redirect(w, r, "https://final.example/page", http.StatusFound)
+		case "/nohead":
+			if r.Method == "HEAD" {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			http.Redirect(w, r, "https://final.example/get", http.StatusFound)
+		case "/loop":
+			http.Redirect(w, r, "https://short.example/q/abc", http.StatusFound)
+		case "/cycle":
+			http.Redirect(w, r, "/cycle", http.StatusFound)
+		case "/script":
+			http.Redirect(w, r, "https://final.example/setup.exe", http.StatusFound)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	old := *config
+	defer func() { *config = old }()
+	config.BaseURL = "https://short.example"
+	config.ResolveShorteners = true
+	config.KnownShorteners = []string{"127.0.0.1"}
+	// The test server listens on loopback
+	config.AllowedNetworks = []string{"127.0.0.1"}
+	config.parseNetworkSettings()
+
+	tests := []struct {
+		path  string
+		want  string
+		error string
+	}{
+		{"/a", "https://final.example/page", ""},
+		{"/nohead", "https://final.example/get", ""},
+		{"/loop", "", "points back to this service"},
+		{"/cycle", "", "more than 5 shorteners"},
+		{"/missing", "", "expected a redirect"},
+		{"/script", "", "executables"},
+	}
+	for _, tt := range tests {
+		got, err := resolveDestination(db, server.URL+tt.path)
+		if tt.error != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.error) {
+				t.Errorf("%s: expected error containing %q, got %q, %v", tt.path, tt.error, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: got %q, %v, want %q", tt.path, got, err, tt.want)
+		}
+	}
+
+	// New links store the URL the shortener leads to
+	purgeLinksTo(db, "https://final.example/page")
+	defer purgeLinksTo(db, "https://final.example/page")
+	form := url.Values{"url": {server.URL + "/a"}}
+	req := httptest.NewRequest("POST", "/create", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	cache, _ := createCache(10)
+	w := httptest.NewRecorder()
+	URLFormHandler{db: db, cache: cache}.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if _, err := linkTo(db, "https://final.example/page"); err != nil {
+		t.Errorf("Expected final URL to be stored, got %v", err)
+	}
+
+	config.ResolveShorteners = false
+	if got, err := resolveDestination(db, server.URL+"/a"); err != nil || got != server.URL+"/a" {
+		t.Errorf("Expected shorteners to be kept when disabled, got %q, %v", got, err)
+	}
+}
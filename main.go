@@ -9,12 +9,12 @@ import (
 var config *Settings
 
 func main() {
-	var settingsFile string
+	configFlag := flag.String("config", "urls.json", "path to settings file")
+	flag.Parse()
+
+	settingsFile := *configFlag
 	if env_filename := os.Getenv("SETTINGS_FILE"); env_filename != "" {
 		settingsFile = env_filename
-	} else {
-		settingsFile = *flag.String("config", "urls.json", "path to settings file")
-		flag.Parse()
 	}
 
 	var err error
@@ -27,5 +27,24 @@ func main() {
 		}
 	}
 
+	// Subcommands work on the database directly, e.g. to create the first user
+	if command := flag.Arg(0); command == "apikey" || command == "user" {
+		db, err := openDatabase()
+		if err != nil {
+			fmt.Println("Error opening database:", err)
+			os.Exit(1)
+		}
+		if command == "apikey" {
+			err = runAPIKeyCommand(db, flag.Args()[1:], os.Stdout)
+		} else {
+			err = runUserCommand(db, flag.Args()[1:], os.Stdin, os.Stdout)
+		}
+		if err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	Serve()
 }
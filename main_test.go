@@ -10,6 +10,9 @@ import (
 func TestMain(m *testing.M) {
 	// Setup default settings
 	config = GetDefaultSettings()
+	// Tests never resolve real hosts, every destination is on a public address
+	// unless a test says otherwise
+	destinationResolver = stubResolver{"*": {"93.184.216.34"}}
 
 	// Setup test database
 	db, err := openDatabase()
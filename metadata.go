@@ -0,0 +1,207 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+// PageMetadata holds the details scraped from a destination page
+type PageMetadata struct {
+	Title       string
+	Description string
+	ImageURL    string
+}
+
+// MetadataFetcher fetches titles and Open Graph metadata for new URLs in the background
+type MetadataFetcher struct {
+	db       *sql.DB
+	client   *http.Client
+	queue    chan URL
+	maxBytes int64
+}
+
+const (
+	outboundTimeout   = 10 * time.Second
+	outboundRedirects = 5
+	metadataMaxBytes  = 1 << 20
+	metadataQueueSize = 100
+)
+
+// newMetadataFetcher creates a fetcher whose client refuses to connect to internal addresses
+func newMetadataFetcher(db *sql.DB) *MetadataFetcher {
+	return &MetadataFetcher{
+		db:       db,
+		client:   newOutboundClient(rejectInternalIP),
+		queue:    make(chan URL, metadataQueueSize),
+		maxBytes: metadataMaxBytes,
+	}
+}
+
+// newOutboundClient returns an HTTP client for requests to link destinations,
+// with timeouts and a redirect limit. Every connection, including those made
+// while following redirects, is checked with checkIP after DNS resolution.
+func newOutboundClient(checkIP func(net.IP) error) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 5 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil {
+				return fmt.Errorf("invalid address %s", address)
+			}
+			return checkIP(ip)
+		},
+	}
+	return &http.Client{
+		Timeout: outboundTimeout,
+		Transport: &http.Transport{
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   5 * time.Second,
+			ResponseHeaderTimeout: 5 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= outboundRedirects {
+				return errors.New("too many redirects")
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return errors.New("unsupported redirect scheme")
+			}
+			return nil
+		},
+	}
+}
+
+// Start runs the background worker until the queue is closed
+func (f *MetadataFetcher) Start() {
+	go func() {
+		for url := range f.queue {
+			meta, err := f.fetch(url.Name)
+			if err != nil {
+				if config.EnableLogging {
+					fmt.Println("Failed to fetch metadata for", url.Name, err)
+				}
+				continue
+			}
+			if err := updateURLMetadata(f.db, url.DomainID, url.Short, meta); err != nil && config.EnableLogging {
+				fmt.Println("Failed to save metadata for", url.Short, err)
+			}
+		}
+	}()
+}
+
+// Enqueue schedules a URL for fetching, dropping it if the queue is full
+func (f *MetadataFetcher) Enqueue(url URL) {
+	select {
+	case f.queue <- url:
+	default:
+	}
+}
+
+// fetch downloads a page and extracts its metadata
+func (f *MetadataFetcher) fetch(rawURL string) (PageMetadata, error) {
+	req, err := http.NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return PageMetadata{}, err
+	}
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return PageMetadata{}, errors.New("unsupported scheme")
+	}
+	req.Header.Set("User-Agent", "url_shortener metadata fetcher")
+	req.Header.Set("Accept", "text/html")
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return PageMetadata{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return PageMetadata{}, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	if contentType := resp.Header.Get("Content-Type"); contentType != "" && !strings.Contains(contentType, "html") {
+		return PageMetadata{}, fmt.Errorf("unexpected content type %s", contentType)
+	}
+
+	meta := parseMetadata(io.LimitReader(resp.Body, f.maxBytes))
+	if meta.ImageURL != "" {
+		if image, err := resp.Request.URL.Parse(meta.ImageURL); err == nil {
+			meta.ImageURL = image.String()
+		}
+	}
+	return meta, nil
+}
+
+// parseMetadata reads the title and Open Graph tags from an HTML document
+func parseMetadata(r io.Reader) PageMetadata {
+	var meta PageMetadata
+	var ogTitle, description string
+	tokenizer := html.NewTokenizer(r)
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return finishMetadata(meta, ogTitle, description)
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			switch token.Data {
+			case "title":
+				if meta.Title == "" && tokenizer.Next() == html.TextToken {
+					meta.Title = strings.TrimSpace(string(tokenizer.Text()))
+				}
+			case "meta":
+				key, content := metaAttributes(token)
+				switch key {
+				case "og:title":
+					ogTitle = content
+				case "og:description":
+					meta.Description = content
+				case "description":
+					description = content
+				case "og:image", "og:image:url":
+					if meta.ImageURL == "" {
+						meta.ImageURL = content
+					}
+				}
+			case "body":
+				return finishMetadata(meta, ogTitle, description)
+			}
+		}
+	}
+}
+
+func finishMetadata(meta PageMetadata, ogTitle string, description string) PageMetadata {
+	if meta.Title == "" {
+		meta.Title = ogTitle
+	}
+	if meta.Description == "" {
+		meta.Description = description
+	}
+	return meta
+}
+
+// metaAttributes returns the property (or name) and content of a meta tag
+func metaAttributes(token html.Token) (string, string) {
+	var key, content string
+	for _, attr := range token.Attr {
+		switch attr.Key {
+		case "property", "name":
+			if key == "" {
+				key = strings.ToLower(attr.Val)
+			}
+		case "content":
+			content = strings.TrimSpace(attr.Val)
+		}
+	}
+	return key, content
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestMetadataFetcher(t *testing.T) *MetadataFetcher {
+	db := setupTestDB(t)
+	fetcher := newMetadataFetcher(db)
+	// httptest servers listen on loopback, which the default client refuses
+	fetcher.client = newOutboundClient(func(net.IP) error { return nil })
+	return fetcher
+}
+
+func TestParseMetadata(t *testing.T) {
+	page := `<html><head>
+		<title> Launch Plan </title>
+		<meta property="og:title" content="OG Launch">
+		<meta name="description" content="Plain description">
+		<meta property="og:description" content="OG description">
+		<meta property="og:image" content="/images/cover.png">
+	</head><body><title>Not this</title></body></html>`
+
+	meta := parseMetadata(strings.NewReader(page))
+	if meta.Title != "Launch Plan" {
+		t.Errorf("Expected title %q, got %q", "Launch Plan", meta.Title)
+	}
+	if meta.Description != "OG description" {
+		t.Errorf("Expected description %q, got %q", "OG description", meta.Description)
+	}
+	if meta.ImageURL != "/images/cover.png" {
+		t.Errorf("Expected image %q, got %q", "/images/cover.png", meta.ImageURL)
+	}
+
+	meta = parseMetadata(strings.NewReader(`<meta property="og:title" content="Only OG"><meta name="description" content="Fallback">`))
+	if meta.Title != "Only OG" || meta.Description != "Fallback" {
+		t.Errorf("Expected Open Graph title and description fallbacks, got %+v", meta)
+	}
+}
+
+func TestMetadataFetch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/page":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write([]byte(`<html><head><title>Test Page</title><meta property="og:image" content="/og.png"></head></html>`))
+		case "/redirect":
+			http.Redirect(w, r, "/page", http.StatusFound)
+		case "/binary":
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write([]byte("not html"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	fetcher := newTestMetadataFetcher(t)
+
+	meta, err := fetcher.fetch(server.URL + "/redirect")
+	if err != nil {
+		t.Fatalf("Failed to fetch metadata: %v", err)
+	}
+	if meta.Title != "Test Page" {
+		t.Errorf("Expected title %q, got %q", "Test Page", meta.Title)
+	}
+	if meta.ImageURL != server.URL+"/og.png" {
+		t.Errorf("Expected absolute image URL %q, got %q", server.URL+"/og.png", meta.ImageURL)
+	}
+
+	if _, err := fetcher.fetch(server.URL + "/binary"); err == nil {
+		t.Error("Expected error for non-HTML content")
+	}
+	if _, err := fetcher.fetch(server.URL + "/missing"); err == nil {
+		t.Error("Expected error for missing page")
+	}
+}
+
+func TestMetadataFetchSizeLimit(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html><head>" + strings.Repeat("<!-- padding -->", 100) + "<title>Too Late</title></head></html>"))
+	}))
+	defer server.Close()
+
+	fetcher := newTestMetadataFetcher(t)
+	fetcher.maxBytes = 64
+
+	meta, err := fetcher.fetch(server.URL)
+	if err != nil {
+		t.Fatalf("Failed to fetch metadata: %v", err)
+	}
+	if meta.Title != "" {
+		t.Errorf("Expected title beyond the size limit to be ignored, got %q", meta.Title)
+	}
+}
+
+func TestMetadataFetchRejectsInternalAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<title>Internal</title>"))
+	}))
+	defer server.Close()
+
+	fetcher := newMetadataFetcher(setupTestDB(t))
+	if _, err := fetcher.fetch(server.URL); err == nil {
+		t.Error("Expected loopback destination to be rejected")
+	}
+	if _, err := fetcher.fetch("file:///etc/passwd"); err == nil {
+		t.Error("Expected non-HTTP scheme to be rejected")
+	}
+}
+
+func TestMetadataFetcherWorker(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<title>Worker Page</title><meta property="og:description" content="Fetched in the background">`))
+	}))
+	defer server.Close()
+
+	fetcher := newTestMetadataFetcher(t)
+	short := "meta0001"
+	createURL(fetcher.db, server.URL, short, "127.0.0.1")
+
+	fetcher.Start()
+	defer close(fetcher.queue)
+	fetcher.Enqueue(URL{Name: server.URL, Short: short})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		url, err := queryShortURL(fetcher.db, 0, short)
+		if err == nil && url.Title == "Worker Page" {
+			if url.Description != "Fetched in the background" {
+				t.Errorf("Expected description to be stored, got %q", url.Description)
+			}
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Error("Worker did not store the fetched title")
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// OIDCGroupRole gives users in a group of the identity provider a role
+type OIDCGroupRole struct {
+	Group string `json:"group"`
+	Role  string `json:"role"`
+}
+
+// OIDCLogin signs users in with an OpenID Connect provider using the
+// authorization code flow with PKCE. Users are matched to local accounts by
+// issuer and subject, and created on their first login.
+type OIDCLogin struct {
+	db       *sql.DB
+	settings *Settings
+	client   *http.Client
+
+	mu       sync.Mutex
+	oauth    oauth2.Config
+	verifier *oidc.IDTokenVerifier
+	pending  map[string]oidcPending
+}
+
+// oidcPending is a login that was sent to the provider and has not come back yet
+type oidcPending struct {
+	codeVerifier string
+	nonce        string
+	next         string
+	expires      time.Time
+}
+
+const (
+	oidcStateCookie  = "oidc_state"
+	oidcLoginTimeout = 10 * time.Minute
+)
+
+// newOIDCLogin creates a login for the provider configured in the settings.
+// The provider is discovered on first use, so that it may be unreachable when
+// the server starts.
+func newOIDCLogin(db *sql.DB, settings *Settings) *OIDCLogin {
+	return &OIDCLogin{
+		db:       db,
+		settings: settings,
+		client:   &http.Client{Timeout: outboundTimeout},
+		pending:  make(map[string]oidcPending),
+	}
+}
+
+// discover fetches the provider configuration unless it is already known
+func (o *OIDCLogin) discover(ctx context.Context) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.verifier != nil {
+		return nil
+	}
+	provider, err := oidc.NewProvider(oidc.ClientContext(ctx, o.client), o.settings.OIDCIssuer)
+	if err != nil {
+		return err
+	}
+	o.oauth = oauth2.Config{
+		ClientID:     o.settings.OIDCClientID,
+		ClientSecret: o.settings.OIDCClientSecret,
+		Endpoint:     provider.Endpoint(),
+		RedirectURL:  strings.TrimSuffix(o.settings.BaseURL, "/") + "/oidc/callback",
+		Scopes:       o.settings.OIDCScopes,
+	}
+	o.verifier = provider.Verifier(&oidc.Config{ClientID: o.settings.OIDCClientID})
+	return nil
+}
+
+// ServeHTTP implements the http.Handler interface for /oidc/login and /oidc/callback
+func (o *OIDCLogin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := o.discover(r.Context()); err != nil {
+		if config.EnableLogging {
+			fmt.Println("OpenID Connect discovery failed:", err)
+		}
+		renderLogin(w, r, "/", "Single sign-on is unavailable, please try again later", http.StatusServiceUnavailable)
+		return
+	}
+	switch r.URL.Path {
+	case "/oidc/login":
+		o.start(w, r)
+	case "/oidc/callback":
+		o.callback(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// start sends the browser to the provider. The state is also kept in a
+// cookie, so that a callback is only accepted in the browser that started it.
+func (o *OIDCLogin) start(w http.ResponseWriter, r *http.Request) {
+	state, err := randomToken()
+	if err != nil {
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+	nonce, err := randomToken()
+	if err != nil {
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+	codeVerifier := oauth2.GenerateVerifier()
+
+	o.mu.Lock()
+	now := time.Now()
+	for key, login := range o.pending {
+		if now.After(login.expires) {
+			delete(o.pending, key)
+		}
+	}
+	o.pending[state] = oidcPending{
+		codeVerifier: codeVerifier,
+		nonce:        nonce,
+		next:         safeRedirectTarget(r.URL.Query().Get("next")),
+		expires:      now.Add(oidcLoginTimeout),
+	}
+	o.mu.Unlock()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/oidc/",
+		MaxAge:   int(oidcLoginTimeout.Seconds()),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(config.BaseURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+	authURL := o.oauth.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(codeVerifier))
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// callback exchanges the authorization code, verifies the ID token and signs
+// the user in
+func (o *OIDCLogin) callback(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if errorCode := query.Get("error"); errorCode != "" {
+		renderLogin(w, r, "/", "Single sign-on failed: "+errorCode, http.StatusUnauthorized)
+		return
+	}
+
+	state := query.Get("state")
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || state == "" || cookie.Value != state {
+		renderLogin(w, r, "/", "Single sign-on failed: invalid state, please try again", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Value: "", Path: "/oidc/", MaxAge: -1, HttpOnly: true})
+
+	o.mu.Lock()
+	login, ok := o.pending[state]
+	delete(o.pending, state)
+	o.mu.Unlock()
+	if !ok || time.Now().After(login.expires) {
+		renderLogin(w, r, "/", "Single sign-on failed: the login expired, please try again", http.StatusBadRequest)
+		return
+	}
+
+	ctx := oidc.ClientContext(r.Context(), o.client)
+	token, err := o.oauth.Exchange(ctx, query.Get("code"), oauth2.VerifierOption(login.codeVerifier))
+	if err != nil {
+		renderLogin(w, r, login.next, "Single sign-on failed: could not exchange the authorization code", http.StatusBadGateway)
+		return
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		renderLogin(w, r, login.next, "Single sign-on failed: no ID token received", http.StatusBadGateway)
+		return
+	}
+	idToken, err := o.verifier.Verify(ctx, rawIDToken)
+	if err != nil || idToken.Nonce != login.nonce {
+		renderLogin(w, r, login.next, "Single sign-on failed: invalid ID token", http.StatusUnauthorized)
+		return
+	}
+
+	var claims map[string]any
+	if err := idToken.Claims(&claims); err != nil {
+		renderLogin(w, r, login.next, "Single sign-on failed: invalid ID token", http.StatusUnauthorized)
+		return
+	}
+	user, err := o.localUser(idToken.Subject, claims)
+	if err != nil {
+		renderLogin(w, r, login.next, "Single sign-on failed: "+err.Error(), http.StatusForbidden)
+		return
+	}
+
+	sessionToken, err := generateSessionToken()
+	if err != nil {
+		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		return
+	}
+	expires := time.Now().Add(sessionLifetime)
+	if err := createSession(o.db, hashToken(sessionToken), user.ID, expires); err != nil {
+		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		return
+	}
+	setSessionCookie(w, sessionToken, expires)
+	http.Redirect(w, r, login.next, http.StatusSeeOther)
+}
+
+// localUser finds or creates the local account for a provider subject and
+// updates its role from the groups claim. A role granted by a group rule is
+// reset to the default role once no rule matches, so removing a user from a
+// group takes its role away. Roles set by an admin are kept in that case.
+func (o *OIDCLogin) localUser(subject string, claims map[string]any) (User, error) {
+	role := oidcRole(claimStrings(claims[o.settings.OIDCGroupsClaim]), o.settings.OIDCGroupRoles)
+
+	user, err := queryUserBySubject(o.db, o.settings.OIDCIssuer, subject)
+	if err == sql.ErrNoRows {
+		username := oidcUsername(claims, o.settings.OIDCUsernameClaim, subject)
+		if err := validateUsername(username); err != nil {
+			return User{}, err
+		}
+		if _, _, err := queryUserByName(o.db, username); err == nil {
+			// Never take over an existing account just because the name matches
+			return User{}, fmt.Errorf("the username %s is already taken by another account", username)
+		}
+		return createOIDCUser(o.db, username, o.settings.OIDCIssuer, subject, role)
+	}
+	if err != nil {
+		return User{}, err
+	}
+	if role == "" && !user.GroupRole {
+		return user, nil
+	}
+	if user.Role != role || user.GroupRole != (role != "") {
+		if err := updateUserGroupRole(o.db, user.ID, role); err != nil {
+			return User{}, err
+		}
+		user.Role, user.GroupRole = role, role != ""
+	}
+	return user, nil
+}
+
+// oidcUsername picks the username from the configured claim, falling back to
+// the email address and then the subject
+func oidcUsername(claims map[string]any, usernameClaim string, subject string) string {
+	for _, claim := range []string{usernameClaim, "email"} {
+		if name, ok := claims[claim].(string); ok && name != "" {
+			return name
+		}
+	}
+	return subject
+}
+
+// oidcRole returns the role of the first rule whose group the user is in
+func oidcRole(groups []string, rules []OIDCGroupRole) string {
+	for _, rule := range rules {
+		for _, group := range groups {
+			if group == rule.Group {
+				return rule.Role
+			}
+		}
+	}
+	return ""
+}
+
+// claimStrings reads a claim that is either a list of strings or a single string
+func claimStrings(claim any) []string {
+	switch value := claim.(type) {
+	case string:
+		return []string{value}
+	case []any:
+		var values []string
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// randomToken returns 128 random bits encoded for use in URLs
+func randomToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+// mockOIDCProvider is a minimal OpenID Connect provider that issues codes
+// for a fixed user and checks PKCE when they are exchanged
+type mockOIDCProvider struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu      sync.Mutex
+	subject string
+	claims  map[string]any
+	codes   map[string]mockAuthorization
+}
+
+type mockAuthorization struct {
+	challenge string
+	nonce     string
+}
+
+func newMockOIDCProvider(t *testing.T) *mockOIDCProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &mockOIDCProvider{key: key, codes: make(map[string]mockAuthorization)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                                p.server.URL,
+			"authorization_endpoint":                p.server.URL + "/authorize",
+			"token_endpoint":                        p.server.URL + "/token",
+			"jwks_uri":                              p.server.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: &p.key.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"},
+		}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		auth, ok := p.codes[r.FormValue("code")]
+		delete(p.codes, r.FormValue("code"))
+		p.mu.Unlock()
+
+		sum := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != auth.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     p.idToken(t, auth.nonce),
+		})
+	})
+	p.server = httptest.NewServer(mux)
+	t.Cleanup(p.server.Close)
+	return p
+}
+
+// authorize plays the part of the browser visiting the provider: it accepts
+// the authorization request and returns the code the provider would send back
+func (p *mockOIDCProvider) authorize(t *testing.T, authURL string) (code string, state string) {
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	if query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+		t.Fatalf("Expected a PKCE challenge in %s", authURL)
+	}
+	code = "code-" + query.Get("state")
+	p.mu.Lock()
+	p.codes[code] = mockAuthorization{challenge: query.Get("code_challenge"), nonce: query.Get("nonce")}
+	p.mu.Unlock()
+	return code, query.Get("state")
+}
+
+func (p *mockOIDCProvider) idToken(t *testing.T, nonce string) string {
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: p.key},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", "test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.mu.Lock()
+	claims := map[string]any{
+		"iss":   p.server.URL,
+		"sub":   p.subject,
+		"aud":   "shortener",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"iat":   time.Now().Unix(),
+		"nonce": nonce,
+	}
+	for k, v := range p.claims {
+		claims[k] = v
+	}
+	p.mu.Unlock()
+	payload, _ := json.Marshal(claims)
+	signed, err := signer.Sign(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := signed.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestOIDCLogin(t *testing.T) {
+	db := setupTestDB(t)
+	provider := newMockOIDCProvider(t)
+	db.Exec("DELETE FROM users WHERE username IN ('sso.user', 'taken')")
+
+	settings := *GetDefaultSettings()
+	settings.OIDCIssuer = provider.server.URL
+	settings.OIDCClientID = "shortener"
+	settings.OIDCGroupRoles = []OIDCGroupRole{{Group: "shortener-admins", Role: "admin"}, {Group: "staff", Role: "editor"}}
+	sso := newOIDCLogin(db, &settings)
+
+	// signIn runs the whole flow and returns the callback response
+	signIn := func(t *testing.T, tamperState bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/oidc/login?next=/stats/abc", nil)
+		w := httptest.NewRecorder()
+		sso.ServeHTTP(w, req)
+		if w.Code != http.StatusFound {
+			t.Fatalf("Expected redirect to the provider, got %d: %s", w.Code, w.Body.String())
+		}
+		code, state := provider.authorize(t, w.Header().Get("Location"))
+
+		stateCookie := w.Result().Cookies()[0]
+		if tamperState {
+			stateCookie.Value = "other"
+		}
+		req = httptest.NewRequest("GET", "/oidc/callback?code="+url.QueryEscape(code)+"&state="+url.QueryEscape(state), nil)
+		req.AddCookie(stateCookie)
+		w = httptest.NewRecorder()
+		sso.ServeHTTP(w, req)
+		return w
+	}
+
+	provider.subject = "subject-1"
+	provider.claims = map[string]any{"preferred_username": "sso.user", "groups": []string{"staff", "shortener-admins"}}
+
+	w := signIn(t, false)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/stats/abc" {
+		t.Fatalf("Expected redirect to /stats/abc, got %d %s", w.Code, w.Body.String())
+	}
+	var session *http.Cookie
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == sessionCookie && cookie.Value != "" {
+			session = cookie
+		}
+	}
+	if session == nil {
+		t.Fatal("Expected a session cookie")
+	}
+	user, err := querySessionUser(db, hashToken(session.Value), time.Now())
+	if err != nil || user.Username != "sso.user" || user.Role != "admin" {
+		t.Errorf("Expected admin sso.user, got %+v, %v", user, err)
+	}
+
+	// Roles follow the groups on every login, and the account is found by subject
+	provider.claims = map[string]any{"preferred_username": "renamed", "groups": "staff"}
+	if w := signIn(t, false); w.Code != http.StatusSeeOther {
+		t.Fatalf("Expected second login to succeed, got %d", w.Code)
+	}
+	if user, _, _ := queryUserByName(db, "sso.user"); user.Role != "editor" {
+		t.Errorf("Expected role editor after group change, got %q", user.Role)
+	}
+
+	// Leaving every group takes away the role the groups granted
+	provider.claims = map[string]any{"preferred_username": "sso.user", "groups": "unrelated"}
+	if w := signIn(t, false); w.Code != http.StatusSeeOther {
+		t.Fatalf("Expected third login to succeed, got %d", w.Code)
+	}
+	if user, _, _ := queryUserByName(db, "sso.user"); user.Role != "" {
+		t.Errorf("Expected the default role after leaving the groups, got %q", user.Role)
+	}
+
+	// Without a matching group, a role set by an admin is kept
+	updateUserRole(db, user.ID, "viewer")
+	if w := signIn(t, false); w.Code != http.StatusSeeOther {
+		t.Fatalf("Expected fourth login to succeed, got %d", w.Code)
+	}
+	if user, _, _ := queryUserByName(db, "sso.user"); user.Role != "viewer" {
+		t.Errorf("Expected role viewer to be kept, got %q", user.Role)
+	}
+
+	// Single sign-on users cannot log in with a password
+	if _, err := authenticateUser(db, "sso.user", ""); err != errInvalidLogin {
+		t.Errorf("Expected password login to fail for an SSO user, got %v", err)
+	}
+
+	if w := signIn(t, true); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d for a mismatched state, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	// A new subject must not take over a local account with the same name
+	hash, _ := hashPassword("local password")
+	createUser(db, "taken", hash)
+	provider.subject = "subject-2"
+	provider.claims = map[string]any{"preferred_username": "taken"}
+	if w := signIn(t, false); w.Code != http.StatusForbidden {
+		t.Errorf("Expected status code %d for a taken username, got %d", http.StatusForbidden, w.Code)
+	}
+}
+
+func TestOIDCRole(t *testing.T) {
+	rules := []OIDCGroupRole{{Group: "admins", Role: "admin"}, {Group: "everyone", Role: "viewer"}}
+	tests := []struct {
+		groups []string
+		want   string
+	}{
+		{[]string{"everyone", "admins"}, "admin"},
+		{[]string{"everyone"}, "viewer"},
+		{[]string{"other"}, ""},
+		{nil, ""},
+	}
+	for _, tt := range tests {
+		if got := oidcRole(tt.groups, rules); got != tt.want {
+			t.Errorf("oidcRole(%v) = %q, want %q", tt.groups, got, tt.want)
+		}
+	}
+
+	if got := claimStrings([]any{"a", 1, "b"}); len(got) != 2 {
+		t.Errorf("Expected two strings, got %v", got)
+	}
+}
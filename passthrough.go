@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+)
+
+// splitQueryPath splits the path after /q/ into the short code and any extra
+// path. A "+" after the code asks for the preview page.
+func splitQueryPath(path string) (short string, extraPath string, preview bool) {
+	short, extraPath, found := strings.Cut(path, "/")
+	if found {
+		extraPath = "/" + extraPath
+	}
+	preview = strings.HasSuffix(short, "+")
+	short = strings.TrimSuffix(short, "+")
+	return short, extraPath, preview
+}
+
+// applyPassthrough appends the extra path of a request to a destination and
+// merges in its query parameters. Parameters already present on the
+// destination are kept, and its fragment stays at the end.
+func applyPassthrough(destination string, extraPath string, query url.Values) (string, error) {
+	u, err := url.Parse(destination)
+	if err != nil {
+		return "", err
+	}
+	if extraPath != "" {
+		u.Path = strings.TrimSuffix(u.Path, "/") + extraPath
+		u.RawPath = ""
+	}
+	u.RawQuery = mergeQuery(u.RawQuery, query)
+	return u.String(), nil
+}
+
+// mergeQuery adds parameters to a raw query string, skipping those it already has
+func mergeQuery(rawQuery string, params url.Values) string {
+	existing, _ := url.ParseQuery(rawQuery)
+	extra := url.Values{}
+	for key, values := range params {
+		if _, ok := existing[key]; ok {
+			continue
+		}
+		extra[key] = values
+	}
+	if len(extra) == 0 {
+		return rawQuery
+	}
+	if rawQuery == "" {
+		return extra.Encode()
+	}
+	return rawQuery + "&" + extra.Encode()
+}
+
+// checkPassthroughDestination checks a destination extended with the path and
+// query of a visitor against the destination policy and the threat feeds, so
+// that rules on paths, extensions or listed URLs cannot be passed by adding
+// them to a short URL
+func checkPassthroughDestination(destination string) error {
+	if err := destinationPolicy.check(destination); err != nil {
+		return err
+	}
+	return threatBlocklist.check(destination)
+}
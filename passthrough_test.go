@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSplitQueryPath(t *testing.T) {
+	tests := []struct {
+		path        string
+		wantShort   string
+		wantExtra   string
+		wantPreview bool
+	}{
+		{"abc123", "abc123", "", false},
+		{"abc123+", "abc123", "", true},
+		{"docs/getting-started", "docs", "/getting-started", false},
+		{"docs+/a/b/", "docs", "/a/b/", true},
+		{"", "", "", false},
+	}
+
+	for _, tt := range tests {
+		short, extra, preview := splitQueryPath(tt.path)
+		if short != tt.wantShort || extra != tt.wantExtra || preview != tt.wantPreview {
+			t.Errorf("splitQueryPath(%q) = %q, %q, %v, want %q, %q, %v",
+				tt.path, short, extra, preview, tt.wantShort, tt.wantExtra, tt.wantPreview)
+		}
+	}
+}
+
+func TestApplyPassthrough(t *testing.T) {
+	tests := []struct {
+		name        string
+		destination string
+		extraPath   string
+		query       string
+		want        string
+	}{
+		{"Path", "https://docs.example.com", "/getting-started", "", "https://docs.example.com/getting-started"},
+		{"Path with trailing slash", "https://docs.example.com/v2/", "/install", "", "https://docs.example.com/v2/install"},
+		{"Query", "https://docs.example.com/", "", "ref=x", "https://docs.example.com/?ref=x"},
+		{"Existing query", "https://example.com/p?a=1&b=2", "", "ref=x", "https://example.com/p?a=1&b=2&ref=x"},
+		{"Existing parameter kept", "https://example.com/p?ref=link", "", "ref=x&c=3", "https://example.com/p?ref=link&c=3"},
+		{"Fragment", "https://example.com/docs?a=1#intro", "/setup", "ref=x", "https://example.com/docs/setup?a=1&ref=x#intro"},
+		{"Escaped path", "https://example.com/docs", "/a b", "", "https://example.com/docs/a%20b"},
+		{"Nothing to add", "https://example.com/p?a=1", "", "", "https://example.com/p?a=1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, _ := url.ParseQuery(tt.query)
+			got, err := applyPassthrough(tt.destination, tt.extraPath, query)
+			if err != nil {
+				t.Fatalf("applyPassthrough failed: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("applyPassthrough() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueryHandlerPassthrough(t *testing.T) {
+	db := setupTestDB(t)
+	cache, _ := createCache(10)
+	handler := QueryHandler{db: db, cache: cache}
+
+	createURL(db, "https://docs.example.com/", "passthr1", "127.0.0.1")
+	updateURLDetails(db, URL{Short: "passthr1", Passthrough: true})
+	createURL(db, "https://example.com/fixed", "passthr2", "127.0.0.1")
+	defer threatBlocklist.load(nil)
+	feed := filepath.Join(t.TempDir(), "urls.txt")
+	os.WriteFile(feed, []byte("https://docs.example.com/phish/login\n"), 0o644)
+	threatBlocklist.load([]string{feed})
+
+	tests := []struct {
+		path         string
+		wantStatus   int
+		wantLocation string
+	}{
+		{"/q/passthr1/getting-started?ref=x", http.StatusMovedPermanently, "https://docs.example.com/getting-started?ref=x"},
+		{"/q/passthr2?ref=x", http.StatusMovedPermanently, "https://example.com/fixed"},
+		{"/q/passthr2/extra", http.StatusNotFound, ""},
+		// The extended destination has to pass the policy and the threat feeds
+		{"/q/passthr1/setup.exe", http.StatusForbidden, ""},
+		{"/q/passthr1/phish/login", http.StatusForbidden, ""},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.path, nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != tt.wantStatus {
+			t.Errorf("Expected status code %d for %s, got %d", tt.wantStatus, tt.path, w.Code)
+		}
+		if w.Header().Get("Location") != tt.wantLocation {
+			t.Errorf("Expected redirect to %q for %s, got %q", tt.wantLocation, tt.path, w.Header().Get("Location"))
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Argon2id parameters, following the OWASP recommendation for interactive logins
+const (
+	argonTime    = 2
+	argonMemory  = 19 * 1024
+	argonThreads = 1
+	argonKeyLen  = 32
+	argonSaltLen = 16
+)
+
+var errInvalidHash = errors.New("invalid password hash")
+
+// hashPassword derives an Argon2id hash, encoded in the PHC string format
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, argonSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, argonTime, argonMemory, argonThreads, argonKeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argonMemory, argonTime, argonThreads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// verifyPassword checks a password against a hash created by hashPassword
+func verifyPassword(password string, hash string) (bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return false, errInvalidHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, errInvalidHash
+	}
+
+	var memory, iterations uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &threads); err != nil {
+		return false, errInvalidHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, errInvalidHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, errInvalidHash
+	}
+
+	other := argon2.IDKey([]byte(password), salt, iterations, memory, threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+// attemptLimiter counts failed attempts per client and blocks clients that
+// fail too often within a window
+type attemptLimiter struct {
+	mu       sync.Mutex
+	max      int
+	window   time.Duration
+	attempts map[string]attemptCount
+}
+
+type attemptCount struct {
+	count int
+	start time.Time
+}
+
+// passwordAttempts limits guessing of link passwords to 5 failures per 15
+// minutes per link and client, see linkAttemptKey
+var passwordAttempts = newAttemptLimiter(5, 15*time.Minute)
+
+// linkAttemptKey identifies the failed password attempts of a client on a link
+func linkAttemptKey(domainID int64, short string, client string) string {
+	return strconv.FormatInt(domainID, 10) + ":" + short + " " + client
+}
+
+func newAttemptLimiter(max int, window time.Duration) *attemptLimiter {
+	return &attemptLimiter{
+		max:      max,
+		window:   window,
+		attempts: make(map[string]attemptCount),
+	}
+}
+
+// allow reports whether a client may make another attempt, and if not, how
+// long it has to wait
+func (l *attemptLimiter) allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	attempt, ok := l.attempts[key]
+	elapsed := time.Since(attempt.start)
+	if !ok || elapsed > l.window || attempt.count < l.max {
+		return true, 0
+	}
+	return false, l.window - elapsed
+}
+
+// fail records a failed attempt
+func (l *attemptLimiter) fail(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for k, attempt := range l.attempts {
+		if now.Sub(attempt.start) > l.window {
+			delete(l.attempts, k)
+		}
+	}
+	attempt, ok := l.attempts[key]
+	if !ok {
+		attempt.start = now
+	}
+	attempt.count++
+	l.attempts[key] = attempt
+}
+
+// reset forgets the failed attempts of a client after a success
+func (l *attemptLimiter) reset(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.attempts, key)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHashPassword(t *testing.T) {
+	hash, err := hashPassword("correct horse")
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$") {
+		t.Errorf("Expected an argon2id hash, got %s", hash)
+	}
+
+	other, _ := hashPassword("correct horse")
+	if hash == other {
+		t.Error("Hashes of the same password should use different salts")
+	}
+
+	ok, err := verifyPassword("correct horse", hash)
+	if err != nil || !ok {
+		t.Errorf("Expected correct password to verify, got %v, %v", ok, err)
+	}
+
+	ok, err = verifyPassword("wrong horse", hash)
+	if err != nil || ok {
+		t.Errorf("Expected wrong password to fail, got %v, %v", ok, err)
+	}
+
+	if _, err := verifyPassword("anything", "plaintext"); err == nil {
+		t.Error("Expected error for a malformed hash")
+	}
+}
+
+func TestAttemptLimiter(t *testing.T) {
+	limiter := newAttemptLimiter(2, 50*time.Millisecond)
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := limiter.allow("10.0.0.1"); !ok {
+			t.Fatalf("Attempt %d should be allowed", i+1)
+		}
+		limiter.fail("10.0.0.1")
+	}
+
+	ok, wait := limiter.allow("10.0.0.1")
+	if ok || wait <= 0 {
+		t.Errorf("Expected client to be blocked with a wait time, got %v, %v", ok, wait)
+	}
+	if ok, _ := limiter.allow("10.0.0.2"); !ok {
+		t.Error("Other clients should not be blocked")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if ok, _ := limiter.allow("10.0.0.1"); !ok {
+		t.Error("Client should be allowed again after the window")
+	}
+
+	limiter.fail("10.0.0.3")
+	limiter.fail("10.0.0.3")
+	limiter.reset("10.0.0.3")
+	if ok, _ := limiter.allow("10.0.0.3"); !ok {
+		t.Error("Client should be allowed after a reset")
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import "strings"
+
+// Platforms a link can have an alternative destination for
+const (
+	platformIOS     = "ios"
+	platformAndroid = "android"
+	platformDesktop = "desktop"
+)
+
+// detectPlatform guesses the platform of a visitor from its User-Agent
+// header. Mobile devices other than iOS and Android return an empty string,
+// so they get the default destination.
+func detectPlatform(userAgent string) string {
+	ua := strings.ToLower(userAgent)
+	switch {
+	case ua == "":
+		return ""
+	case strings.Contains(ua, "iphone") || strings.Contains(ua, "ipad") || strings.Contains(ua, "ipod"):
+		return platformIOS
+	case strings.Contains(ua, "android"):
+		return platformAndroid
+	case strings.Contains(ua, "mobile") || strings.Contains(ua, "bot"):
+		return ""
+	case strings.Contains(ua, "windows") || strings.Contains(ua, "macintosh") ||
+		strings.Contains(ua, "linux") || strings.Contains(ua, "cros"):
+		return platformDesktop
+	}
+	return ""
+}
+
+// platformTarget returns the destination for a platform, or an empty string if it has none
+func (u URL) platformTarget(platform string) string {
+	var target string
+	switch platform {
+	case platformIOS:
+		target = u.IOSURL
+	case platformAndroid:
+		target = u.AndroidURL
+	case platformDesktop:
+		target = u.DesktopURL
+	}
+	return target
+}
+
+// HasPlatformTargets reports whether any platform specific destination is set
+func (u URL) HasPlatformTargets() bool {
+	return u.IOSURL != "" || u.AndroidURL != "" || u.DesktopURL != ""
+}
@@ -0,0 +1,53 @@
+package main
+
+import "testing"
+
+func TestDetectPlatform(t *testing.T) {
+	tests := []struct {
+		name      string
+		userAgent string
+		want      string
+	}{
+		{"iPhone", "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 Mobile/15E148", platformIOS},
+		{"iPad", "Mozilla/5.0 (iPad; CPU OS 16_6 like Mac OS X) AppleWebKit/605.1.15 Mobile/15E148", platformIOS},
+		{"Android", "Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 Chrome/120.0 Mobile Safari/537.36", platformAndroid},
+		{"Windows", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 Chrome/120.0 Safari/537.36", platformDesktop},
+		{"Mac", "Mozilla/5.0 (Macintosh; Intel Mac OS X 14_0) AppleWebKit/605.1.15 Version/17.0 Safari/605.1.15", platformDesktop},
+		{"Linux", "Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0", platformDesktop},
+		{"Other mobile", "Mozilla/5.0 (Mobile; rv:48.0) Gecko/48.0 Firefox/48.0 KAIOS/2.5", ""},
+		{"Crawler", "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", ""},
+		{"Empty", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := detectPlatform(tt.userAgent); got != tt.want {
+				t.Errorf("detectPlatform() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlatformTarget(t *testing.T) {
+	url := URL{
+		Name:       "https://example.com/app",
+		IOSURL:     "https://apps.apple.com/app/example",
+		AndroidURL: "https://play.google.com/store/apps/details?id=com.example",
+	}
+
+	tests := []struct {
+		platform string
+		want     string
+	}{
+		{platformIOS, url.IOSURL},
+		{platformAndroid, url.AndroidURL},
+		{platformDesktop, ""},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		if got := url.platformTarget(tt.platform); got != tt.want {
+			t.Errorf("platformTarget(%q) = %s, want %s", tt.platform, got, tt.want)
+		}
+	}
+}
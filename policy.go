@@ -0,0 +1,361 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// PolicyRule allows or denies destinations. A rule matches when all of its
+// conditions match, and the first matching rule decides.
+type PolicyRule struct {
+	ID     int64  `json:"-"`
+	Action string `json:"action"`
+	// Domain matches the host of the destination. "*.example.com" also
+	// matches every subdomain of example.com.
+	Domain    string `json:"domain,omitempty"`
+	Scheme    string `json:"scheme,omitempty"`
+	Extension string `json:"extension,omitempty"`
+	// Regex matches anywhere in the destination URL
+	Regex  string `json:"regex,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	// Source tells where the rule came from, for the policy page
+	Source string `json:"-"`
+
+	re *regexp.Regexp
+}
+
+// builtinPolicyRules keep out what the service always refused: scripts,
+// inline data and executables
+var builtinPolicyRules = []PolicyRule{
+	{Action: "deny", Scheme: "javascript", Reason: "javascript: URLs are not allowed", Source: "built-in"},
+	{Action: "deny", Scheme: "vbscript", Reason: "vbscript: URLs are not allowed", Source: "built-in"},
+	{Action: "deny", Scheme: "data", Reason: "data: URLs are not allowed", Source: "built-in"},
+	{Action: "deny", Scheme: "file", Reason: "file: URLs are not allowed", Source: "built-in"},
+	{Action: "deny", Extension: ".exe", Reason: "links to executables are not allowed", Source: "built-in"},
+}
+
+// PolicyError explains why a destination was rejected
+type PolicyError struct {
+	Reason string
+}
+
+func (e PolicyError) Error() string {
+	return "Destination not allowed: " + e.Reason
+}
+
+// compile checks a rule and prepares it for matching
+func (rule PolicyRule) compile() (PolicyRule, error) {
+	rule.Action = strings.ToLower(strings.TrimSpace(rule.Action))
+	rule.Domain = strings.ToLower(strings.TrimSpace(rule.Domain))
+	rule.Scheme = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(rule.Scheme)), ":")
+	rule.Extension = strings.ToLower(strings.TrimSpace(rule.Extension))
+	rule.Regex = strings.TrimSpace(rule.Regex)
+	rule.Reason = strings.TrimSpace(rule.Reason)
+
+	if rule.Action != "allow" && rule.Action != "deny" {
+		return rule, fmt.Errorf("rule action must be allow or deny, not %q", rule.Action)
+	}
+	if rule.Domain == "" && rule.Scheme == "" && rule.Extension == "" && rule.Regex == "" {
+		return rule, errors.New("rules need a domain, scheme, extension or regex")
+	}
+	if rule.Extension != "" && !strings.HasPrefix(rule.Extension, ".") {
+		rule.Extension = "." + rule.Extension
+	}
+	if rule.Regex != "" {
+		re, err := regexp.Compile(rule.Regex)
+		if err != nil {
+			return rule, fmt.Errorf("invalid regex %q: %v", rule.Regex, err)
+		}
+		rule.re = re
+	}
+	return rule, nil
+}
+
+// String describes the conditions of a rule
+func (rule PolicyRule) String() string {
+	var parts []string
+	if rule.Domain != "" {
+		parts = append(parts, "domain "+rule.Domain)
+	}
+	if rule.Scheme != "" {
+		parts = append(parts, "scheme "+rule.Scheme)
+	}
+	if rule.Extension != "" {
+		parts = append(parts, "extension "+rule.Extension)
+	}
+	if rule.Regex != "" {
+		parts = append(parts, "regex "+rule.Regex)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// policyTarget is a destination split into the parts rules look at
+type policyTarget struct {
+	raw       string
+	scheme    string
+	host      string
+	extension string
+}
+
+func (rule PolicyRule) matches(target policyTarget) bool {
+	if rule.Scheme != "" && rule.Scheme != target.scheme {
+		return false
+	}
+	if rule.Domain != "" {
+		if base, ok := strings.CutPrefix(rule.Domain, "*."); ok {
+			if target.host != base && !strings.HasSuffix(target.host, "."+base) {
+				return false
+			}
+		} else if target.host != rule.Domain {
+			return false
+		}
+	}
+	if rule.Extension != "" && rule.Extension != target.extension {
+		return false
+	}
+	if rule.re != nil && !rule.re.MatchString(target.raw) {
+		return false
+	}
+	return true
+}
+
+// DestinationPolicy decides which destinations links may point to. Rules
+// come from Settings.DestinationPolicyFile, then the database, then the
+// built-in rules, and destinations no rule matches get the default action.
+type DestinationPolicy struct {
+	mu           sync.RWMutex
+	rules        []PolicyRule
+	defaultAllow bool
+}
+
+// destinationPolicy is the policy normalizeDestination checks against. It
+// starts with the built-in rules until the server loads the configured ones.
+var destinationPolicy = newDestinationPolicy(nil, true)
+
+func newDestinationPolicy(rules []PolicyRule, defaultAllow bool) *DestinationPolicy {
+	policy := &DestinationPolicy{defaultAllow: defaultAllow}
+	for _, rule := range append(rules, builtinPolicyRules...) {
+		compiled, err := rule.compile()
+		if err == nil {
+			policy.rules = append(policy.rules, compiled)
+		}
+	}
+	return policy
+}
+
+// loadPolicyFile reads a JSON array of rules
+func loadPolicyFile(filename string) ([]PolicyRule, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var rules []PolicyRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return rules, nil
+}
+
+// reload replaces the rules with those in the policy file and the database.
+// The old rules stay in place if any rule is invalid.
+func (p *DestinationPolicy) reload(db *sql.DB) error {
+	var rules []PolicyRule
+	if config.DestinationPolicyFile != "" {
+		fileRules, err := loadPolicyFile(config.DestinationPolicyFile)
+		if err != nil {
+			return err
+		}
+		for _, rule := range fileRules {
+			rule.Source = config.DestinationPolicyFile
+			rules = append(rules, rule)
+		}
+	}
+	dbRules, err := queryPolicyRules(db)
+	if err != nil {
+		return err
+	}
+	rules = append(rules, dbRules...)
+	rules = append(rules, builtinPolicyRules...)
+
+	compiled := make([]PolicyRule, 0, len(rules))
+	for _, rule := range rules {
+		c, err := rule.compile()
+		if err != nil {
+			return fmt.Errorf("%s rule %s: %v", rule.Source, rule, err)
+		}
+		compiled = append(compiled, c)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rules = compiled
+	p.defaultAllow = config.DestinationPolicy != "deny"
+	return nil
+}
+
+// Rules returns the rules in the order they are checked
+func (p *DestinationPolicy) Rules() []PolicyRule {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return append([]PolicyRule(nil), p.rules...)
+}
+
+// check returns a PolicyError if a destination is not allowed. The scheme is
+// taken from the destination as entered, everything else from the URL it
+// becomes once https:// has been added.
+func (p *DestinationPolicy) check(destination string) error {
+	var target policyTarget
+	if u, err := url.Parse(destination); err == nil {
+		target.scheme = strings.ToLower(u.Scheme)
+	}
+	if target.scheme != "http" && target.scheme != "https" {
+		destination = "https://" + destination
+	}
+	target.raw = destination
+	if u, err := url.Parse(destination); err == nil {
+		target.host = strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+		target.extension = strings.ToLower(path.Ext(u.Path))
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, rule := range p.rules {
+		if !rule.matches(target) {
+			continue
+		}
+		if rule.Action == "allow" {
+			return nil
+		}
+		if rule.Reason != "" {
+			return PolicyError{Reason: rule.Reason}
+		}
+		return PolicyError{Reason: "blocked by the rule for " + rule.String()}
+	}
+	if !p.defaultAllow {
+		return PolicyError{Reason: "only approved destinations are allowed"}
+	}
+	return nil
+}
+
+// reloadPolicyOnSignal reloads the destination policy when the process
+// receives SIGHUP, e.g. after editing the policy file
+func reloadPolicyOnSignal(db *sql.DB) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			if err := destinationPolicy.reload(db); err != nil {
+				fmt.Println("Error reloading destination policy, keeping the old rules:", err)
+			} else {
+				fmt.Println("Reloaded destination policy")
+			}
+		}
+	}()
+}
+
+// PolicyHandler lets admins see the destination rules, add and delete rules
+// stored in the database, and reload the policy file
+type PolicyHandler struct {
+	db *sql.DB
+}
+
+// ServeHTTP implements the http.Handler interface
+func (h PolicyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var message string
+	switch r.Method {
+	case "GET":
+		if test := strings.TrimSpace(r.URL.Query().Get("test")); test != "" {
+			if _, err := normalizeDestination(test); err != nil {
+				message = test + ": " + err.Error()
+			} else {
+				message = test + " is allowed"
+			}
+		}
+	case "POST":
+		if err := h.update(r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := destinationPolicy.reload(h.db); err != nil {
+			http.Error(w, "Failed to reload policy: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/policy", http.StatusSeeOther)
+		return
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	page := struct {
+		Title     string
+		Rules     []PolicyRule
+		Default   string
+		File      string
+		Message   string
+		CSRFToken string
+	}{
+		Title:     "Destination Policy",
+		Rules:     destinationPolicy.Rules(),
+		Default:   "allow",
+		File:      config.DestinationPolicyFile,
+		Message:   message,
+		CSRFToken: csrfToken(w, r),
+	}
+	if config.DestinationPolicy == "deny" {
+		page.Default = "deny"
+	}
+
+	tmpl, err := template.ParseFiles("templates/policy.html")
+	if err != nil {
+		http.Error(w, "Failed to load template: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = tmpl.Execute(w, page)
+	if err != nil {
+		http.Error(w, "Failed to execute template: "+err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// update applies a form posted to the policy page. Reloading needs no
+// changes, the handler reloads after every post.
+func (h PolicyHandler) update(r *http.Request) error {
+	switch r.FormValue("action") {
+	case "reload":
+		return nil
+	case "delete":
+		id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+		if err != nil {
+			return errors.New("invalid rule")
+		}
+		return deletePolicyRule(h.db, id)
+	}
+
+	rule, err := PolicyRule{
+		Action:    r.FormValue("rule_action"),
+		Domain:    r.FormValue("domain"),
+		Scheme:    r.FormValue("scheme"),
+		Extension: r.FormValue("extension"),
+		Regex:     r.FormValue("regex"),
+		Reason:    r.FormValue("reason"),
+	}.compile()
+	if err != nil {
+		return err
+	}
+	_, err = createPolicyRule(h.db, rule)
+	return err
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestDestinationPolicy(t *testing.T) {
+	policy := newDestinationPolicy([]PolicyRule{
+		{Action: "allow", Domain: "safe.example.com"},
+		{Action: "deny", Domain: "*.example.org", Reason: "example.org is retired"},
+		{Action: "deny", Scheme: "http", Reason: "use https"},
+		{Action: "deny", Extension: "zip"},
+		{Action: "deny", Regex: `[?&]token=`, Reason: "links cannot carry tokens"},
+	}, true)
+
+	tests := []struct {
+		destination string
+		allowed     bool
+		reason      string
+	}{
+		{"https://example.com/data:report", true, ""},
+		{"example.com/page", true, ""},
+		{"javascript:alert(1)", false, "javascript: URLs are not allowed"},
+		{"JavaScript:alert(1)", false, "javascript: URLs are not allowed"},
+		{"https://example.com/setup.EXE", false, "links to executables are not allowed"},
+		{"https://safe.example.com/setup.exe", true, ""},
+		{"https://example.org/", false, "example.org is retired"},
+		{"https://www.example.org/", false, "example.org is retired"},
+		{"https://notexample.org/", true, ""},
+		{"http://example.com/", false, "use https"},
+		{"https://example.com/files/archive.zip", false, "extension .zip"},
+		{"https://example.com/?a=1&token=secret", false, "links cannot carry tokens"},
+	}
+	for _, tt := range tests {
+		err := policy.check(tt.destination)
+		if (err == nil) != tt.allowed {
+			t.Errorf("check(%q) = %v, want allowed %v", tt.destination, err, tt.allowed)
+			continue
+		}
+		if err != nil && !strings.Contains(err.Error(), tt.reason) {
+			t.Errorf("check(%q) = %q, want reason %q", tt.destination, err, tt.reason)
+		}
+	}
+
+	allowlist := newDestinationPolicy([]PolicyRule{{Action: "allow", Domain: "*.example.com"}}, false)
+	if err := allowlist.check("https://docs.example.com/"); err != nil {
+		t.Errorf("Expected allowlisted domain to be allowed, got %v", err)
+	}
+	if err := allowlist.check("https://example.net/"); err == nil {
+		t.Error("Expected unlisted domain to be denied")
+	}
+}
+
+func TestPolicyRuleCompile(t *testing.T) {
+	invalid := []PolicyRule{
+		{Action: "block", Domain: "example.com"},
+		{Action: "deny"},
+		{Action: "deny", Regex: "("},
+	}
+	for _, rule := range invalid {
+		if _, err := rule.compile(); err == nil {
+			t.Errorf("Expected %+v to be invalid", rule)
+		}
+	}
+}
+
+func TestPolicyReload(t *testing.T) {
+	db := setupTestDB(t)
+	db.Exec("DELETE FROM policy_rules")
+	defer db.Exec("DELETE FROM policy_rules")
+
+	oldFile, oldDefault := config.DestinationPolicyFile, config.DestinationPolicy
+	defer func() {
+		config.DestinationPolicyFile, config.DestinationPolicy = oldFile, oldDefault
+		destinationPolicy.reload(db)
+	}()
+
+	filename := filepath.Join(t.TempDir(), "policy.json")
+	os.WriteFile(filename, []byte(`[{"action": "deny", "domain": "*.blocked.example", "reason": "blocked by file"}]`), 0o644)
+	config.DestinationPolicyFile = filename
+	config.DestinationPolicy = "allow"
+	createPolicyRule(db, PolicyRule{Action: "deny", Domain: "db.example", Reason: "blocked by database"})
+
+	if err := destinationPolicy.reload(db); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	if _, err := normalizeDestination("https://www.blocked.example/"); err == nil || !strings.Contains(err.Error(), "blocked by file") {
+		t.Errorf("Expected file rule to apply, got %v", err)
+	}
+	if _, err := normalizeDestination("https://db.example/page"); err == nil || !strings.Contains(err.Error(), "blocked by database") {
+		t.Errorf("Expected database rule to apply, got %v", err)
+	}
+
+	// A broken file keeps the rules that were loaded
+	os.WriteFile(filename, []byte(`[{"action": "deny", "regex": "("}]`), 0o644)
+	if err := destinationPolicy.reload(db); err == nil {
+		t.Error("Expected reload with an invalid regex to fail")
+	}
+	if _, err := normalizeDestination("https://www.blocked.example/"); err == nil {
+		t.Error("Expected old rules to be kept after a failed reload")
+	}
+}
+
+func TestPolicyHandler(t *testing.T) {
+	db := setupTestDB(t)
+	db.Exec("DELETE FROM policy_rules")
+	defer db.Exec("DELETE FROM policy_rules")
+	defer destinationPolicy.reload(db)
+
+	handler := PolicyHandler{db: db}
+	post := func(form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/policy", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := post(url.Values{"rule_action": {"deny"}, "domain": {"*.handler.example"}, "reason": {"no handler links"}})
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("Expected 303 after adding a rule, got %d: %s", w.Code, w.Body.String())
+	}
+	if _, err := normalizeDestination("https://a.handler.example/"); err == nil || !strings.Contains(err.Error(), "no handler links") {
+		t.Errorf("Expected new rule to apply without a restart, got %v", err)
+	}
+
+	if w := post(url.Values{"rule_action": {"deny"}, "regex": {"("}}); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid regex, got %d", w.Code)
+	}
+
+	req := httptest.NewRequest("GET", "/policy?test=https://a.handler.example/", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "no handler links") {
+		t.Errorf("Expected policy page to explain the test result, got %d", w.Code)
+	}
+
+	rules, _ := queryPolicyRules(db)
+	if len(rules) != 1 {
+		t.Fatalf("Expected 1 database rule, got %d", len(rules))
+	}
+	post(url.Values{"action": {"delete"}, "id": {strconv.FormatInt(rules[0].ID, 10)}})
+	if _, err := normalizeDestination("https://a.handler.example/"); err != nil {
+		t.Errorf("Expected deleted rule to stop applying, got %v", err)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// parseNetworks parses CIDRs and single addresses, such as those of trusted
+// proxies or blocked networks
+func parseNetworks(entries []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if strings.Contains(entry, "/") {
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid network %q", entry)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", entry)
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+	}
+	return prefixes, nil
+}
+
+// trustedProxy reports whether an address belongs to a trusted proxy in
+// Settings.TrustedProxies
+func trustedProxy(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range config.trustedPrefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseForwardedAddr parses an address from X-Forwarded-For or the for=
+// parameter of Forwarded, which may carry quotes, brackets and a port
+func parseForwardedAddr(value string) (netip.Addr, bool) {
+	value = strings.Trim(strings.TrimSpace(value), `"`)
+	if host, _, err := net.SplitHostPort(value); err == nil {
+		value = host
+	}
+	addr, err := netip.ParseAddr(strings.Trim(value, "[]"))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+// forwardedFor returns the addresses a request passed through according to
+// the Forwarded header, or X-Forwarded-For if there is none, from the
+// original client to the last proxy. Entries that are not addresses, such as
+// "unknown" or obfuscated identifiers, are kept as empty strings.
+func forwardedFor(r *http.Request) []string {
+	var hops []string
+	if forwarded := r.Header.Values("Forwarded"); len(forwarded) > 0 {
+		for _, element := range strings.Split(strings.Join(forwarded, ","), ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(key, "for") {
+					hops = append(hops, value)
+				}
+			}
+		}
+		return hops
+	}
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	return hops
+}
+
+// clientIP returns the address of the client that sent a request. Requests
+// from trusted proxies are followed back through the addresses the proxies
+// added to Forwarded or X-Forwarded-For, up to the first address that is not
+// a trusted proxy, since clients can put anything in front of those.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	peer, ok := parseForwardedAddr(host)
+	if !ok || !trustedProxy(peer) {
+		return host
+	}
+
+	client := peer
+	hops := forwardedFor(r)
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, ok := parseForwardedAddr(hops[i])
+		if !ok {
+			// The proxy did not know the address before it
+			break
+		}
+		client = addr
+		if !trustedProxy(addr) {
+			break
+		}
+	}
+	return client.String()
+}
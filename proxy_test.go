@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	config.TrustedProxies = []string{"10.0.0.0/8", "192.0.2.1"}
+	config.parseNetworkSettings()
+	defer func() {
+		config.TrustedProxies = nil
+		config.parseNetworkSettings()
+	}()
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		want       string
+	}{
+		{"direct", "203.0.113.5:1234", nil, "203.0.113.5"},
+		{"untrusted peer", "203.0.113.5:1234", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "203.0.113.5"},
+		{"trusted proxy", "10.0.0.2:1234", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "198.51.100.1"},
+		{"chain of proxies", "10.0.0.2:1234", map[string]string{"X-Forwarded-For": "198.51.100.1, 192.0.2.1"}, "198.51.100.1"},
+		{"spoofed entry", "10.0.0.2:1234", map[string]string{"X-Forwarded-For": "1.2.3.4, 198.51.100.1"}, "198.51.100.1"},
+		{"no header", "10.0.0.2:1234", nil, "10.0.0.2"},
+		{"forwarded", "10.0.0.2:1234", map[string]string{"Forwarded": `for=198.51.100.1;proto=https, for="[2001:db8::17]:4711"`}, "2001:db8::17"},
+		{"forwarded wins", "10.0.0.2:1234", map[string]string{"Forwarded": "for=198.51.100.1", "X-Forwarded-For": "198.51.100.2"}, "198.51.100.1"},
+		{"unknown hop", "10.0.0.2:1234", map[string]string{"Forwarded": "for=198.51.100.1, for=unknown"}, "10.0.0.2"},
+		{"ipv6 peer", "[2001:db8::1]:1234", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tt.remoteAddr
+		for key, value := range tt.headers {
+			req.Header.Set(key, value)
+		}
+		if got := clientIP(req); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+
+	if _, err := parseNetworks([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("Expected an invalid CIDR to fail")
+	}
+}
+
+func TestClickClientIP(t *testing.T) {
+	db := setupTestDB(t)
+	cache, _ := createCache(10)
+	config.TrustedProxies = []string{"10.0.0.0/8"}
+	config.parseNetworkSettings()
+	defer func() {
+		config.TrustedProxies = nil
+		config.parseNetworkSettings()
+	}()
+
+	short := "proxied1"
+	deleteURL(db, 0, short)
+	createURL(db, "https://proxied.example.com", short, "127.0.0.1")
+
+	req := httptest.NewRequest("GET", "/q/"+short, nil)
+	req.RemoteAddr = "10.1.2.3:5555"
+	req.Header.Set("X-Forwarded-For", "198.51.100.23")
+	w := httptest.NewRecorder()
+	QueryHandler{db: db, cache: cache}.ServeHTTP(w, req)
+	if w.Code != http.StatusMovedPermanently {
+		t.Fatalf("Expected redirect, got %d", w.Code)
+	}
+
+	var ip string
+	db.QueryRow("SELECT client_ip FROM clicks WHERE short = ?", short).Scan(&ip)
+	if ip != "198.51.100.23" {
+		t.Errorf("Expected click from the forwarded client, got %q", ip)
+	}
+}
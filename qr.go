@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// QRHandler serves QR codes for the short URL of a link
+type QRHandler struct {
+	db *sql.DB
+}
+
+// QROptions controls how a QR code is rendered
+type QROptions struct {
+	Format string
+	Size   int
+	Margin int
+	Level  qrcode.RecoveryLevel
+}
+
+const (
+	qrDefaultSize   = 256
+	qrMaxSize       = 2048
+	qrDefaultMargin = 4
+	qrMaxMargin     = 16
+)
+
+var qrLevels = map[string]qrcode.RecoveryLevel{
+	"L": qrcode.Low,
+	"M": qrcode.Medium,
+	"Q": qrcode.High,
+	"H": qrcode.Highest,
+}
+
+// parseQROptions reads the format, size in pixels, margin in modules and
+// error correction level (L, M, Q or H) from query parameters
+func parseQROptions(query map[string][]string) (QROptions, error) {
+	get := func(key string) string {
+		if values := query[key]; len(values) > 0 {
+			return strings.TrimSpace(values[0])
+		}
+		return ""
+	}
+	options := QROptions{Format: "png", Size: qrDefaultSize, Margin: qrDefaultMargin, Level: qrcode.Medium}
+
+	if format := strings.ToLower(get("format")); format != "" {
+		if format != "png" && format != "svg" {
+			return QROptions{}, fmt.Errorf("unsupported format %q", format)
+		}
+		options.Format = format
+	}
+	if size := get("size"); size != "" {
+		s, err := strconv.Atoi(size)
+		if err != nil || s < 1 || s > qrMaxSize {
+			return QROptions{}, fmt.Errorf("size must be between 1 and %d", qrMaxSize)
+		}
+		options.Size = s
+	}
+	if margin := get("margin"); margin != "" {
+		m, err := strconv.Atoi(margin)
+		if err != nil || m < 0 || m > qrMaxMargin {
+			return QROptions{}, fmt.Errorf("margin must be between 0 and %d", qrMaxMargin)
+		}
+		options.Margin = m
+	}
+	if level := strings.ToUpper(get("level")); level != "" {
+		l, ok := qrLevels[level]
+		if !ok {
+			return QROptions{}, fmt.Errorf("level must be one of L, M, Q or H")
+		}
+		options.Level = l
+	}
+	return options, nil
+}
+
+// ServeHTTP implements the http.Handler interface for /qr/<short-code>
+func (h QRHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var link URL
+	domainID, shortURL, err := pathLink(r, "/qr/")
+	if err == nil {
+		link, err = queryShortURL(h.db, domainID, shortURL)
+	}
+	if err != nil || !requestAuth(r).canView(link) {
+		http.NotFound(w, r)
+		return
+	}
+
+	options, err := parseQROptions(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	modules, err := qrModules(link.ShortURL(), options.Level)
+	if err != nil {
+		http.Error(w, "Failed to encode QR code", http.StatusInternalServerError)
+		return
+	}
+
+	var body []byte
+	if options.Format == "svg" {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		body = renderQRSVG(modules, options)
+	} else {
+		body, err = renderQRPNG(modules, options)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+	}
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	w.Write(body)
+}
+
+// qrModules encodes content as a QR code without its quiet zone, so the
+// margin can be chosen by the caller
+func qrModules(content string, level qrcode.RecoveryLevel) ([][]bool, error) {
+	code, err := qrcode.New(content, level)
+	if err != nil {
+		return nil, err
+	}
+	code.DisableBorder = true
+	return code.Bitmap(), nil
+}
+
+// renderQRPNG draws the modules as a square PNG of the requested size. Modules
+// are scaled by a whole number of pixels to stay sharp, and the code is
+// centered in any space left over.
+func renderQRPNG(modules [][]bool, options QROptions) ([]byte, error) {
+	total := len(modules) + 2*options.Margin
+	scale := options.Size / total
+	if scale < 1 {
+		return nil, fmt.Errorf("size must be at least %d for this code", total)
+	}
+	offset := (options.Size-scale*total)/2 + options.Margin*scale
+
+	img := image.NewPaletted(image.Rect(0, 0, options.Size, options.Size), color.Palette{color.White, color.Black})
+	for y, row := range modules {
+		for x, dark := range row {
+			if !dark {
+				continue
+			}
+			for dy := 0; dy < scale; dy++ {
+				for dx := 0; dx < scale; dx++ {
+					img.SetColorIndex(offset+x*scale+dx, offset+y*scale+dy, 1)
+				}
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// renderQRSVG draws the modules as a single SVG path, merging horizontal runs
+// of dark modules, in a view box measured in modules
+func renderQRSVG(modules [][]bool, options QROptions) []byte {
+	total := len(modules) + 2*options.Margin
+	var path strings.Builder
+	for y, row := range modules {
+		for x := 0; x < len(row); x++ {
+			if !row[x] {
+				continue
+			}
+			start := x
+			for x < len(row) && row[x] {
+				x++
+			}
+			fmt.Fprintf(&path, "M%d %dh%dv1h-%dz", start+options.Margin, y+options.Margin, x-start, x-start)
+		}
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`,
+		options.Size, options.Size, total, total)
+	fmt.Fprintf(&buf, `<rect width="%d" height="%d" fill="#fff"/><path d="%s" fill="#000"/></svg>`, total, total, path.String())
+	return buf.Bytes()
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/skip2/go-qrcode"
+)
+
+func TestParseQROptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		want    QROptions
+		wantErr bool
+	}{
+		{"Defaults", "", QROptions{Format: "png", Size: 256, Margin: 4, Level: qrcode.Medium}, false},
+		{"All options", "format=SVG&size=512&margin=0&level=h", QROptions{Format: "svg", Size: 512, Margin: 0, Level: qrcode.Highest}, false},
+		{"Unknown format", "format=gif", QROptions{}, true},
+		{"Size too large", "size=5000", QROptions{}, true},
+		{"Negative margin", "margin=-1", QROptions{}, true},
+		{"Unknown level", "level=X", QROptions{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, _ := url.ParseQuery(tt.query)
+			got, err := parseQROptions(query)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseQROptions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseQROptions() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQRHandler(t *testing.T) {
+	db := setupTestDB(t)
+	handler := QRHandler{db: db}
+	createURL(db, "https://events.example.com/signup", "qrcode01", "127.0.0.1")
+
+	tests := []struct {
+		name            string
+		path            string
+		wantStatus      int
+		wantContentType string
+	}{
+		{"PNG", "/qr/qrcode01?size=300", http.StatusOK, "image/png"},
+		{"SVG", "/qr/qrcode01?format=svg&margin=2&level=Q", http.StatusOK, "image/svg+xml"},
+		{"Size too small", "/qr/qrcode01?size=10", http.StatusBadRequest, ""},
+		{"Invalid level", "/qr/qrcode01?level=Z", http.StatusBadRequest, ""},
+		{"Missing", "/qr/missing", http.StatusNotFound, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.path, nil)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("Expected status code %d, got %d", tt.wantStatus, w.Code)
+			}
+			if tt.wantContentType != "" && w.Header().Get("Content-Type") != tt.wantContentType {
+				t.Errorf("Expected content type %s, got %s", tt.wantContentType, w.Header().Get("Content-Type"))
+			}
+		})
+	}
+
+	req := httptest.NewRequest("GET", "/qr/qrcode01?size=300", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	img, err := png.Decode(bytes.NewReader(w.Body.Bytes()))
+	if err != nil {
+		t.Fatalf("Failed to decode PNG: %v", err)
+	}
+	if bounds := img.Bounds(); bounds.Dx() != 300 || bounds.Dy() != 300 {
+		t.Errorf("Expected a 300x300 image, got %dx%d", bounds.Dx(), bounds.Dy())
+	}
+	if r, _, _, _ := img.At(0, 0).RGBA(); r == 0 {
+		t.Error("Expected the margin to be white")
+	}
+}
+
+func TestRenderQRSVG(t *testing.T) {
+	modules, err := qrModules(URL{Short: "abc12345"}.ShortURL(), qrcode.Medium)
+	if err != nil {
+		t.Fatalf("qrModules failed: %v", err)
+	}
+	// Versions grow in steps of four modules from 21 modules wide
+	if len(modules) != len(modules[0]) || (len(modules)-21)%4 != 0 {
+		t.Fatalf("Unexpected symbol size %dx%d", len(modules[0]), len(modules))
+	}
+
+	svg := string(renderQRSVG(modules, QROptions{Size: 200, Margin: 1}))
+	viewBox := fmt.Sprintf(`viewBox="0 0 %d %d"`, len(modules)+2, len(modules)+2)
+	if !strings.Contains(svg, `width="200"`) || !strings.Contains(svg, viewBox) {
+		t.Errorf("Unexpected SVG dimensions: %s", svg[:120])
+	}
+	// The top left finder pattern starts with a run of seven dark modules
+	if !strings.Contains(svg, "M1 1h7v1h-7z") {
+		t.Error("Expected the finder pattern in the SVG path")
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RateLimit is a token bucket: clients can make Burst requests at once, and
+// the bucket refills at PerMinute requests per minute. A PerMinute of 0
+// disables the limit.
+type RateLimit struct {
+	PerMinute int `json:"per_minute"`
+	Burst     int `json:"burst"`
+}
+
+// perSecond returns the refill rate of the bucket
+func (l RateLimit) perSecond() float64 {
+	return float64(l.PerMinute) / 60
+}
+
+// capacity returns the size of the bucket, at least one request
+func (l RateLimit) capacity() float64 {
+	return math.Max(1, float64(l.Burst))
+}
+
+// RateLimitStore keeps the token buckets of all clients
+type RateLimitStore interface {
+	// take removes a token from a bucket, or reports how long the client has
+	// to wait for the next one
+	take(key string, limit RateLimit, now time.Time) (bool, time.Duration, error)
+}
+
+// newRateLimitStore returns the store named by Settings.RateLimitStore. The
+// memory store is enough for a single server, replicas share buckets in Redis.
+func newRateLimitStore(kind string, cache *Cache) RateLimitStore {
+	if kind == "redis" && cache != nil {
+		return redisBuckets{rdb: cache.rdb}
+	}
+	return newMemoryBuckets()
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// memoryBuckets keeps token buckets in memory
+type memoryBuckets struct {
+	mu        sync.Mutex
+	buckets   map[string]bucket
+	lastSweep time.Time
+}
+
+func newMemoryBuckets() *memoryBuckets {
+	return &memoryBuckets{buckets: make(map[string]bucket)}
+}
+
+// refill returns a bucket with the tokens added since it was last updated
+func refill(b bucket, limit RateLimit, now time.Time) bucket {
+	elapsed := now.Sub(b.updated).Seconds()
+	b.tokens = math.Min(limit.capacity(), b.tokens+elapsed*limit.perSecond())
+	b.updated = now
+	return b
+}
+
+func (m *memoryBuckets) take(key string, limit RateLimit, now time.Time) (bool, time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Forget clients that have been quiet for a while, their buckets are full
+	if now.Sub(m.lastSweep) > time.Minute {
+		for k, b := range m.buckets {
+			if refill(b, limit, now).tokens >= limit.capacity() {
+				delete(m.buckets, k)
+			}
+		}
+		m.lastSweep = now
+	}
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = bucket{tokens: limit.capacity(), updated: now}
+	}
+	b = refill(b, limit, now)
+	if b.tokens < 1 {
+		m.buckets[key] = b
+		wait := time.Duration((1 - b.tokens) / limit.perSecond() * float64(time.Second))
+		return false, wait, nil
+	}
+	b.tokens--
+	m.buckets[key] = b
+	return true, 0, nil
+}
+
+// takeScript refills and takes from a bucket stored as a Redis hash in one
+// step, so that replicas do not race each other. It returns 1 or 0 for
+// whether a token was taken and the milliseconds to wait otherwise.
+var takeScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local capacity = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local state = redis.call("HMGET", KEYS[1], "tokens", "updated")
+local tokens = tonumber(state[1]) or capacity
+local updated = tonumber(state[2]) or now
+tokens = math.min(capacity, tokens + math.max(0, now - updated) / 1000 * rate)
+local allowed = 0
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	wait = math.ceil((1 - tokens) / rate * 1000)
+end
+redis.call("HSET", KEYS[1], "tokens", tokens, "updated", now)
+redis.call("PEXPIRE", KEYS[1], math.ceil(capacity / rate * 1000))
+return {allowed, wait}
+`)
+
+// redisBuckets keeps token buckets in Redis, shared by all replicas
+type redisBuckets struct {
+	rdb *redis.Client
+}
+
+func (s redisBuckets) take(key string, limit RateLimit, now time.Time) (bool, time.Duration, error) {
+	result, err := takeScript.Run(context.Background(), s.rdb, []string{"ratelimit:" + key},
+		limit.perSecond(), limit.capacity(), now.UnixMilli()).Int64Slice()
+	if err != nil {
+		return false, 0, err
+	}
+	if len(result) != 2 {
+		return false, 0, fmt.Errorf("unexpected rate limit result %v", result)
+	}
+	return result[0] == 1, time.Duration(result[1]) * time.Millisecond, nil
+}
+
+// RateLimiter rejects requests from clients that used up their budget with
+// 429 Too Many Requests. Requests with an API key are limited per key, all
+// others per client IP. Wrap it in Auth so that API keys are known.
+type RateLimiter struct {
+	store RateLimitStore
+	// name keeps the buckets of different budgets apart
+	name  string
+	limit RateLimit
+	next  http.Handler
+}
+
+// ServeHTTP implements the http.Handler interface
+func (l RateLimiter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if l.limit.PerMinute <= 0 {
+		l.next.ServeHTTP(w, r)
+		return
+	}
+
+	key := l.name + ":ip:" + clientIP(r)
+	if id := requestAuth(r).key.ID; id != 0 {
+		key = l.name + ":key:" + strconv.FormatInt(id, 10)
+	}
+	ok, wait, err := l.store.take(key, l.limit, time.Now())
+	if err != nil {
+		// A broken store should not take the service down with it
+		if config.EnableLogging {
+			fmt.Println("Error checking rate limit:", err)
+		}
+		ok = true
+	}
+	if !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, "Too many requests, please try again later", http.StatusTooManyRequests)
+		return
+	}
+	l.next.ServeHTTP(w, r)
+}
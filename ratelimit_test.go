@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMemoryBuckets(t *testing.T) {
+	store := newMemoryBuckets()
+	limit := RateLimit{PerMinute: 60, Burst: 3}
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if ok, _, _ := store.take("client", limit, now); !ok {
+			t.Fatalf("Expected request %d of the burst to pass", i+1)
+		}
+	}
+	ok, wait, _ := store.take("client", limit, now)
+	if ok || wait <= 0 || wait > time.Second {
+		t.Fatalf("Expected to wait up to a second after the burst, got %v, %v", ok, wait)
+	}
+	if ok, _, _ := store.take("other", limit, now); !ok {
+		t.Error("Expected other clients to have their own bucket")
+	}
+
+	// One token per second refills
+	if ok, _, _ := store.take("client", limit, now.Add(time.Second)); !ok {
+		t.Error("Expected a token after a second")
+	}
+	if ok, _, _ := store.take("client", limit, now.Add(time.Second)); ok {
+		t.Error("Expected only one token after a second")
+	}
+	for i := 0; i < 3; i++ {
+		if ok, _, _ := store.take("client", limit, now.Add(time.Hour)); !ok {
+			t.Errorf("Expected a full bucket after an hour, request %d failed", i+1)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	db := setupTestDB(t)
+	db.Exec("DELETE FROM api_keys")
+	_, token, _ := createAPIKey(db, "limited", 0, []string{scopeLinksRead, scopeLinksWrite}, time.Time{})
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	limiter := RateLimiter{store: newMemoryBuckets(), name: "create", limit: RateLimit{PerMinute: 1, Burst: 2}, next: next}
+	handler := Auth{db: db, read: scopeLinksRead, write: scopeLinksWrite, next: limiter}
+	request := func(remoteAddr string, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/s", nil)
+		req.RemoteAddr = remoteAddr
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	request("198.51.100.7:1000", "")
+	request("198.51.100.7:1001", "")
+	w := request("198.51.100.7:1002", "")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429 after the burst, got %d", w.Code)
+	}
+	if retry := w.Header().Get("Retry-After"); retry == "" || retry == "0" {
+		t.Errorf("Expected a Retry-After header, got %q", retry)
+	}
+	if w := request("198.51.100.8:1000", ""); w.Code != http.StatusOK {
+		t.Errorf("Expected another IP to pass, got %d", w.Code)
+	}
+
+	// API keys have their own budget wherever they come from
+	if w := request("198.51.100.7:1003", token); w.Code != http.StatusOK {
+		t.Errorf("Expected API key to have its own budget, got %d", w.Code)
+	}
+	request("198.51.100.9:1000", token)
+	if w := request("198.51.100.10:1000", token); w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected API key to be limited across IPs, got %d", w.Code)
+	}
+
+	unlimited := RateLimiter{store: newMemoryBuckets(), name: "create", next: next}
+	for i := 0; i < 5; i++ {
+		w := httptest.NewRecorder()
+		unlimited.ServeHTTP(w, httptest.NewRequest("POST", "/s", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected no limit when per_minute is 0, got %d", w.Code)
+		}
+	}
+}
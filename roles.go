@@ -0,0 +1,93 @@
+package main
+
+// Roles of users, from least to most privileged. Viewers can look at their
+// own links, editors can also create and change them, and admins can see and
+// change every link, manage users and API keys, and purge data.
+const (
+	roleViewer = "viewer"
+	roleEditor = "editor"
+	roleAdmin  = "admin"
+)
+
+var roleRanks = map[string]int{
+	roleViewer: 1,
+	roleEditor: 2,
+	roleAdmin:  3,
+}
+
+var roles = []string{roleViewer, roleEditor, roleAdmin}
+
+func validRole(role string) bool {
+	return roleRanks[role] != 0
+}
+
+// userRole returns the role of a user, who has the default role until one
+// is assigned
+func userRole(user User) string {
+	if validRole(user.Role) {
+		return user.Role
+	}
+	return config.DefaultRole
+}
+
+// scopeRole returns the least role a user needs for what a scope allows
+func scopeRole(scope string) string {
+	switch scope {
+	case scopeLinksRead:
+		return roleViewer
+	case scopeLinksWrite:
+		return roleEditor
+	}
+	return roleAdmin
+}
+
+// role returns the role a request acts with. API keys act with the role of
+// their user, and keys without a user are only limited by their scopes.
+// Anonymous visitors can only use the service when authentication is not
+// required, and then share the links nobody owns as editors.
+func (a authInfo) role() string {
+	switch {
+	case a.user.ID != 0:
+		return userRole(a.user)
+	case a.key.ID != 0 && a.key.UserID != 0:
+		return userRole(User{Role: a.key.OwnerRole})
+	case a.key.ID != 0:
+		return roleAdmin
+	case !config.RequireAuth:
+		return roleEditor
+	}
+	return ""
+}
+
+// atLeast reports whether a request has a role at least as privileged as the given one
+func (a authInfo) atLeast(role string) bool {
+	return roleRanks[a.role()] >= roleRanks[role]
+}
+
+// canView reports whether a request may see a link and its stats. Links in
+// a workspace are shared by its members while they work in it, other links
+// are only seen by their owner.
+func (a authInfo) canView(link URL) bool {
+	switch {
+	case a.atLeast(roleAdmin):
+		return true
+	case !a.atLeast(roleViewer) || link.WorkspaceID != a.workspace.ID:
+		return false
+	}
+	return link.WorkspaceID != 0 || link.OwnerID == a.ownerID()
+}
+
+// canModify reports whether a request may change a link
+func (a authInfo) canModify(link URL) bool {
+	return a.canView(link) && a.atLeast(roleEditor)
+}
+
+// withPermissions marks which links a request may edit and purge, for the
+// buttons on each row
+func (a authInfo) withPermissions(urls []URL) []URL {
+	for i := range urls {
+		urls[i].CanEdit = a.canModify(urls[i])
+		urls[i].CanPurge = a.atLeast(roleAdmin)
+	}
+	return urls
+}
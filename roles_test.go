@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRoles(t *testing.T) {
+	tests := []struct {
+		name string
+		auth authInfo
+		want string
+	}{
+		{"anonymous", authInfo{}, roleEditor},
+		{"default role", authInfo{user: User{ID: 1}}, config.DefaultRole},
+		{"assigned role", authInfo{user: User{ID: 1, Role: roleViewer}}, roleViewer},
+		{"key of a user", authInfo{key: APIKey{ID: 1, UserID: 1, OwnerRole: roleAdmin}}, roleAdmin},
+		{"key without a user", authInfo{key: APIKey{ID: 1}}, roleAdmin},
+	}
+	for _, tt := range tests {
+		if got := tt.auth.role(); got != tt.want {
+			t.Errorf("%s: got role %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	link := URL{OwnerID: 1}
+	viewer := authInfo{user: User{ID: 1, Role: roleViewer}}
+	if !viewer.canView(link) || viewer.canModify(link) {
+		t.Error("Expected viewers to see but not change their own links")
+	}
+	editor := authInfo{user: User{ID: 2, Role: roleEditor}}
+	if editor.canView(link) || editor.canModify(link) {
+		t.Error("Expected editors to be kept from links of other users")
+	}
+	admin := authInfo{user: User{ID: 3, Role: roleAdmin}}
+	if !admin.canModify(link) {
+		t.Error("Expected admins to change every link")
+	}
+	if (authInfo{}).canView(link) {
+		t.Error("Expected anonymous visitors to be kept from owned links")
+	}
+}
+
+func TestLinkPermissions(t *testing.T) {
+	db := setupTestDB(t)
+	cache, _ := createCache(10)
+	owner := createTestUser(t, "permowner", "hunter2hunter2")
+	createTestUser(t, "permother", "hunter2hunter2")
+	viewer := createTestUser(t, "permviewer", "hunter2hunter2")
+	updateUserRole(db, viewer.ID, roleViewer)
+	ownerSession := login(t, "permowner", "hunter2hunter2")
+	otherSession := login(t, "permother", "hunter2hunter2")
+	viewerSession := login(t, "permviewer", "hunter2hunter2")
+
+	short := "permlink"
+	deleteURL(db, 0, short)
+	createURL(db, "https://perm.example.com", short, "127.0.0.1")
+	updateURLOwner(db, 0, short, owner.ID)
+	viewerShort := "permview"
+	deleteURL(db, 0, viewerShort)
+	createURL(db, "https://view.example.com", viewerShort, "127.0.0.1")
+	updateURLOwner(db, 0, viewerShort, viewer.ID)
+
+	edit := Auth{db: db, read: scopeLinksRead, write: scopeLinksWrite, next: EditHandler{db: db, cache: cache}}
+	stats := Auth{db: db, read: scopeLinksRead, write: scopeLinksWrite, next: StatsHandler{db: db}}
+	qr := Auth{db: db, read: scopeLinksRead, write: scopeLinksWrite, next: QRHandler{db: db}}
+	do := func(h http.Handler, method string, path string, cookie *http.Cookie) int {
+		req := httptest.NewRequest(method, path, strings.NewReader("notes=changed"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	tests := []struct {
+		name    string
+		handler http.Handler
+		method  string
+		path    string
+		cookie  *http.Cookie
+		want    int
+	}{
+		{"owner edits", edit, "POST", "/edit/" + short, ownerSession, http.StatusOK},
+		{"other user edits", edit, "POST", "/edit/" + short, otherSession, http.StatusNotFound},
+		{"other user opens editor", edit, "GET", "/edit/" + short, otherSession, http.StatusNotFound},
+		{"viewer edits own link", edit, "POST", "/edit/" + viewerShort, viewerSession, http.StatusForbidden},
+		{"owner stats", stats, "GET", "/stats/" + short, ownerSession, http.StatusOK},
+		{"other user stats", stats, "GET", "/stats/" + short, otherSession, http.StatusNotFound},
+		{"viewer stats", stats, "GET", "/stats/" + viewerShort, viewerSession, http.StatusOK},
+		{"owner QR code", qr, "GET", "/qr/" + short, ownerSession, http.StatusOK},
+		{"other user QR code", qr, "GET", "/qr/" + short, otherSession, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if got := do(tt.handler, tt.method, tt.path, tt.cookie); got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, got, tt.want)
+		}
+	}
+
+	// Viewers cannot create links at all
+	create := Auth{db: db, read: scopeLinksRead, write: scopeLinksWrite, next: URLFormHandler{db: db, cache: cache}}
+	if got := do(create, "POST", "/create", viewerSession); got != http.StatusForbidden {
+		t.Errorf("Expected viewer to be refused creating links, got %d", got)
+	}
+}
+
+func TestPurgeAndUsers(t *testing.T) {
+	db := setupTestDB(t)
+	cache, _ := createCache(10)
+	admin := createTestUser(t, "purgeadmin", "hunter2hunter2")
+	updateUserRole(db, admin.ID, roleAdmin)
+	createTestUser(t, "purgeeditor", "hunter2hunter2")
+	adminSession := login(t, "purgeadmin", "hunter2hunter2")
+	editorSession := login(t, "purgeeditor", "hunter2hunter2")
+	deleteUser(db, "newviewer")
+
+	short := "purgeme1"
+	deleteURL(db, 0, short)
+	createURL(db, "https://purge.example.com", short, "127.0.0.1")
+	db.Exec("INSERT INTO clicks (short, clicked_at) VALUES (?, CURRENT_TIMESTAMP)", short)
+
+	purge := Auth{db: db, read: scopeKeysAdmin, write: scopeKeysAdmin, next: PurgeHandler{db: db, cache: cache}}
+	users := Auth{db: db, read: scopeKeysAdmin, write: scopeKeysAdmin, next: UsersHandler{db: db}}
+	do := func(h http.Handler, method string, path string, form url.Values, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := do(purge, "POST", "/purge/"+short, nil, editorSession); w.Code != http.StatusForbidden {
+		t.Errorf("Expected editor to be refused purging, got %d", w.Code)
+	}
+	if w := do(purge, "POST", "/purge/"+short, nil, adminSession); w.Code != http.StatusOK {
+		t.Fatalf("Expected purge to succeed, got %d", w.Code)
+	}
+	if _, err := queryShortURL(db, 0, short); err == nil {
+		t.Error("Expected purged link to be gone")
+	}
+	var clicks int
+	db.QueryRow("SELECT COUNT(*) FROM clicks WHERE short = ?", short).Scan(&clicks)
+	if clicks != 0 {
+		t.Errorf("Expected clicks to be purged, got %d", clicks)
+	}
+	if w := do(purge, "POST", "/purge/"+short, nil, adminSession); w.Code != http.StatusNotFound {
+		t.Errorf("Expected purging a missing link to return 404, got %d", w.Code)
+	}
+
+	if w := do(users, "GET", "/users", nil, editorSession); w.Code != http.StatusForbidden {
+		t.Errorf("Expected editor to be refused the users page, got %d", w.Code)
+	}
+	form := url.Values{"username": {"newviewer"}, "password": {"long enough"}, "role": {roleViewer}}
+	if w := do(users, "POST", "/users", form, adminSession); w.Code != http.StatusSeeOther {
+		t.Fatalf("Expected user to be created, got %d: %s", w.Code, w.Body.String())
+	}
+	created, _, err := queryUserByName(db, "newviewer")
+	if err != nil || created.Role != roleViewer {
+		t.Fatalf("Expected new viewer, got %+v, %v", created, err)
+	}
+
+	form = url.Values{"action": {"role"}, "id": {fmt.Sprint(created.ID)}, "role": {roleEditor}}
+	do(users, "POST", "/users", form, adminSession)
+	if user, _, _ := queryUserByName(db, "newviewer"); user.Role != roleEditor {
+		t.Errorf("Expected role to change to editor, got %q", user.Role)
+	}
+	form = url.Values{"action": {"role"}, "id": {fmt.Sprint(admin.ID)}, "role": {roleViewer}}
+	if w := do(users, "POST", "/users", form, adminSession); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected admin to be kept from demoting themselves, got %d", w.Code)
+	}
+
+	if w := do(users, "GET", "/users", nil, adminSession); !strings.Contains(w.Body.String(), "newviewer") {
+		t.Error("Expected new user on the users page")
+	}
+	do(users, "POST", "/users", url.Values{"action": {"delete"}, "username": {"newviewer"}}, adminSession)
+	if _, _, err := queryUserByName(db, "newviewer"); err == nil {
+		t.Error("Expected user to be deleted")
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// notBeforeLayout is the format of datetime-local inputs, which carry no
+// time zone and are read in the server's local time
+const notBeforeLayout = "2006-01-02T15:04"
+
+// parseNotBefore reads an activation time from a form value. An empty value
+// means the link is active immediately.
+func parseNotBefore(value string) (time.Time, error) {
+	return parseScheduleTime(value, "activation time")
+}
+
+// parseNotAfter reads an expiry time from a form value. An empty value means
+// the link never expires.
+func parseNotAfter(value string) (time.Time, error) {
+	return parseScheduleTime(value, "expiry time")
+}
+
+func parseScheduleTime(value string, name string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation(notBeforeLayout, value, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s %q", name, value)
+	}
+	return t, nil
+}
+
+// Active reports whether a link redirects at the given time, which has to be
+// within its activation window
+func (u URL) Active(now time.Time) bool {
+	return (u.NotBefore.IsZero() || !now.Before(u.NotBefore)) && !u.expiredAt(now)
+}
+
+// expiredAt reports whether the expiry time of a link has passed at the given time
+func (u URL) expiredAt(now time.Time) bool {
+	return !u.NotAfter.IsZero() && !now.Before(u.NotAfter)
+}
+
+// Scheduled reports whether a link is still waiting for its activation time
+func (u URL) Scheduled() bool {
+	return !u.NotBefore.IsZero() && time.Now().Before(u.NotBefore)
+}
+
+// Expired reports whether a link is past its expiry time
+func (u URL) Expired() bool {
+	return u.expiredAt(time.Now())
+}
+
+// NotBeforeInput formats the activation time for a datetime-local input
+func (u URL) NotBeforeInput() string {
+	if u.NotBefore.IsZero() {
+		return ""
+	}
+	return u.NotBefore.In(time.Local).Format(notBeforeLayout)
+}
+
+// NotAfterInput formats the expiry time for a datetime-local input
+func (u URL) NotAfterInput() string {
+	if u.NotAfter.IsZero() {
+		return ""
+	}
+	return u.NotAfter.In(time.Local).Format(notBeforeLayout)
+}
+
+// renderComingSoon shows the configured "coming soon" page for a link that is
+// not active yet. Only the short code and activation time are passed to the
+// template so the destination is not revealed early.
+func renderComingSoon(w http.ResponseWriter, link URL) {
+	tmpl, err := template.ParseFiles(config.ComingSoonTemplate)
+	if err != nil {
+		http.Error(w, "Failed to load template: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	page := struct {
+		Short     string
+		NotBefore time.Time
+	}{
+		Short:     link.Short,
+		NotBefore: link.NotBefore,
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(link.NotBefore).Seconds())+1))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	err = tmpl.Execute(w, page)
+	if err != nil {
+		http.Error(w, "Failed to execute template: "+err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// renderExpired tells visitors that a link is past its expiry time, without
+// revealing its destination
+func renderExpired(w http.ResponseWriter) {
+	tmpl, err := template.ParseFiles("templates/expired.html")
+	if err != nil {
+		http.Error(w, "Failed to load template: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusGone)
+	err = tmpl.Execute(w, nil)
+	if err != nil {
+		http.Error(w, "Failed to execute template: "+err.Error(), http.StatusInternalServerError)
+	}
+}
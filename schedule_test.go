@@ -0,0 +1,153 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseNotBefore(t *testing.T) {
+	local := time.Date(2030, 5, 1, 9, 30, 0, 0, time.Local)
+
+	tests := []struct {
+		name    string
+		value   string
+		want    time.Time
+		wantErr bool
+	}{
+		{"Empty", "", time.Time{}, false},
+		{"Datetime local", "2030-05-01T09:30", local, false},
+		{"RFC 3339", "2030-05-01T09:30:00Z", time.Date(2030, 5, 1, 9, 30, 0, 0, time.UTC), false},
+		{"Invalid", "next tuesday", time.Time{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseNotBefore(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseNotBefore() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("parseNotBefore() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestURLActive(t *testing.T) {
+	now := time.Now()
+	if !(URL{}).Active(now) {
+		t.Error("Expected link without activation time to be active")
+	}
+	if (URL{NotBefore: now.Add(time.Hour)}).Active(now) {
+		t.Error("Expected link activating in an hour to be inactive")
+	}
+	if !(URL{NotBefore: now}).Active(now) {
+		t.Error("Expected link to be active at its activation time")
+	}
+	if !(URL{NotAfter: now.Add(time.Hour)}).Active(now) {
+		t.Error("Expected link expiring in an hour to be active")
+	}
+	if (URL{NotBefore: now.Add(-time.Hour), NotAfter: now}).Active(now) {
+		t.Error("Expected link to be inactive at its expiry time")
+	}
+}
+
+func TestQueryHandlerExpired(t *testing.T) {
+	db := setupTestDB(t)
+	cache, _ := createCache(10)
+	handler := QueryHandler{db: db, cache: cache}
+
+	short := "expiry01"
+	destination := "https://sale.example.com/summer"
+	createURL(db, destination, short, "127.0.0.1")
+	defer deleteURL(db, 0, short)
+	updateURLDetails(db, URL{Short: short, NotAfter: time.Now().Add(time.Hour)})
+
+	req := httptest.NewRequest("GET", "/q/"+short, nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	// Permanent redirects would be cached beyond the expiry time
+	if w.Code != http.StatusFound || w.Header().Get("Location") != destination {
+		t.Errorf("Expected temporary redirect to %s before expiry, got %d %s", destination, w.Code, w.Header().Get("Location"))
+	}
+
+	updateURLDetails(db, URL{Short: short, NotAfter: time.Now().Add(-time.Minute)})
+	cache.forgetLink(0, short)
+
+	req = httptest.NewRequest("GET", "/q/"+short, nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusGone {
+		t.Errorf("Expected status code %d after expiry, got %d", http.StatusGone, w.Code)
+	}
+	if strings.Contains(w.Body.String(), "sale.example.com") || w.Header().Get("Location") != "" {
+		t.Error("Expected expired link not to reveal the destination")
+	}
+	if link, err := queryShortURL(db, 0, short); err != nil || link.NotAfter.IsZero() {
+		t.Errorf("Expected expiry time to be stored, got %+v, %v", link, err)
+	}
+}
+
+func TestReadURLFormWindow(t *testing.T) {
+	read := func(notBefore string, notAfter string) (URL, error) {
+		form := url.Values{"not_before": {notBefore}, "not_after": {notAfter}}
+		req := httptest.NewRequest("POST", "/edit/abc", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		var link URL
+		err := readURLForm(req, &link)
+		return link, err
+	}
+
+	link, err := read("2030-05-01T09:30", "2030-05-08T09:30")
+	if err != nil || link.NotAfter.Sub(link.NotBefore) != 7*24*time.Hour {
+		t.Errorf("Expected a week long window, got %v to %v, %v", link.NotBefore, link.NotAfter, err)
+	}
+	if _, err := read("2030-05-08T09:30", "2030-05-01T09:30"); err == nil {
+		t.Error("Expected an expiry time before the activation time to be rejected")
+	}
+	if _, err := read("", "someday"); err == nil {
+		t.Error("Expected an invalid expiry time to be rejected")
+	}
+}
+
+func TestQueryHandlerComingSoon(t *testing.T) {
+	db := setupTestDB(t)
+	cache, _ := createCache(10)
+	handler := QueryHandler{db: db, cache: cache}
+
+	short := "launch01"
+	destination := "https://launch.example.com/secret-product"
+	createURL(db, destination, short, "127.0.0.1")
+	updateURLDetails(db, URL{Short: short, NotBefore: time.Now().Add(time.Hour)})
+
+	for _, path := range []string{"/q/" + short, "/q/" + short + "+"} {
+		req := httptest.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if w.Code != http.StatusServiceUnavailable {
+			t.Fatalf("Expected status code %d for %s, got %d", http.StatusServiceUnavailable, path, w.Code)
+		}
+		if strings.Contains(w.Body.String(), "launch.example.com") || w.Header().Get("Location") != "" {
+			t.Errorf("Expected %s not to reveal the destination", path)
+		}
+		if w.Header().Get("Retry-After") == "" {
+			t.Errorf("Expected Retry-After header for %s", path)
+		}
+	}
+
+	updateURLDetails(db, URL{Short: short, NotBefore: time.Now().Add(-time.Minute)})
+	cache.forgetLink(0, short)
+
+	req := httptest.NewRequest("GET", "/q/"+short, nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != destination {
+		t.Errorf("Expected redirect to %s after activation, got %d %s", destination, w.Code, w.Header().Get("Location"))
+	}
+}
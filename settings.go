@@ -2,24 +2,73 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/netip"
 	"os"
 	"strconv"
 	"strings"
 )
 
 type Settings struct {
-	ServerPort    int    `json:"server_port"`
-	DatabasePath  string `json:"database_path"`
-	BaseURL       string `json:"base_url"`
-	MaxURLLength  int    `json:"max_url_length"`
-	EnableLogging bool   `json:"enable_logging"`
+	ServerPort         int    `json:"server_port"`
+	DatabasePath       string `json:"database_path"`
+	BaseURL            string `json:"base_url"`
+	MaxURLLength       int    `json:"max_url_length"`
+	EnableLogging      bool   `json:"enable_logging"`
+	FetchMetadata      bool   `json:"fetch_metadata"`
+	LinkCheckInterval  int    `json:"link_check_interval_minutes"`
+	PreviewLinks       bool   `json:"preview_links"`
+	GeoIPDatabase      string `json:"geoip_database"`
+	Passthrough        bool   `json:"passthrough"`
+	ComingSoonTemplate string `json:"coming_soon_template"`
+	RequireAuth        bool   `json:"require_auth"`
+	DefaultRole        string `json:"default_role"`
+	// DisablePasswordLogin only allows single sign-on in the web interface
+	DisablePasswordLogin bool            `json:"disable_password_login"`
+	OIDCIssuer           string          `json:"oidc_issuer"`
+	OIDCClientID         string          `json:"oidc_client_id"`
+	OIDCClientSecret     string          `json:"oidc_client_secret"`
+	OIDCScopes           []string        `json:"oidc_scopes"`
+	OIDCUsernameClaim    string          `json:"oidc_username_claim"`
+	OIDCGroupsClaim      string          `json:"oidc_groups_claim"`
+	OIDCGroupRoles       []OIDCGroupRole `json:"oidc_group_roles"`
+	// Budgets per client IP, or per API key, for creating links and for redirects
+	CreateRateLimit   RateLimit `json:"create_rate_limit"`
+	RedirectRateLimit RateLimit `json:"redirect_rate_limit"`
+	RateLimitStore    string    `json:"rate_limit_store"`
+	// TrustedProxies lists the addresses, as CIDRs or single IPs, of proxies
+	// whose X-Forwarded-For and Forwarded headers are believed
+	TrustedProxies []string `json:"trusted_proxies"`
+	// DestinationPolicy is "allow" or "deny" for destinations no rule matches
+	DestinationPolicy     string `json:"destination_policy"`
+	DestinationPolicyFile string `json:"destination_policy_file"`
+	// BlocklistFiles are local threat feeds of phishing and malware domains and URLs
+	BlocklistFiles           []string `json:"blocklist_files"`
+	BlocklistRefreshInterval int      `json:"blocklist_refresh_minutes"`
+	// BlockedNetworks are refused as destinations and for outbound requests,
+	// except for the AllowedNetworks within them
+	BlockedNetworks []string `json:"blocked_networks"`
+	AllowedNetworks []string `json:"allowed_networks"`
+	// AllowUnresolvedDestinations accepts destinations whose host does not
+	// resolve, instead of rejecting them
+	AllowUnresolvedDestinations bool `json:"allow_unresolved_destinations"`
+	// ResolveShorteners replaces destinations on KnownShorteners with the URL
+	// they redirect to, following at most ShortenerHops redirects
+	ResolveShorteners bool     `json:"resolve_shorteners"`
+	KnownShorteners   []string `json:"known_shorteners"`
+	ShortenerHops     int      `json:"shortener_hops"`
+
+	// The network lists parsed by parseNetworkSettings
+	trustedPrefixes []netip.Prefix
+	blockedPrefixes []netip.Prefix
+	allowedPrefixes []netip.Prefix
 }
 
 // LoadSettings reads settings from a JSON file
 func LoadSettings(filename string) (*Settings, error) {
-	// First load from file if it exists
-	var settings Settings
+	// First load from file if it exists, keeping defaults for missing keys
+	settings := *GetDefaultSettings()
 
 	fmt.Println("Loading settings from: ", filename)
 
@@ -28,9 +77,16 @@ func LoadSettings(filename string) (*Settings, error) {
 		if err := json.Unmarshal(data, &settings); err != nil {
 			return nil, err
 		}
+		// require_auth was called require_api_key before user accounts existed
+		var renamed struct {
+			RequireAuth   *bool `json:"require_auth"`
+			RequireAPIKey *bool `json:"require_api_key"`
+		}
+		if json.Unmarshal(data, &renamed) == nil && renamed.RequireAuth == nil && renamed.RequireAPIKey != nil {
+			settings.RequireAuth = *renamed.RequireAPIKey
+		}
 	} else {
 		fmt.Println("No settings file found, using defaults")
-		settings = *GetDefaultSettings()
 	}
 
 	// Override with environment variables if they exist
@@ -58,9 +114,160 @@ func LoadSettings(filename string) (*Settings, error) {
 		settings.EnableLogging = strings.ToLower(logging) == "true"
 	}
 
+	if fetch := os.Getenv("FETCH_METADATA"); fetch != "" {
+		settings.FetchMetadata = strings.ToLower(fetch) == "true"
+	}
+
+	if interval := os.Getenv("LINK_CHECK_INTERVAL_MINUTES"); interval != "" {
+		if i, err := strconv.Atoi(interval); err == nil {
+			settings.LinkCheckInterval = i
+		}
+	}
+
+	if preview := os.Getenv("PREVIEW_LINKS"); preview != "" {
+		settings.PreviewLinks = strings.ToLower(preview) == "true"
+	}
+
+	if geoip := os.Getenv("GEOIP_DATABASE"); geoip != "" {
+		settings.GeoIPDatabase = geoip
+	}
+
+	if passthrough := os.Getenv("PASSTHROUGH"); passthrough != "" {
+		settings.Passthrough = strings.ToLower(passthrough) == "true"
+	}
+
+	if comingSoon := os.Getenv("COMING_SOON_TEMPLATE"); comingSoon != "" {
+		settings.ComingSoonTemplate = comingSoon
+	}
+
+	if requireAPIKey := os.Getenv("REQUIRE_API_KEY"); requireAPIKey != "" {
+		settings.RequireAuth = strings.ToLower(requireAPIKey) == "true"
+	}
+
+	if requireAuth := os.Getenv("REQUIRE_AUTH"); requireAuth != "" {
+		settings.RequireAuth = strings.ToLower(requireAuth) == "true"
+	}
+
+	if role := os.Getenv("DEFAULT_ROLE"); role != "" {
+		settings.DefaultRole = role
+	}
+
+	if disable := os.Getenv("DISABLE_PASSWORD_LOGIN"); disable != "" {
+		settings.DisablePasswordLogin = strings.ToLower(disable) == "true"
+	}
+
+	if issuer := os.Getenv("OIDC_ISSUER"); issuer != "" {
+		settings.OIDCIssuer = issuer
+	}
+
+	if clientID := os.Getenv("OIDC_CLIENT_ID"); clientID != "" {
+		settings.OIDCClientID = clientID
+	}
+
+	if clientSecret := os.Getenv("OIDC_CLIENT_SECRET"); clientSecret != "" {
+		settings.OIDCClientSecret = clientSecret
+	}
+
+	if scopes := os.Getenv("OIDC_SCOPES"); scopes != "" {
+		settings.OIDCScopes = strings.Split(scopes, ",")
+	}
+
+	limits := []struct {
+		env   string
+		value *int
+	}{
+		{"CREATE_RATE_LIMIT_PER_MINUTE", &settings.CreateRateLimit.PerMinute},
+		{"CREATE_RATE_LIMIT_BURST", &settings.CreateRateLimit.Burst},
+		{"REDIRECT_RATE_LIMIT_PER_MINUTE", &settings.RedirectRateLimit.PerMinute},
+		{"REDIRECT_RATE_LIMIT_BURST", &settings.RedirectRateLimit.Burst},
+	}
+	for _, limit := range limits {
+		if value := os.Getenv(limit.env); value != "" {
+			if v, err := strconv.Atoi(value); err == nil {
+				*limit.value = v
+			}
+		}
+	}
+
+	if store := os.Getenv("RATE_LIMIT_STORE"); store != "" {
+		settings.RateLimitStore = store
+	}
+
+	if proxies := os.Getenv("TRUSTED_PROXIES"); proxies != "" {
+		settings.TrustedProxies = strings.Split(proxies, ",")
+	}
+
+	if policy := os.Getenv("DESTINATION_POLICY"); policy != "" {
+		settings.DestinationPolicy = policy
+	}
+
+	if policyFile := os.Getenv("DESTINATION_POLICY_FILE"); policyFile != "" {
+		settings.DestinationPolicyFile = policyFile
+	}
+
+	if files := os.Getenv("BLOCKLIST_FILES"); files != "" {
+		settings.BlocklistFiles = strings.Split(files, ",")
+	}
+
+	if interval := os.Getenv("BLOCKLIST_REFRESH_MINUTES"); interval != "" {
+		if i, err := strconv.Atoi(interval); err == nil {
+			settings.BlocklistRefreshInterval = i
+		}
+	}
+
+	if networks := os.Getenv("BLOCKED_NETWORKS"); networks != "" {
+		settings.BlockedNetworks = strings.Split(networks, ",")
+	}
+
+	if networks := os.Getenv("ALLOWED_NETWORKS"); networks != "" {
+		settings.AllowedNetworks = strings.Split(networks, ",")
+	}
+
+	if unresolved := os.Getenv("ALLOW_UNRESOLVED_DESTINATIONS"); unresolved != "" {
+		settings.AllowUnresolvedDestinations = strings.ToLower(unresolved) == "true"
+	}
+
+	if resolve := os.Getenv("RESOLVE_SHORTENERS"); resolve != "" {
+		settings.ResolveShorteners = strings.ToLower(resolve) == "true"
+	}
+
+	if shorteners := os.Getenv("KNOWN_SHORTENERS"); shorteners != "" {
+		settings.KnownShorteners = strings.Split(shorteners, ",")
+	}
+
+	if hops := os.Getenv("SHORTENER_HOPS"); hops != "" {
+		if i, err := strconv.Atoi(hops); err == nil {
+			settings.ShortenerHops = i
+		}
+	}
+
+	if err := settings.parseNetworkSettings(); err != nil {
+		fmt.Println("Error in network settings:", err)
+	}
+
 	return &settings, nil
 }
 
+// parseNetworkSettings parses TrustedProxies, BlockedNetworks and
+// AllowedNetworks, so that requests and connections do not parse them again.
+// It has to be called after changing them. With invalid entries no proxy is
+// trusted, the default networks are blocked and none are allowed.
+func (s *Settings) parseNetworkSettings() error {
+	var errs []error
+	var err error
+	if s.trustedPrefixes, err = parseNetworks(s.TrustedProxies); err != nil {
+		errs = append(errs, fmt.Errorf("trusted_proxies: %v, forwarded addresses are ignored", err))
+	}
+	if s.blockedPrefixes, err = parseNetworks(s.BlockedNetworks); err != nil {
+		s.blockedPrefixes, _ = parseNetworks(defaultBlockedNetworks)
+		errs = append(errs, fmt.Errorf("blocked_networks: %v, blocking the default networks", err))
+	}
+	if s.allowedPrefixes, err = parseNetworks(s.AllowedNetworks); err != nil {
+		errs = append(errs, fmt.Errorf("allowed_networks: %v, no networks are exempted", err))
+	}
+	return errors.Join(errs...)
+}
+
 // SaveSettings writes settings to a JSON file
 func (s *Settings) SaveSettings(filename string) error {
 	data, err := json.MarshalIndent(s, "", "    ")
@@ -73,11 +280,28 @@ func (s *Settings) SaveSettings(filename string) error {
 
 // GetDefaultSettings returns default configuration values
 func GetDefaultSettings() *Settings {
-	return &Settings{
-		ServerPort:    8080,
-		DatabasePath:  "./urls.db",
-		BaseURL:       "http://localhost:8080",
-		MaxURLLength:  2048,
-		EnableLogging: true,
+	settings := &Settings{
+		ServerPort:               8080,
+		DatabasePath:             "./urls.db",
+		BaseURL:                  "http://localhost:8080",
+		MaxURLLength:             2048,
+		EnableLogging:            true,
+		FetchMetadata:            true,
+		LinkCheckInterval:        24 * 60,
+		ComingSoonTemplate:       "templates/coming_soon.html",
+		DefaultRole:              "editor",
+		OIDCScopes:               []string{"openid", "profile", "email"},
+		OIDCUsernameClaim:        "preferred_username",
+		OIDCGroupsClaim:          "groups",
+		CreateRateLimit:          RateLimit{PerMinute: 30, Burst: 10},
+		RedirectRateLimit:        RateLimit{PerMinute: 600, Burst: 60},
+		RateLimitStore:           "memory",
+		DestinationPolicy:        "allow",
+		BlocklistRefreshInterval: 60,
+		BlockedNetworks:          append([]string(nil), defaultBlockedNetworks...),
+		KnownShorteners:          append([]string(nil), defaultKnownShorteners...),
+		ShortenerHops:            5,
 	}
+	settings.parseNetworkSettings()
+	return settings
 }
@@ -86,3 +86,24 @@ func TestLoadNonExistentFile(t *testing.T) {
 		t.Error("Unexpected error when loading non-existent file ", err)
 	}
 }
+
+func TestLoadRenamedRequireAuth(t *testing.T) {
+	testFile := "test_settings.json"
+	defer os.Remove(testFile)
+
+	os.WriteFile(testFile, []byte(`{"require_api_key": true}`), 0644)
+	settings, err := LoadSettings(testFile)
+	if err != nil || !settings.RequireAuth {
+		t.Errorf("Expected require_api_key to enable require_auth, got %v, %v", settings.RequireAuth, err)
+	}
+
+	os.WriteFile(testFile, []byte(`{"require_api_key": true, "require_auth": false}`), 0644)
+	if settings, _ := LoadSettings(testFile); settings.RequireAuth {
+		t.Error("Expected require_auth to win over require_api_key")
+	}
+
+	t.Setenv("REQUIRE_API_KEY", "true")
+	if settings, _ := LoadSettings("nonexistent.json"); !settings.RequireAuth {
+		t.Error("Expected REQUIRE_API_KEY to enable require_auth")
+	}
+}
@@ -1,12 +1,44 @@
 package main
 
 import (
+	"crypto/rand"
+	"database/sql"
 	"fmt"
 	"hash/crc32"
 )
 
+// codeAttempts bounds how often a new link draws another code because the
+// code is already taken on its domain
+const codeAttempts = 5
+
 func shorten(url string) (string, error) {
 	url_bytes := []byte(url)
 	hash := crc32.ChecksumIEEE(url_bytes)
 	return fmt.Sprintf("%08x", hash), nil
 }
+
+// newCode returns a code for a new link. The destination is shortened with a
+// random salt, so every link gets its own code and a code reveals nothing
+// about the links of other workspaces to the same destination.
+func newCode(url string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	return shorten(url + fmt.Sprintf("#%x", salt))
+}
+
+// insertNewURL stores a new link under a fresh code, drawing another one
+// while the code is taken on the domain of the link
+func insertNewURL(db *sql.DB, url *URL, passwordHash string) error {
+	var err error
+	for attempt := 0; attempt < codeAttempts; attempt++ {
+		if url.Short, err = newCode(url.Name); err != nil {
+			return err
+		}
+		if err = insertURL(db, *url, passwordHash); !isUniqueViolation(err) {
+			return err
+		}
+	}
+	return err
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"time"
+)
+
+// defaultBlockedNetworks are the loopback, private, shared, link-local and
+// other non-public ranges, which also hold the cloud metadata services at
+// 169.254.169.254, 100.100.100.200 and fd00:ec2::254. The NAT64 and 6to4
+// prefixes are included because they embed IPv4 addresses, which could be
+// internal ones.
+var defaultBlockedNetworks = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"64:ff9b::/96",
+	"2002::/16",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+}
+
+var errInternalDestination = errors.New("Destination points to an internal address")
+
+// Resolver looks up the addresses of a host. net.DefaultResolver is one,
+// tests replace it with a stub.
+type Resolver interface {
+	LookupNetIP(ctx context.Context, network string, host string) ([]netip.Addr, error)
+}
+
+// destinationResolver resolves the hosts of new destinations
+var destinationResolver Resolver = net.DefaultResolver
+
+const resolveTimeout = 3 * time.Second
+
+// checkAddr refuses addresses in Settings.BlockedNetworks, unless they are in
+// Settings.AllowedNetworks
+func checkAddr(addr netip.Addr) error {
+	addr = addr.Unmap().WithZone("")
+	for _, prefix := range config.allowedPrefixes {
+		if prefix.Contains(addr) {
+			return nil
+		}
+	}
+	for _, prefix := range config.blockedPrefixes {
+		if prefix.Contains(addr) {
+			return fmt.Errorf("address %s is in the blocked network %s", addr, prefix)
+		}
+	}
+	return nil
+}
+
+// rejectInternalIP is the checkIP of outbound clients, so that requests to
+// destinations and every redirect they follow are checked after DNS resolution
+func rejectInternalIP(ip net.IP) error {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return fmt.Errorf("invalid address %s", ip)
+	}
+	return checkAddr(addr)
+}
+
+// checkDestinationHost resolves the host of a destination and rejects it if
+// any of its addresses is blocked. Hosts that cannot be resolved are rejected
+// too, unless Settings.AllowUnresolvedDestinations is set. Outbound requests
+// check every connection again in case the name resolves differently later.
+func checkDestinationHost(destination string) error {
+	u, err := url.Parse(destination)
+	if err != nil || u.Hostname() == "" {
+		return nil
+	}
+	host := u.Hostname()
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if checkAddr(addr) != nil {
+			return errInternalDestination
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	addrs, err := destinationResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil || len(addrs) == 0 {
+		if config.AllowUnresolvedDestinations {
+			return nil
+		}
+		return fmt.Errorf("Could not resolve the destination host %s", host)
+	}
+	for _, addr := range addrs {
+		if checkAddr(addr) != nil {
+			return errInternalDestination
+		}
+	}
+	return nil
+}
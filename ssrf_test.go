@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+// stubResolver answers lookups from a fixed table, where "*" stands for
+// every other host
+type stubResolver map[string][]string
+
+func (s stubResolver) LookupNetIP(ctx context.Context, network string, host string) ([]netip.Addr, error) {
+	entries, ok := s[host]
+	if !ok {
+		entries, ok = s["*"]
+	}
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	var addrs []netip.Addr
+	for _, entry := range entries {
+		addrs = append(addrs, netip.MustParseAddr(entry))
+	}
+	return addrs, nil
+}
+
+func useStubResolver(t *testing.T, resolver stubResolver) {
+	old := destinationResolver
+	destinationResolver = resolver
+	t.Cleanup(func() { destinationResolver = old })
+}
+
+func TestCheckDestinationHost(t *testing.T) {
+	useStubResolver(t, stubResolver{
+		"public.example":   {"93.184.216.34"},
+		"metadata.example": {"169.254.169.254"},
+		"intranet.example": {"10.1.2.3"},
+		"mixed.example":    {"93.184.216.34", "192.168.1.10"},
+		"v6.example":       {"2606:2800:220:1:248:1893:25c8:1946"},
+		"local6.example":   {"fd00:ec2::254"},
+	})
+
+	tests := []struct {
+		destination string
+		allowed     bool
+	}{
+		{"https://public.example/page", true},
+		{"https://v6.example/", true},
+		{"https://unresolvable.example/", false},
+		{"http://169.254.169.254/latest/meta-data/", false},
+		{"http://metadata.example/computeMetadata/v1/", false},
+		{"https://intranet.example/wiki", false},
+		{"https://mixed.example/", false},
+		{"https://local6.example/", false},
+		{"http://127.0.0.1:8080/admin", false},
+		{"http://[::1]/", false},
+		{"http://[::ffff:127.0.0.1]/", false},
+		{"http://[fe80::1%25eth0]/", false},
+		{"http://0.0.0.0/", false},
+		{"http://100.100.100.200/latest/meta-data/", false},
+		{"http://[64:ff9b::a9fe:a9fe]/", false},
+		{"http://[2002:a9fe:a9fe::1]/", false},
+	}
+	for _, tt := range tests {
+		_, err := normalizeDestination(tt.destination)
+		if (err == nil) != tt.allowed {
+			t.Errorf("normalizeDestination(%q) = %v, want allowed %v", tt.destination, err, tt.allowed)
+		}
+	}
+
+	config.AllowUnresolvedDestinations = true
+	defer func() { config.AllowUnresolvedDestinations = false }()
+	if _, err := normalizeDestination("https://unresolvable.example/"); err != nil {
+		t.Errorf("Expected unresolvable host to be accepted with allow_unresolved_destinations, got %v", err)
+	}
+}
+
+func TestNetworkSettings(t *testing.T) {
+	useStubResolver(t, stubResolver{"intranet.example": {"10.1.2.3"}})
+	oldBlocked, oldAllowed := config.BlockedNetworks, config.AllowedNetworks
+	defer func() {
+		config.BlockedNetworks, config.AllowedNetworks = oldBlocked, oldAllowed
+		config.parseNetworkSettings()
+	}()
+
+	config.AllowedNetworks = []string{"10.1.0.0/16"}
+	config.parseNetworkSettings()
+	if _, err := normalizeDestination("https://intranet.example/wiki"); err != nil {
+		t.Errorf("Expected allowed network to be accepted, got %v", err)
+	}
+	if _, err := normalizeDestination("http://10.2.0.1/"); err == nil {
+		t.Error("Expected the rest of 10.0.0.0/8 to stay blocked")
+	}
+
+	config.AllowedNetworks = nil
+	config.BlockedNetworks = []string{"203.0.113.0/24"}
+	config.parseNetworkSettings()
+	if _, err := normalizeDestination("https://intranet.example/wiki"); err != nil {
+		t.Errorf("Expected networks left out of blocked_networks to be accepted, got %v", err)
+	}
+	if _, err := normalizeDestination("http://203.0.113.9/"); err == nil {
+		t.Error("Expected configured network to be blocked")
+	}
+
+	// Invalid settings block the default networks
+	config.BlockedNetworks = []string{"not a network"}
+	if err := config.parseNetworkSettings(); err == nil {
+		t.Error("Expected an error for an invalid network")
+	}
+	if _, err := normalizeDestination("http://192.168.0.1/"); err == nil {
+		t.Error("Expected default networks to be blocked with invalid settings")
+	}
+}
+
+func TestOutboundClientRejectsInternal(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("internal"))
+	}))
+	defer server.Close()
+
+	client := newOutboundClient(rejectInternalIP)
+	if _, err := client.Get(server.URL); err == nil {
+		t.Error("Expected request to a loopback server to be refused")
+	}
+
+	oldAllowed := config.AllowedNetworks
+	config.AllowedNetworks = []string{"127.0.0.1"}
+	config.parseNetworkSettings()
+	defer func() {
+		config.AllowedNetworks = oldAllowed
+		config.parseNetworkSettings()
+	}()
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Expected allowed network to be reachable, got %v", err)
+	}
+	resp.Body.Close()
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// User is a local account that can sign in to the web interface
+type User struct {
+	ID        int64     `json:"id"`
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"created_at"`
+	Role      string    `json:"role"`
+	// GroupRole is set while the role was granted by an oidc_group_roles rule
+	GroupRole bool `json:"-"`
+}
+
+const minPasswordLength = 8
+
+var errInvalidLogin = errors.New("invalid username or password")
+
+// dummyPasswordHash is verified against when a username does not exist, so
+// that failed logins take the same time whether or not the user exists
+var dummyPasswordHash, _ = hashPassword("not a real password")
+
+// validateUsername checks that a username is short and free of spaces
+func validateUsername(username string) error {
+	if username == "" || len(username) > 64 || strings.ContainsAny(username, " \t\r\n") {
+		return errors.New("usernames must be 1 to 64 characters without spaces")
+	}
+	return nil
+}
+
+func validatePassword(password string) error {
+	if len(password) < minPasswordLength {
+		return fmt.Errorf("passwords must be at least %d characters", minPasswordLength)
+	}
+	return nil
+}
+
+// authenticateUser checks a username and password. Users who sign in with
+// single sign-on have no password and are always rejected.
+func authenticateUser(db *sql.DB, username string, password string) (User, error) {
+	user, hash, err := queryUserByName(db, username)
+	if err == sql.ErrNoRows || hash == "" {
+		verifyPassword(password, dummyPasswordHash)
+		return User{}, errInvalidLogin
+	}
+	if err != nil {
+		return User{}, err
+	}
+	if ok, err := verifyPassword(password, hash); err != nil || !ok {
+		return User{}, errInvalidLogin
+	}
+	return user, nil
+}
+
+// runUserCommand implements the user subcommand. Passwords are read from the
+// first line of in, so they do not end up in the shell history:
+//
+//	url_shortener user create [-role viewer|editor|admin] <username>
+//	url_shortener user passwd <username>
+//	url_shortener user role <username> viewer|editor|admin
+//	url_shortener user list
+//	url_shortener user delete <username>
+func runUserCommand(db *sql.DB, args []string, in io.Reader, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("usage: user create|passwd|role|list|delete")
+	}
+
+	readPassword := func() (string, error) {
+		fmt.Fprint(out, "Password: ")
+		line, err := bufio.NewReader(in).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		password := strings.TrimRight(line, "\r\n")
+		return password, validatePassword(password)
+	}
+
+	switch args[0] {
+	case "create", "passwd":
+		flags := flag.NewFlagSet("user "+args[0], flag.ContinueOnError)
+		flags.SetOutput(out)
+		role := flags.String("role", "", "role of the new user, the default role if empty")
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		if flags.NArg() != 1 {
+			return fmt.Errorf("usage: user %s <username>", args[0])
+		}
+		if *role != "" && (args[0] != "create" || !validRole(*role)) {
+			return fmt.Errorf("invalid role %q", *role)
+		}
+		username := flags.Arg(0)
+		if err := validateUsername(username); err != nil {
+			return err
+		}
+		password, err := readPassword()
+		if err != nil {
+			return err
+		}
+		hash, err := hashPassword(password)
+		if err != nil {
+			return err
+		}
+		if args[0] == "create" {
+			user, err := createUser(db, username, hash)
+			if err != nil {
+				return err
+			}
+			if *role != "" {
+				if err := updateUserRole(db, user.ID, *role); err != nil {
+					return err
+				}
+			}
+			fmt.Fprintf(out, "\nCreated user %s\n", username)
+		} else {
+			if err := updateUserPassword(db, username, hash); err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "\nChanged the password of %s and signed out their sessions\n", username)
+		}
+	case "role":
+		if len(args) != 3 || !validRole(args[2]) {
+			return errors.New("usage: user role <username> viewer|editor|admin")
+		}
+		user, _, err := queryUserByName(db, args[1])
+		if err != nil {
+			return fmt.Errorf("unknown user %q", args[1])
+		}
+		if err := updateUserRole(db, user.ID, args[2]); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%s is now %s\n", user.Username, args[2])
+	case "list":
+		users, err := queryUsers(db)
+		if err != nil {
+			return err
+		}
+		for _, user := range users {
+			fmt.Fprintf(out, "%d\t%s\trole %s\tcreated %s\n", user.ID, user.Username, userRole(user), user.CreatedAt.Format(time.RFC3339))
+		}
+	case "delete":
+		if len(args) != 2 {
+			return errors.New("usage: user delete <username>")
+		}
+		if err := deleteUser(db, args[1]); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Deleted user %s, their links are kept\n", args[1])
+	default:
+		return fmt.Errorf("unknown user command %q", args[0])
+	}
+	return nil
+}
+
+// UsersHandler lets admins create users, change their roles and delete them
+type UsersHandler struct {
+	db *sql.DB
+}
+
+// ServeHTTP implements the http.Handler interface
+func (h UsersHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		if err := h.update(r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Redirect(w, r, "/users", http.StatusSeeOther)
+		return
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	users, err := queryUsers(h.db)
+	if err != nil {
+		http.Error(w, "Failed to fetch users", http.StatusInternalServerError)
+		return
+	}
+	for i := range users {
+		users[i].Role = userRole(users[i])
+	}
+
+	page := struct {
+		Title     string
+		Users     []User
+		Roles     []string
+		Default   string
+		Self      int64
+		CSRFToken string
+	}{
+		Title:     "Users",
+		Users:     users,
+		Roles:     roles,
+		Default:   config.DefaultRole,
+		Self:      requestAuth(r).ownerID(),
+		CSRFToken: csrfToken(w, r),
+	}
+
+	tmpl, err := template.ParseFiles("templates/users.html")
+	if err != nil {
+		http.Error(w, "Failed to load template: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = tmpl.Execute(w, page)
+	if err != nil {
+		http.Error(w, "Failed to execute template: "+err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// update applies a form posted to the users page
+func (h UsersHandler) update(r *http.Request) error {
+	switch r.FormValue("action") {
+	case "role":
+		id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+		if err != nil {
+			return errors.New("invalid user")
+		}
+		if !validRole(r.FormValue("role")) {
+			return errors.New("invalid role")
+		}
+		// Keep admins from locking themselves out
+		if id == requestAuth(r).ownerID() && r.FormValue("role") != roleAdmin {
+			return errors.New("you cannot change your own role")
+		}
+		return updateUserRole(h.db, id, r.FormValue("role"))
+	case "delete":
+		username := r.FormValue("username")
+		if username == requestAuth(r).user.Username {
+			return errors.New("you cannot delete yourself")
+		}
+		return deleteUser(h.db, username)
+	}
+
+	username := strings.TrimSpace(r.FormValue("username"))
+	if err := validateUsername(username); err != nil {
+		return err
+	}
+	password := r.FormValue("password")
+	if err := validatePassword(password); err != nil {
+		return err
+	}
+	role := r.FormValue("role")
+	if role != "" && !validRole(role) {
+		return errors.New("invalid role")
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	user, err := createUser(h.db, username, hash)
+	if err != nil {
+		return fmt.Errorf("username %s is already taken", username)
+	}
+	if role == "" {
+		return nil
+	}
+	return updateUserRole(h.db, user.ID, role)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRunUserCommand(t *testing.T) {
+	db := setupTestDB(t)
+	deleteUser(db, "clitest")
+
+	var out bytes.Buffer
+	if err := runUserCommand(db, []string{"create", "clitest"}, strings.NewReader("first password\n"), &out); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	if _, err := authenticateUser(db, "clitest", "first password"); err != nil {
+		t.Errorf("Expected new user to log in, got %v", err)
+	}
+
+	if err := runUserCommand(db, []string{"create", "clitest"}, strings.NewReader("first password\n"), &out); err == nil {
+		t.Error("Expected duplicate username to fail")
+	}
+	if err := runUserCommand(db, []string{"create", "short"}, strings.NewReader("short\n"), &out); err == nil {
+		t.Error("Expected short password to fail")
+	}
+	if err := runUserCommand(db, []string{"create", "-role", "owner", "clirole"}, strings.NewReader("long enough\n"), &out); err == nil {
+		t.Error("Expected unknown role to fail")
+	}
+	if err := runUserCommand(db, []string{"create", "with space"}, strings.NewReader("long enough\n"), &out); err == nil {
+		t.Error("Expected username with a space to fail")
+	}
+
+	if err := runUserCommand(db, []string{"passwd", "clitest"}, strings.NewReader("second password\n"), &out); err != nil {
+		t.Fatalf("passwd failed: %v", err)
+	}
+	if _, err := authenticateUser(db, "clitest", "first password"); err != errInvalidLogin {
+		t.Errorf("Expected old password to be rejected, got %v", err)
+	}
+
+	if err := runUserCommand(db, []string{"role", "clitest", "admin"}, nil, &out); err != nil {
+		t.Fatalf("role failed: %v", err)
+	}
+	if err := runUserCommand(db, []string{"role", "clitest", "owner"}, nil, &out); err == nil {
+		t.Error("Expected unknown role to fail")
+	}
+
+	out.Reset()
+	runUserCommand(db, []string{"list"}, nil, &out)
+	if !strings.Contains(out.String(), "clitest\trole admin") {
+		t.Errorf("Expected user in list, got %s", out.String())
+	}
+
+	if err := runUserCommand(db, []string{"delete", "clitest"}, nil, &out); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	if _, err := authenticateUser(db, "clitest", "second password"); err != errInvalidLogin {
+		t.Errorf("Expected deleted user to be rejected, got %v", err)
+	}
+}
+
+func TestDeleteUserReleasesLinks(t *testing.T) {
+	db := setupTestDB(t)
+	deleteUser(db, "newcomer")
+	departed := createTestUser(t, "departed", "departed password")
+	short := "departed"
+	deleteURL(db, 0, short)
+	defer deleteURL(db, 0, short)
+	createURL(db, "https://departed.example.com/", short, "127.0.0.1")
+	updateURLOwner(db, 0, short, departed.ID)
+
+	// The newest id is handed out again after the user is removed
+	if err := deleteUser(db, "departed"); err != nil {
+		t.Fatalf("deleteUser failed: %v", err)
+	}
+	newcomer := createTestUser(t, "newcomer", "newcomer password")
+	defer deleteUser(db, "newcomer")
+	updateUserRole(db, newcomer.ID, roleEditor)
+	newcomer.Role = roleEditor
+
+	link, err := queryShortURL(db, 0, short)
+	if err != nil {
+		t.Fatalf("Expected the link to be kept, got %v", err)
+	}
+	if link.OwnerID != 0 || (authInfo{user: newcomer}).canView(link) {
+		t.Errorf("Expected the link of user %d not to pass to user %d, got owner %d", departed.ID, newcomer.ID, link.OwnerID)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// UTMTemplate is a named set of UTM parameters added to destinations at
+// redirect time. Each workspace has its own templates, and links outside of
+// workspaces share those of workspace 0.
+type UTMTemplate struct {
+	WorkspaceID int64  `json:"workspace_id"`
+	Name        string `json:"name"`
+	Source      string `json:"source"`
+	Medium      string `json:"medium"`
+	Campaign    string `json:"campaign"`
+	Term        string `json:"term"`
+	Content     string `json:"content"`
+}
+
+// Values returns the non-empty UTM parameters of a template
+func (t UTMTemplate) Values() url.Values {
+	values := url.Values{}
+	params := []struct {
+		key   string
+		value string
+	}{
+		{"utm_source", t.Source},
+		{"utm_medium", t.Medium},
+		{"utm_campaign", t.Campaign},
+		{"utm_term", t.Term},
+		{"utm_content", t.Content},
+	}
+	for _, param := range params {
+		if param.value != "" {
+			values.Set(param.key, param.value)
+		}
+	}
+	return values
+}
+
+// applyUTM adds the parameters of a template to a destination, keeping any
+// UTM parameters the destination already has
+func applyUTM(destination string, t UTMTemplate) (string, error) {
+	u, err := url.Parse(destination)
+	if err != nil {
+		return "", err
+	}
+	u.RawQuery = mergeQuery(u.RawQuery, t.Values())
+	return u.String(), nil
+}
+
+// readUTMForm reads a UTM template from a submitted form
+func readUTMForm(r *http.Request) (UTMTemplate, error) {
+	t := UTMTemplate{
+		Name:     strings.TrimSpace(r.FormValue("name")),
+		Source:   strings.TrimSpace(r.FormValue("source")),
+		Medium:   strings.TrimSpace(r.FormValue("medium")),
+		Campaign: strings.TrimSpace(r.FormValue("campaign")),
+		Term:     strings.TrimSpace(r.FormValue("term")),
+		Content:  strings.TrimSpace(r.FormValue("content")),
+	}
+	if t.Name == "" {
+		return t, errors.New("Template name is required")
+	}
+	if t.Source == "" || t.Medium == "" || t.Campaign == "" {
+		return t, errors.New("Source, medium and campaign are required")
+	}
+	return t, nil
+}
+
+// UTMHandler lists, saves and deletes the UTM templates of the workspace a
+// request works in
+type UTMHandler struct {
+	db *sql.DB
+}
+
+// ServeHTTP implements the http.Handler interface
+func (h UTMHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	workspace := requestAuth(r).workspace
+	switch r.Method {
+	case "GET":
+	case "POST":
+		var err error
+		if r.FormValue("action") == "delete" {
+			err = deleteUTMTemplate(h.db, workspace.ID, r.FormValue("name"))
+		} else {
+			var t UTMTemplate
+			t, err = readUTMForm(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			t.WorkspaceID = workspace.ID
+			err = saveUTMTemplate(h.db, t)
+		}
+		if err != nil {
+			http.Error(w, "Failed to save UTM templates", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/utm", http.StatusSeeOther)
+		return
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	templates, err := queryUTMTemplates(h.db, workspace.ID)
+	if err != nil {
+		http.Error(w, "Failed to fetch UTM templates", http.StatusInternalServerError)
+		return
+	}
+
+	page := struct {
+		Title     string
+		Templates []UTMTemplate
+		Workspace Workspace
+		CSRFToken string
+	}{
+		Title:     "UTM Templates",
+		Templates: templates,
+		Workspace: workspace,
+		CSRFToken: csrfToken(w, r),
+	}
+
+	tmpl, err := template.ParseFiles("templates/utm.html")
+	if err != nil {
+		http.Error(w, "Failed to load template: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = tmpl.Execute(w, page)
+	if err != nil {
+		http.Error(w, "Failed to execute template: "+err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestApplyUTM(t *testing.T) {
+	template := UTMTemplate{Name: "newsletter", Source: "newsletter", Medium: "email", Campaign: "spring"}
+
+	tests := []struct {
+		name        string
+		destination string
+		want        string
+	}{
+		{"Plain", "https://example.com/", "https://example.com/?utm_campaign=spring&utm_medium=email&utm_source=newsletter"},
+		{"Existing query", "https://example.com/?id=7", "https://example.com/?id=7&utm_campaign=spring&utm_medium=email&utm_source=newsletter"},
+		{"Existing UTM kept", "https://example.com/?utm_source=partner#top", "https://example.com/?utm_source=partner&utm_campaign=spring&utm_medium=email#top"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := applyUTM(tt.destination, template)
+			if err != nil {
+				t.Fatalf("applyUTM failed: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("applyUTM() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUTMHandler(t *testing.T) {
+	db := setupTestDB(t)
+	handler := UTMHandler{db: db}
+
+	post := func(form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/utm", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := post(url.Values{"name": {"utmtest"}, "source": {"twitter"}, "medium": {"social"}, "campaign": {"launch"}})
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("Expected status code %d, got %d", http.StatusSeeOther, w.Code)
+	}
+
+	saved, err := queryUTMTemplate(db, 0, "utmtest")
+	if err != nil || saved.Source != "twitter" || saved.Campaign != "launch" {
+		t.Errorf("Expected saved template, got %+v, %v", saved, err)
+	}
+
+	req := httptest.NewRequest("GET", "/utm", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "utmtest") {
+		t.Errorf("Expected template list containing utmtest, got %d", w.Code)
+	}
+
+	if w := post(url.Values{"name": {"incomplete"}, "source": {"twitter"}}); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d for a template without medium and campaign, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	post(url.Values{"action": {"delete"}, "name": {"utmtest"}})
+	if _, err := queryUTMTemplate(db, 0, "utmtest"); err == nil {
+		t.Error("Expected template to be deleted")
+	}
+}
+
+func TestQueryHandlerUTM(t *testing.T) {
+	db := setupTestDB(t)
+	cache, _ := createCache(10)
+	handler := QueryHandler{db: db, cache: cache}
+
+	saveUTMTemplate(db, UTMTemplate{Name: "utmlink", Source: "print", Medium: "poster", Campaign: "fair"})
+	// Templates of workspaces never apply to links outside of them
+	saveUTMTemplate(db, UTMTemplate{WorkspaceID: 999, Name: "utmlink", Source: "other", Medium: "team", Campaign: "theirs"})
+	defer deleteUTMTemplate(db, 999, "utmlink")
+	createURL(db, "https://example.com/event?utm_medium=flyer", "utmlink1", "127.0.0.1")
+	updateURLDetails(db, URL{Short: "utmlink1", UTMTemplate: "utmlink"})
+
+	req := httptest.NewRequest("GET", "/q/utmlink1", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	want := "https://example.com/event?utm_medium=flyer&utm_campaign=fair&utm_source=print"
+	if w.Header().Get("Location") != want {
+		t.Errorf("Expected redirect to %s, got %s", want, w.Header().Get("Location"))
+	}
+}
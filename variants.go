@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Variant is one of several weighted destinations a link rotates between
+type Variant struct {
+	Target string `json:"target"`
+	Weight int    `json:"weight"`
+}
+
+const variantCookieMaxAge = 30 * 24 * 60 * 60
+
+// parseVariants reads "weight destination" lines into variants
+func parseVariants(s string) ([]Variant, error) {
+	var variants []Variant
+	for _, line := range strings.Split(s, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid variant %q, expected a weight and a URL", strings.TrimSpace(line))
+		}
+		weight, err := strconv.Atoi(fields[0])
+		if err != nil || weight < 1 {
+			return nil, fmt.Errorf("invalid variant weight %q", fields[0])
+		}
+		destination, err := normalizeDestination(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("variant %s: %w", fields[1], err)
+		}
+		variants = append(variants, Variant{Target: destination, Weight: weight})
+	}
+	return variants, nil
+}
+
+// VariantList returns the variants of a URL as "weight destination" lines
+func (u URL) VariantList() string {
+	var lines []string
+	for _, variant := range u.Variants {
+		lines = append(lines, strconv.Itoa(variant.Weight)+" "+variant.Target)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// hasTargeting reports whether the destination of a link depends on the visitor
+func (u URL) hasTargeting() bool {
+	return len(u.Variants) > 0 || len(u.CountryTargets) > 0 || u.HasPlatformTargets()
+}
+
+// pickVariant chooses a variant index at random, in proportion to the weights
+func pickVariant(variants []Variant, rnd func(n int) int) int {
+	total := 0
+	for _, variant := range variants {
+		total += variant.Weight
+	}
+	if total <= 0 {
+		return 0
+	}
+	n := rnd(total)
+	for i, variant := range variants {
+		n -= variant.Weight
+		if n < 0 {
+			return i
+		}
+	}
+	return len(variants) - 1
+}
+
+// chooseVariant picks the variant to serve. Links with sticky variants keep
+// serving a visitor the variant stored in their cookie.
+func chooseVariant(w http.ResponseWriter, r *http.Request, link URL) Variant {
+	name := "variant_" + link.Short
+	if link.StickyVariants {
+		if cookie, err := r.Cookie(name); err == nil {
+			if i, err := strconv.Atoi(cookie.Value); err == nil && i >= 0 && i < len(link.Variants) {
+				return link.Variants[i]
+			}
+		}
+	}
+
+	i := pickVariant(link.Variants, rand.Intn)
+	if link.StickyVariants {
+		http.SetCookie(w, &http.Cookie{
+			Name:     name,
+			Value:    strconv.Itoa(i),
+			Path:     "/q/" + link.Short,
+			MaxAge:   variantCookieMaxAge,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	return link.Variants[i]
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseVariants(t *testing.T) {
+	variants, err := parseVariants("70 https://example.com/a\n\n30   https://example.com/b\n")
+	if err != nil {
+		t.Fatalf("Failed to parse variants: %v", err)
+	}
+	if len(variants) != 2 || variants[0] != (Variant{"https://example.com/a", 70}) || variants[1] != (Variant{"https://example.com/b", 30}) {
+		t.Errorf("Unexpected variants %v", variants)
+	}
+	if got := (URL{Variants: variants}).VariantList(); got != "70 https://example.com/a\n30 https://example.com/b" {
+		t.Errorf("Unexpected variant list %q", got)
+	}
+
+	invalid := []string{
+		"https://example.com/a",
+		"0 https://example.com/a",
+		"heavy https://example.com/a",
+		"50 javascript:alert(1)",
+	}
+	for _, input := range invalid {
+		if _, err := parseVariants(input); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestPickVariant(t *testing.T) {
+	variants := []Variant{{"a", 1}, {"b", 3}}
+
+	tests := []struct {
+		roll int
+		want int
+	}{
+		{0, 0},
+		{1, 1},
+		{3, 1},
+	}
+
+	for _, tt := range tests {
+		got := pickVariant(variants, func(n int) int {
+			if n != 4 {
+				t.Errorf("Expected total weight 4, got %d", n)
+			}
+			return tt.roll
+		})
+		if got != tt.want {
+			t.Errorf("pickVariant() with roll %d = %d, want %d", tt.roll, got, tt.want)
+		}
+	}
+}
+
+func TestChooseVariantSticky(t *testing.T) {
+	link := URL{
+		Short:          "sticky01",
+		Variants:       []Variant{{"https://example.com/a", 1}, {"https://example.com/b", 1}},
+		StickyVariants: true,
+	}
+
+	req := httptest.NewRequest("GET", "/q/sticky01", nil)
+	w := httptest.NewRecorder()
+	first := chooseVariant(w, req, link)
+
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("Expected a variant cookie, got %v", cookies)
+	}
+
+	for i := 0; i < 20; i++ {
+		req := httptest.NewRequest("GET", "/q/sticky01", nil)
+		req.AddCookie(cookies[0])
+		if got := chooseVariant(httptest.NewRecorder(), req, link); got != first {
+			t.Fatalf("Expected sticky variant %s, got %s", first.Target, got.Target)
+		}
+	}
+
+	// Cookies pointing at a variant that no longer exists are ignored
+	req = httptest.NewRequest("GET", "/q/sticky01", nil)
+	req.AddCookie(&http.Cookie{Name: "variant_sticky01", Value: "7"})
+	if got := chooseVariant(httptest.NewRecorder(), req, link); got.Target == "" {
+		t.Error("Expected a valid variant for an out of range cookie")
+	}
+
+	link.StickyVariants = false
+	w = httptest.NewRecorder()
+	chooseVariant(w, httptest.NewRequest("GET", "/q/sticky01", nil), link)
+	if len(w.Result().Cookies()) != 0 {
+		t.Error("Links without sticky variants should not set a cookie")
+	}
+}
+
+func TestChooseDestinationTargetsBeforeVariants(t *testing.T) {
+	link := URL{
+		Name:           "https://example.com/",
+		Short:          "sticky02",
+		Variants:       []Variant{{"https://example.com/a", 1}, {"https://example.com/b", 1}},
+		StickyVariants: true,
+		IOSURL:         "https://apps.apple.com/app/example",
+	}
+	handler := QueryHandler{}
+
+	// Visitors sent to a platform target never see a variant
+	req := httptest.NewRequest("GET", "/q/sticky02", nil)
+	req.Header.Set("User-Agent", "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 Mobile/15E148")
+	w := httptest.NewRecorder()
+	destination, variant := handler.chooseDestination(w, req, link)
+	if destination != link.IOSURL || variant != "" {
+		t.Errorf("Expected the iOS target without a variant, got %q, %q", destination, variant)
+	}
+	if cookies := w.Result().Cookies(); len(cookies) != 0 {
+		t.Errorf("Expected no variant cookie for a platform target, got %v", cookies)
+	}
+
+	req = httptest.NewRequest("GET", "/q/sticky02", nil)
+	w = httptest.NewRecorder()
+	destination, variant = handler.chooseDestination(w, req, link)
+	if variant == "" || destination != variant || len(w.Result().Cookies()) != 1 {
+		t.Errorf("Expected a remembered variant for other visitors, got %q, %q", destination, variant)
+	}
+}
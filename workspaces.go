@@ -0,0 +1,327 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// workspaceCookie remembers the workspace a user switched to in the web interface
+const workspaceCookie = "workspace"
+
+// workspaceHeader names the workspace of an API request
+const workspaceHeader = "X-Workspace"
+
+var errNotWorkspaceMember = errors.New("not a member of this workspace")
+
+// Workspace is a team sharing its links. Members see and, with the editor
+// role, change every link in the workspace, and new links created in it get
+// the workspace defaults.
+type Workspace struct {
+	ID                 int64
+	Name               string
+	CreatedAt          time.Time
+	DefaultTags        []string
+	DefaultUTMTemplate string
+	DefaultPreview     bool
+	DefaultPassthrough bool
+}
+
+// WorkspaceMember is a user in a workspace. The owner, who created the
+// workspace, and admins manage its members.
+type WorkspaceMember struct {
+	User
+	Owner bool
+}
+
+// DefaultTagList returns the default tags as a comma separated string
+func (w Workspace) DefaultTagList() string {
+	return strings.Join(w.DefaultTags, ", ")
+}
+
+// validateWorkspaceName checks that a workspace name is not empty or too long
+func validateWorkspaceName(name string) error {
+	if name == "" || len(name) > 64 {
+		return errors.New("workspace names must be 1 to 64 characters")
+	}
+	return nil
+}
+
+// requestWorkspace returns the workspace a request works in: the one in the
+// X-Workspace header, or the one a signed in user switched to. Admins can
+// enter every workspace, everybody else only those they are a member of.
+// explicit reports whether the header asked for the workspace, in which case
+// an error should be returned to the client instead of falling back to no
+// workspace.
+func requestWorkspace(db *sql.DB, r *http.Request, info authInfo) (workspace Workspace, explicit bool, err error) {
+	value := r.Header.Get(workspaceHeader)
+	explicit = value != ""
+	if cookie, cerr := r.Cookie(workspaceCookie); !explicit && cerr == nil && info.user.ID != 0 {
+		value = cookie.Value
+	}
+	if value == "" {
+		return Workspace{}, explicit, nil
+	}
+
+	id, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return Workspace{}, explicit, errNotWorkspaceMember
+	}
+	workspace, err = workspaceFor(db, info, id)
+	return workspace, explicit, err
+}
+
+// workspaceFor returns a workspace if the request may enter it
+func workspaceFor(db *sql.DB, info authInfo, id int64) (Workspace, error) {
+	workspace, err := queryWorkspace(db, id)
+	if err != nil {
+		return Workspace{}, errNotWorkspaceMember
+	}
+	if info.atLeast(roleAdmin) {
+		return workspace, nil
+	}
+	if info.ownerID() == 0 {
+		return Workspace{}, errNotWorkspaceMember
+	}
+	member, err := queryWorkspaceMember(db, id, info.ownerID())
+	if err != nil || !member {
+		return Workspace{}, errNotWorkspaceMember
+	}
+	return workspace, nil
+}
+
+// applyWorkspaceDefaults fills in the fields of a new link that a create
+// request left out with the defaults of its workspace
+func applyWorkspaceDefaults(r *http.Request, link *URL, workspace Workspace) {
+	if workspace.ID == 0 {
+		return
+	}
+	link.WorkspaceID = workspace.ID
+	if _, ok := r.Form["tags"]; !ok {
+		link.Tags = workspace.DefaultTags
+	}
+	if _, ok := r.Form["utm_template"]; !ok {
+		link.UTMTemplate = workspace.DefaultUTMTemplate
+	}
+	if _, ok := r.Form["preview"]; !ok {
+		link.Preview = workspace.DefaultPreview
+	}
+	if _, ok := r.Form["passthrough"]; !ok {
+		link.Passthrough = workspace.DefaultPassthrough
+	}
+}
+
+func setWorkspaceCookie(w http.ResponseWriter, workspaceID int64) {
+	cookie := &http.Cookie{
+		Name:     workspaceCookie,
+		Value:    strconv.FormatInt(workspaceID, 10),
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(config.BaseURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	}
+	if workspaceID == 0 {
+		cookie.Value = ""
+		cookie.MaxAge = -1
+	}
+	http.SetCookie(w, cookie)
+}
+
+// WorkspaceHandler lets signed in users switch between their workspaces,
+// create new ones and manage the members and defaults of the active one
+type WorkspaceHandler struct {
+	db *sql.DB
+}
+
+// ServeHTTP implements the http.Handler interface
+func (h WorkspaceHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth := requestAuth(r)
+	if auth.user.ID == 0 {
+		http.Error(w, "Log in to use workspaces", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+	case "POST":
+		status, err := h.update(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		next := "/workspaces"
+		if r.FormValue("action") == "switch" {
+			next = safeRedirectTarget(r.FormValue("next"))
+		}
+		http.Redirect(w, r, next, http.StatusSeeOther)
+		return
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Admins can enter every workspace
+	var userID int64
+	if !auth.atLeast(roleAdmin) {
+		userID = auth.user.ID
+	}
+	workspaces, err := queryWorkspaces(h.db, userID)
+	if err != nil {
+		http.Error(w, "Failed to fetch workspaces", http.StatusInternalServerError)
+		return
+	}
+	var members []WorkspaceMember
+	if auth.workspace.ID != 0 {
+		members, err = queryWorkspaceMembers(h.db, auth.workspace.ID)
+		if err != nil {
+			http.Error(w, "Failed to fetch members", http.StatusInternalServerError)
+			return
+		}
+	}
+	canManageMembers, err := h.canManageMembers(auth)
+	if err != nil {
+		http.Error(w, "Failed to fetch members", http.StatusInternalServerError)
+		return
+	}
+	utmTemplates, err := queryUTMTemplates(h.db, auth.workspace.ID)
+	if err != nil {
+		http.Error(w, "Failed to fetch UTM templates", http.StatusInternalServerError)
+		return
+	}
+
+	page := struct {
+		Title            string
+		Workspaces       []Workspace
+		Workspace        Workspace
+		Members          []WorkspaceMember
+		UTMTemplates     []UTMTemplate
+		CanManage        bool
+		CanManageMembers bool
+		CSRFToken        string
+	}{
+		Title:            "Workspaces",
+		Workspaces:       workspaces,
+		Workspace:        auth.workspace,
+		Members:          members,
+		UTMTemplates:     utmTemplates,
+		CanManage:        auth.atLeast(roleEditor),
+		CanManageMembers: canManageMembers,
+		CSRFToken:        csrfToken(w, r),
+	}
+
+	tmpl, err := template.ParseFiles("templates/workspaces.html")
+	if err != nil {
+		http.Error(w, "Failed to load template: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = tmpl.Execute(w, page)
+	if err != nil {
+		http.Error(w, "Failed to execute template: "+err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// update applies a form posted to the workspaces page and returns the status
+// code to answer with if it fails
+func (h WorkspaceHandler) update(w http.ResponseWriter, r *http.Request) (int, error) {
+	auth := requestAuth(r)
+	action := r.FormValue("action")
+	if action == "switch" {
+		id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+		if err != nil {
+			return http.StatusBadRequest, errors.New("invalid workspace")
+		}
+		if id != 0 {
+			if _, err := workspaceFor(h.db, auth, id); err != nil {
+				return http.StatusForbidden, err
+			}
+		}
+		setWorkspaceCookie(w, id)
+		return 0, nil
+	}
+
+	// Viewers can switch workspaces but not change them
+	if !auth.atLeast(roleEditor) {
+		return http.StatusForbidden, errors.New("your role does not allow changing workspaces")
+	}
+
+	if action == "create" {
+		name := strings.TrimSpace(r.FormValue("name"))
+		if err := validateWorkspaceName(name); err != nil {
+			return http.StatusBadRequest, err
+		}
+		workspace, err := createWorkspace(h.db, name, auth.user.ID)
+		if err != nil {
+			return http.StatusBadRequest, errors.New("workspace " + name + " already exists")
+		}
+		setWorkspaceCookie(w, workspace.ID)
+		return 0, nil
+	}
+
+	// Everything else changes the active workspace
+	workspace := auth.workspace
+	if workspace.ID == 0 {
+		return http.StatusBadRequest, errors.New("switch to a workspace first")
+	}
+	if action == "add_member" || action == "remove_member" {
+		allowed, err := h.canManageMembers(auth)
+		if err != nil {
+			return http.StatusInternalServerError, errors.New("failed to check workspace owner")
+		}
+		if !allowed {
+			return http.StatusForbidden, errors.New("only the workspace owner and admins can change members")
+		}
+	}
+	switch action {
+	case "add_member":
+		user, _, err := queryUserByName(h.db, strings.TrimSpace(r.FormValue("username")))
+		if err != nil {
+			return http.StatusBadRequest, errors.New("unknown user")
+		}
+		if err := addWorkspaceMember(h.db, workspace.ID, user.ID); err != nil {
+			return http.StatusInternalServerError, errors.New("failed to add member")
+		}
+	case "remove_member":
+		userID, err := strconv.ParseInt(r.FormValue("user_id"), 10, 64)
+		if err != nil {
+			return http.StatusBadRequest, errors.New("invalid user")
+		}
+		// Only admins can take a workspace away from its owner
+		if owner, err := queryWorkspaceOwner(h.db, workspace.ID, userID); err != nil || (owner && !auth.atLeast(roleAdmin)) {
+			return http.StatusForbidden, errors.New("the workspace owner can only be removed by an admin")
+		}
+		if err := removeWorkspaceMember(h.db, workspace.ID, userID); err != nil {
+			return http.StatusInternalServerError, errors.New("failed to remove member")
+		}
+	case "defaults":
+		workspace.DefaultTags = parseTags(r.FormValue("default_tags"))
+		workspace.DefaultUTMTemplate = strings.TrimSpace(r.FormValue("default_utm_template"))
+		workspace.DefaultPreview = r.FormValue("default_preview") != ""
+		workspace.DefaultPassthrough = r.FormValue("default_passthrough") != ""
+		if err := updateWorkspaceDefaults(h.db, workspace); err != nil {
+			return http.StatusInternalServerError, errors.New("failed to save defaults")
+		}
+	default:
+		return http.StatusBadRequest, errors.New("unknown action")
+	}
+	return 0, nil
+}
+
+// canManageMembers reports whether a request may add and remove members of
+// the active workspace, which only its owner and admins can
+func (h WorkspaceHandler) canManageMembers(auth authInfo) (bool, error) {
+	if auth.workspace.ID == 0 {
+		return false, nil
+	}
+	if auth.atLeast(roleAdmin) {
+		return true, nil
+	}
+	if !auth.atLeast(roleEditor) {
+		return false, nil
+	}
+	return queryWorkspaceOwner(h.db, auth.workspace.ID, auth.user.ID)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestWorkspaces(t *testing.T) {
+	db := setupTestDB(t)
+	cache, _ := createCache(10)
+	db.Exec("DELETE FROM workspace_members WHERE workspace_id IN (SELECT id FROM workspaces WHERE name = 'Test team')")
+	db.Exec("DELETE FROM workspaces WHERE name = 'Test team'")
+	createTestUser(t, "wsalice", "hunter2hunter2")
+	createTestUser(t, "wsbob", "hunter2hunter2")
+	createTestUser(t, "wscarol", "hunter2hunter2")
+	alice := login(t, "wsalice", "hunter2hunter2")
+	bob := login(t, "wsbob", "hunter2hunter2")
+	carol := login(t, "wscarol", "hunter2hunter2")
+
+	auth := func(h http.Handler) http.Handler {
+		return Auth{db: db, read: scopeLinksRead, write: scopeLinksWrite, next: h}
+	}
+	workspaces := Auth{db: db, read: scopeLinksRead, write: scopeLinksRead, next: WorkspaceHandler{db: db}}
+	do := func(h http.Handler, method string, path string, form url.Values, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do(workspaces, "POST", "/workspaces", url.Values{"action": {"create"}, "name": {"Test team"}}, alice)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("Expected workspace to be created, got %d: %s", w.Code, w.Body.String())
+	}
+	var team *http.Cookie
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == workspaceCookie {
+			team = cookie
+		}
+	}
+	if team == nil {
+		t.Fatal("Expected to switch to the new workspace")
+	}
+
+	form := url.Values{"action": {"defaults"}, "default_tags": {"team"}, "default_preview": {"true"}}
+	if w := do(workspaces, "POST", "/workspaces", form, alice, team); w.Code != http.StatusSeeOther {
+		t.Fatalf("Expected defaults to be saved, got %d", w.Code)
+	}
+	form = url.Values{"action": {"add_member"}, "username": {"wsbob"}}
+	if w := do(workspaces, "POST", "/workspaces", form, alice, team); w.Code != http.StatusSeeOther {
+		t.Fatalf("Expected member to be added, got %d", w.Code)
+	}
+
+	// Only the owner manages members, and nobody but an admin removes the owner
+	aliceUser, _, _ := queryUserByName(db, "wsalice")
+	form = url.Values{"action": {"add_member"}, "username": {"wscarol"}}
+	if w := do(workspaces, "POST", "/workspaces", form, bob, team); w.Code != http.StatusForbidden {
+		t.Errorf("Expected members other than the owner to be refused adding members, got %d", w.Code)
+	}
+	form = url.Values{"action": {"remove_member"}, "user_id": {fmt.Sprint(aliceUser.ID)}}
+	if w := do(workspaces, "POST", "/workspaces", form, bob, team); w.Code != http.StatusForbidden {
+		t.Errorf("Expected members to be refused removing the owner, got %d", w.Code)
+	}
+	if w := do(workspaces, "POST", "/workspaces", form, alice, team); w.Code != http.StatusForbidden {
+		t.Errorf("Expected the owner to be kept, got %d", w.Code)
+	}
+
+	// UTM templates belong to the workspace
+	utm := auth(UTMHandler{db: db})
+	form = url.Values{"name": {"wsutm"}, "source": {"team"}, "medium": {"email"}, "campaign": {"launch"}}
+	if w := do(utm, "POST", "/utm", form, bob, team); w.Code != http.StatusSeeOther {
+		t.Fatalf("Expected members to save workspace templates, got %d", w.Code)
+	}
+	teamID, _ := strconv.ParseInt(team.Value, 10, 64)
+	if _, err := queryUTMTemplate(db, teamID, "wsutm"); err != nil {
+		t.Errorf("Expected template in the workspace, got %v", err)
+	}
+	if _, err := queryUTMTemplate(db, 0, "wsutm"); err == nil {
+		t.Error("Expected workspace template to stay out of other workspaces")
+	}
+	if w := do(utm, "POST", "/utm", url.Values{"action": {"delete"}, "name": {"wsutm"}}, carol); w.Code != http.StatusSeeOther {
+		t.Fatalf("Expected delete outside the workspace to succeed, got %d", w.Code)
+	}
+	if _, err := queryUTMTemplate(db, teamID, "wsutm"); err != nil {
+		t.Error("Expected users outside the workspace not to delete its templates")
+	}
+
+	// New links get the workspace and its defaults for fields left out
+	destination := "https://workspace.example.com/shared"
+	purgeLinksTo(db, destination)
+	if w := do(auth(URLFormHandler{db: db, cache: cache}), "POST", "/create", url.Values{"url": {destination}}, alice, team); w.Code != http.StatusOK {
+		t.Fatalf("Expected link to be created, got %d", w.Code)
+	}
+	link, err := linkTo(db, destination)
+	short := link.Short
+	if err != nil || link.WorkspaceID == 0 || !link.Preview || link.TagList() != "team" {
+		t.Fatalf("Expected link in the workspace with its defaults, got %+v, %v", link, err)
+	}
+
+	home := auth(HomeHandler{db: db, cache: cache})
+	if body := do(home, "GET", "/", nil, bob, team).Body.String(); !strings.Contains(body, short) {
+		t.Error("Expected members to see the links of the workspace")
+	}
+	if body := do(home, "GET", "/", nil, alice).Body.String(); strings.Contains(body, short) {
+		t.Error("Expected workspace links to stay out of personal lists")
+	}
+	if body := do(home, "GET", "/", nil, carol, team).Body.String(); strings.Contains(body, short) {
+		t.Error("Expected non-members to be kept out of the workspace")
+	}
+
+	stats := auth(StatsHandler{db: db})
+	if w := do(stats, "GET", "/stats/"+short, nil, bob, team); w.Code != http.StatusOK {
+		t.Errorf("Expected members to see stats, got %d", w.Code)
+	}
+	if w := do(stats, "GET", "/stats/"+short, nil, carol, team); w.Code != http.StatusNotFound {
+		t.Errorf("Expected non-members to get 404 for stats, got %d", w.Code)
+	}
+
+	req := httptest.NewRequest("GET", "/u", nil)
+	req.Header.Set(workspaceHeader, team.Value)
+	req.AddCookie(carol)
+	w = httptest.NewRecorder()
+	auth(ListHandler{db: db}).ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a workspace header of a non-member, got %d", w.Code)
+	}
+
+	form = url.Values{"action": {"switch"}, "id": {team.Value}}
+	if w := do(workspaces, "POST", "/workspaces", form, carol); w.Code != http.StatusForbidden {
+		t.Errorf("Expected non-members to be refused switching, got %d", w.Code)
+	}
+
+	bobUser, _, _ := queryUserByName(db, "wsbob")
+	form = url.Values{"action": {"remove_member"}, "user_id": {fmt.Sprint(bobUser.ID)}}
+	do(workspaces, "POST", "/workspaces", form, alice, team)
+	if body := do(home, "GET", "/", nil, bob, team).Body.String(); strings.Contains(body, short) {
+		t.Error("Expected removed members to lose access")
+	}
+}